@@ -2,30 +2,55 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/codeslinger/log"
+	"github.com/rcrowley/go-metrics"
 	"net"
+	"sort"
+	"strings"
+	"time"
 )
 
 // --- Admin Service --------------------------------------------------------
 
 type AdminService struct {
-	addr     string
+	addr     net.Addr
+	server   *Server
 	exited   chan int
 	draining bool
 }
 
-// Create a new admin service instance bound to the given TCP address.
-func NewAdminService(addr string) *AdminService {
+// An admin command handler. Returns the lines of its reply, or an error to
+// report to the client.
+type adminCommand func(a *AdminService, args []string) ([]string, error)
+
+var adminCommands map[string]adminCommand
+
+const adminIdleSecs = 300
+
+func init() {
+	adminCommands = map[string]adminCommand{
+		"help":       (*AdminService).cmdHelp,
+		"ratelimits": (*AdminService).cmdRateLimits,
+		"reload":     (*AdminService).cmdReload,
+		"stats":      (*AdminService).cmdStats,
+	}
+}
+
+// Create a new admin service instance bound to the given address,
+// controlling the given server.
+func NewAdminService(addr net.Addr, server *Server) *AdminService {
 	return &AdminService{
 		addr:     addr,
+		server:   server,
 		exited:   make(chan int, 1),
 		draining: false,
 	}
 }
 
-// Returns TCP address on which this server is listening.
-func (a *AdminService) Addr() string {
+// Returns address on which this server is listening.
+func (a *AdminService) Addr() net.Addr {
 	return a.addr
 }
 
@@ -40,8 +65,10 @@ func (a *AdminService) Shutdown() {
 	a.exited <- 1
 }
 
-// Process an incoming admin service connection.
-func (a *AdminService) Handle(conn *net.TCPConn) {
+// Process an incoming admin service connection. Each line sent by the client
+// is a command followed by its arguments; replies are one or more lines
+// ending with a line of "OK" or "ERR <reason>".
+func (a *AdminService) Handle(conn net.Conn) {
 	defer func() {
 		log.Trace(func() string {
 			return fmt.Sprintf("%s: client disconnected", conn.RemoteAddr())
@@ -51,10 +78,44 @@ func (a *AdminService) Handle(conn *net.TCPConn) {
 	if a.draining {
 		return
 	}
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(time.Second * adminIdleSecs))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToLower(args[0])
+		if name == "quit" {
+			return
+		}
+		var reply []string
+		if cmd, ok := adminCommands[name]; !ok {
+			err = fmt.Errorf("unknown command: %s", name)
+		} else {
+			reply, err = cmd(a, args[1:])
+		}
+		if err != nil {
+			reply = append(reply, fmt.Sprintf("ERR %v", err))
+		} else {
+			reply = append(reply, "OK")
+		}
+		if _, err = conn.Write([]byte(strings.Join(reply, "\r\n") + "\r\n")); err != nil {
+			return
+		}
+	}
 }
 
 // Set TCP socket options on a new admin service connection.
-func (a *AdminService) SetClientOptions(conn *net.TCPConn) error {
+func (a *AdminService) SetClientOptions(c net.Conn) error {
+	conn, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
 	if err := conn.SetKeepAlive(true); err != nil {
 		log.Error("%s: SetKeepAlive: %v", conn.RemoteAddr(), err)
 		return err
@@ -65,3 +126,49 @@ func (a *AdminService) SetClientOptions(conn *net.TCPConn) error {
 	}
 	return nil
 }
+
+// List the available admin commands.
+func (a *AdminService) cmdHelp(args []string) ([]string, error) {
+	names := []string{"quit"}
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return []string{strings.Join(names, " ")}, nil
+}
+
+// Re-read the configuration file and apply it to new sessions.
+func (a *AdminService) cmdReload(args []string) ([]string, error) {
+	restart, err := a.server.Reload()
+	if err != nil {
+		return nil, err
+	}
+	if len(restart) > 0 {
+		return []string{"restart required for: " + strings.Join(restart, ", ")}, nil
+	}
+	return nil, nil
+}
+
+// Report the current value of every metric in the registry.
+func (a *AdminService) cmdStats(args []string) ([]string, error) {
+	lines := make([]string, 0)
+	a.server.Config().Metrics().Each(func(name string, i interface{}) {
+		switch m := i.(type) {
+		case metrics.Counter:
+			lines = append(lines, fmt.Sprintf("%s %d", name, m.Count()))
+		case metrics.Gauge:
+			lines = append(lines, fmt.Sprintf("%s %d", name, m.Value()))
+		case metrics.Meter:
+			lines = append(lines, fmt.Sprintf("%s %d %.2f/min", name, m.Count(), m.Rate1()*60))
+		case metrics.Histogram:
+			lines = append(lines, fmt.Sprintf("%s %d", name, m.Count()))
+		}
+	})
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// Report the state of every client that is currently being rate limited.
+func (a *AdminService) cmdRateLimits(args []string) ([]string, error) {
+	return a.server.State().Rates.State(), nil
+}
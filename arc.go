@@ -0,0 +1,264 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/codeslinger/log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- ARC ------------------------------------------------------------------
+
+// The result of validating a message's ARC chain (RFC 8617), and the
+// instance number of its most recent ARC set. Temporary is set if the
+// chain could not be validated for a reason that may go away, such as a
+// DNS failure.
+type ARCCheck struct {
+	Result    string
+	Instance  int
+	Reason    string
+	Temporary bool
+}
+
+// The three headers of one ARC set.
+type arcSet struct {
+	results   string
+	signature string
+	seal      string
+}
+
+const (
+	ARCNone = "none"
+	ARCPass = "pass"
+	ARCFail = "fail"
+
+	arcMaxInstance = 50
+	arcResultsName = "ARC-Authentication-Results"
+	arcMessageName = "ARC-Message-Signature"
+	arcSealName    = "ARC-Seal"
+)
+
+// Validate the ARC chain of a message, looking up keys through the given
+// resolver.
+func VerifyARC(r Resolver, msg string) *ARCCheck {
+	headers, body := splitMessage(msg)
+	sets, n, err := collectARCSets(headers)
+	c := &ARCCheck{Result: ARCPass, Instance: n}
+	if n == 0 {
+		c.Result = ARCNone
+		return c
+	}
+	if err == nil {
+		err = verifyARCChain(r, sets, headers, body)
+	}
+	if err != nil {
+		c.Result, c.Reason = ARCFail, err.Error()
+		if de, ok := err.(*dkimError); ok && de.result == DKIMTempError {
+			c.Temporary = true
+		}
+	}
+	return c
+}
+
+func (c *ARCCheck) String() string {
+	return fmt.Sprintf("%s (i=%d)", c.Result, c.Instance)
+}
+
+// Check the structure of an ARC chain, its most recent message signature,
+// and all of its seals.
+func verifyARCChain(r Resolver, sets []*arcSet, headers []string, body string) error {
+	n := len(sets) - 1
+	for i := 1; i <= n; i++ {
+		cv := strings.ToLower(arcTag(sets[i].seal, "cv"))
+		if (i == 1 && cv != ARCNone) || (i > 1 && cv != ARCPass) {
+			return &dkimError{DKIMFail, fmt.Sprintf("seal %d has cv=%s", i, cv)}
+		}
+	}
+	tags, err := parseTagList(headerValue(sets[n].signature))
+	if err != nil {
+		return &dkimError{DKIMFail, "malformed message signature"}
+	}
+	sig, err := newDKIMSignature(sets[n].signature, tags, true)
+	if err == nil {
+		err = sig.verify(r, headers, body)
+	}
+	if err != nil {
+		return err
+	}
+	for i := n; i >= 1; i-- {
+		if err = verifyARCSeal(r, sets, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the seal of the ARC set with the given instance number.
+func verifyARCSeal(r Resolver, sets []*arcSet, i int) error {
+	tags, err := parseTagList(headerValue(sets[i].seal))
+	if err != nil || tags["b"] == "" || tags["d"] == "" || tags["s"] == "" {
+		return &dkimError{DKIMFail, fmt.Sprintf("malformed seal %d", i)}
+	}
+	if a := strings.ToLower(tags["a"]); a != "rsa-sha256" {
+		return &dkimError{DKIMFail, "unsupported seal algorithm " + a}
+	}
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return &dkimError{DKIMFail, fmt.Sprintf("malformed seal %d", i)}
+	}
+	key, err := lookupDKIMKey(r, tags["s"], tags["d"], "rsa-sha256")
+	if err != nil {
+		return err
+	}
+	hash := arcSealHash(sets[:i], sets[i].results, sets[i].signature, stripSignatureData(sets[i].seal))
+	if rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, hash, sig) != nil {
+		return &dkimError{DKIMFail, fmt.Sprintf("seal %d did not verify", i)}
+	}
+	return nil
+}
+
+// Gather the ARC sets of a message, indexed by instance number, along with
+// the highest instance number found. An error is returned if the sets do
+// not form a complete chain.
+func collectARCSets(headers []string) ([]*arcSet, int, error) {
+	found := make(map[int]*arcSet)
+	n := 0
+	for _, h := range headers {
+		var slot *string
+		i, err := strconv.Atoi(arcTag(h, "i"))
+		switch {
+		case isHeader(h, arcResultsName), isHeader(h, arcMessageName), isHeader(h, arcSealName):
+			if err != nil || i < 1 || i > arcMaxInstance {
+				return nil, 1, &dkimError{DKIMFail, "bad ARC instance number"}
+			}
+		default:
+			continue
+		}
+		set, ok := found[i]
+		if !ok {
+			set = &arcSet{}
+			found[i] = set
+		}
+		switch {
+		case isHeader(h, arcResultsName):
+			slot = &set.results
+		case isHeader(h, arcMessageName):
+			slot = &set.signature
+		default:
+			slot = &set.seal
+		}
+		if *slot != "" {
+			return nil, i, &dkimError{DKIMFail, fmt.Sprintf("duplicate ARC header for instance %d", i)}
+		}
+		*slot = h
+		if i > n {
+			n = i
+		}
+	}
+	sets := make([]*arcSet, n+1)
+	for i := 1; i <= n; i++ {
+		set, ok := found[i]
+		if !ok || set.results == "" || set.signature == "" || set.seal == "" {
+			return nil, n, &dkimError{DKIMFail, fmt.Sprintf("incomplete ARC set %d", i)}
+		}
+		sets[i] = set
+	}
+	return sets, n, nil
+}
+
+// Hash the ARC sets before a new seal, then the given results and message
+// signature headers of the set being sealed and its seal without a trailing
+// line break (RFC 8617 section 5.1.1).
+func arcSealHash(prior []*arcSet, results, signature, seal string) []byte {
+	h := sha256.New()
+	for _, set := range prior {
+		if set == nil {
+			continue
+		}
+		h.Write([]byte(canonHeader(set.results, "relaxed")))
+		h.Write([]byte(canonHeader(set.signature, "relaxed")))
+		h.Write([]byte(canonHeader(set.seal, "relaxed")))
+	}
+	h.Write([]byte(canonHeader(results, "relaxed")))
+	h.Write([]byte(canonHeader(signature, "relaxed")))
+	h.Write([]byte(strings.TrimSuffix(canonHeader(seal, "relaxed"), "\r\n")))
+	return h.Sum(nil)
+}
+
+// Return the headers of a new ARC set sealing the given message, which
+// records the given authentication results and chain validation result.
+func (s *DKIMSigner) Seal(msg, authserv string, results []string, chain *ARCCheck, names []string, now time.Time) (string, error) {
+	key, ok := s.Key.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("ARC sealing requires an RSA key")
+	}
+	headers, body := splitMessage(msg)
+	sets, _, _ := collectARCSets(headers)
+	i := chain.Instance + 1
+	aar := fmt.Sprintf("%s: i=%d; %s;\r\n\t%s\r\n", arcResultsName, i, authserv, strings.Join(results, ";\r\n\t"))
+	signed := make([]string, 0, len(names))
+	for _, name := range append(names, dkimHeaderName) {
+		for _, h := range headers {
+			if isHeader(h, name) {
+				signed = append(signed, strings.ToLower(name))
+			}
+		}
+	}
+	bh := sha256.Sum256([]byte(canonBody(body, "relaxed")))
+	ams := fmt.Sprintf("%s: i=%d; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		arcMessageName, i, s.Domain, s.Selector, now.Unix(),
+		strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bh[:]))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, signedHeaderHash(headers, signed, "relaxed", ams))
+	if err != nil {
+		return "", err
+	}
+	ams += foldBase64(base64.StdEncoding.EncodeToString(sig)) + "\r\n"
+	cv := chain.Result
+	seal := fmt.Sprintf("%s: i=%d; a=rsa-sha256; t=%d; cv=%s;\r\n\td=%s; s=%s;\r\n\tb=",
+		arcSealName, i, now.Unix(), cv, s.Domain, s.Selector)
+	sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, arcSealHash(sets, aar, ams, seal))
+	if err != nil {
+		return "", err
+	}
+	seal += foldBase64(base64.StdEncoding.EncodeToString(sig)) + "\r\n"
+	return seal + ams + aar, nil
+}
+
+// Add an ARC set to the current message, if sealing is enabled and the
+// chain it carries can still be extended.
+func (s *SMTPSession) sealARC() {
+	signer := s.cfg.ARCSealer()
+	c := s.message.ARC
+	if signer == nil || c == nil || c.Temporary || c.Instance >= arcMaxInstance {
+		return
+	}
+	headers, err := signer.Seal(s.message.Body, s.cfg.ServingDomain(), s.message.authResults(),
+		c, s.cfg.DKIMSignHeaders(), time.Now())
+	if err != nil {
+		log.Error("%s: failed to seal message for %s: %v", s.remote, signer.Domain, err)
+		return
+	}
+	s.message.Body = headers + s.message.Body
+}
+
+// Return the value of a tag in a header whose value is a tag list, or an
+// empty string if it has no such tag. ARC-Authentication-Results headers
+// are not tag lists after their first tag, so only as much of the value as
+// is needed is parsed.
+func arcTag(field, name string) string {
+	for _, part := range strings.Split(headerValue(field), ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == name {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
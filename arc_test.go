@@ -0,0 +1,177 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Return signers for two forwarding hosts, and a resolver publishing their
+// keys.
+func arcHops(t *testing.T) (*DKIMSigner, *DKIMSigner, *fakeResolver) {
+	r := &fakeResolver{txt: make(map[string][]string)}
+	hops := make([]*DKIMSigner, 2)
+	for i, domain := range []string{"hop1.example", "hop2.example"} {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.txt["arc._domainkey."+domain] = []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)}
+		hops[i] = &DKIMSigner{Domain: domain, Selector: "arc", Key: key}
+	}
+	return hops[0], hops[1], r
+}
+
+// Add an ARC set to a message as the given hop would, having found the
+// given chain on it.
+func arcSeal(t *testing.T, hop *DKIMSigner, msg string, chain *ARCCheck) string {
+	headers, err := hop.Seal(msg, hop.Domain, []string{"spf=pass smtp.mailfrom=example.org"}, chain,
+		DefaultDKIMSignHeaders, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return headers + msg
+}
+
+// Return a message sealed by both hops, checking the chain after each.
+func arcTwoHops(t *testing.T, hop1, hop2 *DKIMSigner, r *fakeResolver) string {
+	c := VerifyARC(r, dkimTestMessage)
+	if c.Result != ARCNone || c.Instance != 0 {
+		t.Fatalf("unsealed message: got %s", c)
+	}
+	msg := arcSeal(t, hop1, dkimTestMessage, c)
+	if c = VerifyARC(r, msg); c.Result != ARCPass || c.Instance != 1 {
+		t.Fatalf("after one hop: got %s (%s)", c, c.Reason)
+	}
+	msg = arcSeal(t, hop2, msg, c)
+	if c = VerifyARC(r, msg); c.Result != ARCPass || c.Instance != 2 {
+		t.Fatalf("after two hops: got %s (%s)", c, c.Reason)
+	}
+	return msg
+}
+
+// Rejoin the headers and body of a message split by splitMessage.
+func joinMessage(headers []string, body string) string {
+	return strings.Join(headers, "") + "\r\n" + body
+}
+
+// Return the message with the first of its headers with the given name and
+// ARC instance number passed through edit. A nil edit removes the header.
+func editARCHeader(msg, name string, i int, edit func(string) string) string {
+	headers, body := splitMessage(msg)
+	for j, h := range headers {
+		if isHeader(h, name) && arcTag(h, "i") == strconv.Itoa(i) {
+			if edit == nil {
+				headers = append(headers[:j], headers[j+1:]...)
+			} else {
+				headers[j] = edit(h)
+			}
+			break
+		}
+	}
+	return joinMessage(headers, body)
+}
+
+func TestARCSealTwoHops(t *testing.T) {
+	hop1, hop2, r := arcHops(t)
+	msg := arcTwoHops(t, hop1, hop2, r)
+	headers, _ := splitMessage(msg)
+	sets, n, err := collectARCSets(headers)
+	if err != nil || n != 2 {
+		t.Fatalf("got %d sets (%v)", n, err)
+	}
+	for i, want := range map[int]string{1: ARCNone, 2: ARCPass} {
+		if arcTag(sets[i].seal, "cv") != want {
+			t.Errorf("seal %d: got cv=%s, want cv=%s", i, arcTag(sets[i].seal, "cv"), want)
+		}
+	}
+	if d := arcTag(sets[2].signature, "d"); d != "hop2.example" {
+		t.Errorf("message signature 2 has d=%s", d)
+	}
+	if !strings.HasPrefix(sets[1].results, "ARC-Authentication-Results: i=1; hop1.example;\r\n\tspf=pass") {
+		t.Errorf("got results %q", sets[1].results)
+	}
+}
+
+func TestARCTampered(t *testing.T) {
+	hop1, hop2, r := arcHops(t)
+	msg := arcTwoHops(t, hop1, hop2, r)
+	replace := func(old, new string) func(string) string {
+		return func(h string) string { return strings.Replace(h, old, new, 1) }
+	}
+	tests := []struct {
+		name string
+		msg  string
+	}{
+		{"body changed", strings.Replace(msg, "Hi", "Bye", 1)},
+		{"signed header changed", strings.Replace(msg, "Subject:  Hello", "Subject:  Goodbye", 1)},
+		{"earlier results changed", editARCHeader(msg, arcResultsName, 1, replace("spf=pass", "spf=fail"))},
+		{"earlier message signature changed", editARCHeader(msg, arcMessageName, 1, replace("c=relaxed", "c=relaxed/simple"))},
+		{"earlier seal changed", editARCHeader(msg, arcSealName, 1, replace("cv=none", "cv=none "))},
+		{"set missing results", editARCHeader(msg, arcResultsName, 1, nil)},
+		{"set missing seal", editARCHeader(msg, arcSealName, 2, nil)},
+		{"instance gap", editARCHeader(editARCHeader(editARCHeader(msg,
+			arcSealName, 2, replace("i=2", "i=3")),
+			arcMessageName, 2, replace("i=2", "i=3")),
+			arcResultsName, 2, replace("i=2", "i=3"))},
+		{"duplicate set", strings.Replace(msg, "\r\n\r\n", "\r\n"+strings.SplitAfter(msg, "\r\n")[0]+"\r\n", 1)},
+		{"bad instance", "ARC-Seal: i=x; a=rsa-sha256; cv=none; d=hop1.example; s=arc; b=\r\n" + dkimTestMessage},
+		{"instance too high", "ARC-Seal: i=51; a=rsa-sha256; cv=none; d=hop1.example; s=arc; b=\r\n" + dkimTestMessage},
+	}
+	for _, test := range tests {
+		if c := VerifyARC(r, test.msg); c.Result != ARCFail || c.Temporary {
+			t.Errorf("%s: got %s (%s)", test.name, c, c.Reason)
+		}
+	}
+}
+
+func TestARCChainValidation(t *testing.T) {
+	hop1, hop2, r := arcHops(t)
+	tests := []struct {
+		name   string
+		chains []*ARCCheck
+	}{
+		// The first set must say there was no chain before it.
+		{"first set cv=pass", []*ARCCheck{{Result: ARCPass}}},
+		// Later sets must say the chain they found was valid.
+		{"later set cv=fail", []*ARCCheck{{Result: ARCNone}, {Result: ARCFail, Instance: 1}}},
+		{"later set cv=none", []*ARCCheck{{Result: ARCNone}, {Result: ARCNone, Instance: 1}}},
+	}
+	for _, test := range tests {
+		msg := dkimTestMessage
+		for i, chain := range test.chains {
+			msg = arcSeal(t, []*DKIMSigner{hop1, hop2}[i], msg, chain)
+		}
+		c := VerifyARC(r, msg)
+		if c.Result != ARCFail || !strings.Contains(c.Reason, "cv=") {
+			t.Errorf("%s: got %s (%s)", test.name, c, c.Reason)
+		}
+	}
+}
+
+func TestARCKeyUnavailable(t *testing.T) {
+	hop1, hop2, r := arcHops(t)
+	msg := arcTwoHops(t, hop1, hop2, r)
+	delete(r.txt, "arc._domainkey.hop1.example")
+	r.fail = map[string]bool{"arc._domainkey.hop1.example": true}
+	if c := VerifyARC(r, msg); c.Result != ARCFail || !c.Temporary {
+		t.Errorf("got %s (%s), temporary %v", c, c.Reason, c.Temporary)
+	}
+}
+
+func TestARCSealRequiresRSA(t *testing.T) {
+	signer := &DKIMSigner{Domain: "example.org", Selector: "sel", Key: newEd25519Key(t)}
+	if _, err := signer.Seal(dkimTestMessage, "example.org", nil, &ARCCheck{Result: ARCNone}, DefaultDKIMSignHeaders, time.Now()); err == nil {
+		t.Error("sealed with an Ed25519 key")
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/codeslinger/log"
+	"net"
+	"strings"
+	"time"
+)
+
+// --- ClamAV ---------------------------------------------------------------
+
+// Settings for scanning messages for viruses with clamd. If clamd cannot be
+// reached, messages are refused temporarily unless FailOpen is set. Messages
+// larger than MaxSize are not scanned; Oversize says whether they are
+// accepted anyway or refused, permanently or temporarily.
+type ClamdPolicy struct {
+	Addr     net.Addr
+	FailOpen bool
+	MaxSize  int
+	Oversize string
+	Timeout  time.Duration
+}
+
+const (
+	ClamdAccept   = "accept"
+	ClamdReject   = "reject"
+	ClamdTempfail = "tempfail"
+
+	defaultClamdMaxSize = 25 * 1024 * 1024
+	defaultClamdTimeout = 30 * time.Second
+	clamdChunkSize      = 64 * 1024
+)
+
+// Have clamd scan a message with the INSTREAM command, returning the name
+// of the virus found, or an empty string if the message is clean.
+func ScanClamd(p *ClamdPolicy, msg string) (string, error) {
+	conn, err := net.DialTimeout(p.Addr.Network(), p.Addr.String(), p.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(p.Timeout)); err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	size := make([]byte, 4)
+	for len(msg) > 0 {
+		chunk := msg
+		if len(chunk) > clamdChunkSize {
+			chunk = chunk[:clamdChunkSize]
+		}
+		msg = msg[len(chunk):]
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+		w.Write(size)
+		w.WriteString(chunk)
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	w.Write(size)
+	if err = w.Flush(); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	// The reply is "stream: OK", "stream: <name> FOUND" or "<reason> ERROR".
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", errors.New("clamd error: " + reply)
+}
+
+// Scan the current message for viruses. If the message must be refused, the
+// reply code and text are returned.
+func (s *SMTPSession) checkVirus() (int, string) {
+	p := s.cfg.Clamd()
+	if p == nil {
+		return 0, ""
+	}
+	if len(s.message.Body) > p.MaxSize {
+		log.Warn("%s: message of %d bytes too large to scan for viruses (action: %s)", s.remote, len(s.message.Body), p.Oversize)
+		switch p.Oversize {
+		case ClamdReject:
+			return 552, "5.3.4 Message too large to scan for viruses"
+		case ClamdTempfail:
+			return 451, "4.7.1 Unable to scan message for viruses, try again later"
+		}
+		return 0, ""
+	}
+	virus, err := ScanClamd(p, s.message.Body+"\r\n")
+	if err != nil {
+		log.Warn("%s: virus scan failed: %v", s.remote, err)
+		if p.FailOpen {
+			return 0, ""
+		}
+		return 451, "4.7.1 Unable to scan message for viruses, try again later"
+	}
+	if virus == "" {
+		return 0, ""
+	}
+	s.message.Virus = virus
+	s.shared.VirusRejected.Inc(1)
+	return 554, "5.7.1 Virus found: " + virus
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Start a clamd on a local port that finds the given virus in every message,
+// or none if it is empty, and return its address. Each message it reads is
+// sent on scanned.
+func fakeClamd(t *testing.T, virus string, scanned chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+				conn.Close()
+				continue
+			}
+			var msg []byte
+			size := make([]byte, 4)
+			for {
+				if _, err := io.ReadFull(r, size); err != nil {
+					break
+				}
+				n := binary.BigEndian.Uint32(size)
+				if n == 0 {
+					break
+				}
+				chunk := make([]byte, n)
+				io.ReadFull(r, chunk)
+				msg = append(msg, chunk...)
+			}
+			if scanned != nil {
+				scanned <- string(msg)
+			}
+			if virus == "" {
+				io.WriteString(conn, "stream: OK\x00")
+			} else {
+				io.WriteString(conn, "stream: "+virus+" FOUND\x00")
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestScanClamd(t *testing.T) {
+	scanned := make(chan string, 1)
+	addr, _ := ResolveAddr(fakeClamd(t, "Eicar-Test-Signature", scanned))
+	p := &ClamdPolicy{Addr: addr, MaxSize: 10, Timeout: defaultClamdTimeout}
+	msg := strings.Repeat("x", 3*clamdChunkSize/2)
+	virus, err := ScanClamd(p, msg)
+	if err != nil || virus != "Eicar-Test-Signature" {
+		t.Errorf("got %q (%v)", virus, err)
+	}
+	if got := <-scanned; got != msg {
+		t.Errorf("clamd was sent %d bytes, want %d", len(got), len(msg))
+	}
+}
+
+func TestClamdOversize(t *testing.T) {
+	tests := map[string]int{
+		ClamdAccept:   250,
+		ClamdReject:   552,
+		ClamdTempfail: 451,
+	}
+	for action, code := range tests {
+		cfg := testConfig(t,
+			"domain: mx.example.com",
+			"localdomains: example.com",
+			"clamd: "+fakeClamd(t, "Eicar-Test-Signature", nil),
+			"clamdmaxsize: 1024",
+			"clamdoversize: "+action)
+		c := startSession(t, cfg, "198.51.100.7", nil)
+		c.send(250, "EHLO client.example")
+		c.send(250, "MAIL FROM:<a@elsewhere.example>")
+		c.send(250, "RCPT TO:<user@example.com>")
+		c.send(354, "DATA")
+		if got := c.cmd("Subject: hi\r\n\r\n%s\r\n.", strings.Repeat("x", 2048)); got != code {
+			t.Errorf("%s: got reply %d, want %d", action, got, code)
+		}
+		c.send(250, "MAIL FROM:<a@elsewhere.example>")
+		c.send(250, "RCPT TO:<user@example.com>")
+		c.send(354, "DATA")
+		c.send(554, "Subject: hi\r\n\r\nsmall\r\n.")
+	}
+}
@@ -3,6 +3,8 @@ package main
 
 import (
 	"bufio"
+	"crypto/rsa"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/codeslinger/log"
@@ -17,21 +19,96 @@ import (
 )
 
 type Config interface {
-	ListenLocal() *net.TCPAddr
+	Listeners() []*ListenerProfile
+	TLSConfig() *tls.Config
+	XclientHosts() NetList
+	XforwardHosts() NetList
+	TrustedHosts() NetList
+	AdminLocal() net.Addr
+	LogLevel() log.Level
 	MaxIdleSecs() int
+	MaxConns() int
+	MaxConnsPerIP() int
+	ConnRate() int
+	MsgRate() int
+	RcptRate() int
+	Greylisting() *GreylistPolicy
+	GreylistDB() string
+	Tarpit() *TarpitPolicy
+	DNSBL() *DNSBLPolicy
+	SPF() *SPFPolicy
+	DKIMVerify() bool
+	DKIMSigner(domain string) *DKIMSigner
+	DKIMSignHeaders() []string
+	DKIMSignHosts() NetList
+	DMARC() *DMARCPolicy
+	DMARCReports() *DMARCReportPolicy
+	PublicSuffixes() *PublicSuffixList
+	ARCVerify() bool
+	ARCSealer() *DKIMSigner
+	Milters() *MilterPolicy
+	Spamd() *SpamdPolicy
+	Clamd() *ClamdPolicy
+	Recipients() LookupTable
+	Routing() *RoutingPolicy
+	Resolver() Resolver
 	MaxMsgSize() int
 	ServingDomain() string
 	SoftwareIdent() string
 	Metrics() metrics.Registry
 	Cores() int
+	Close()
 }
 
 type config struct {
 	domain              string
 	ident               string
-	listenAddr          *net.TCPAddr
+	listenAddr          net.Addr
+	listeners           []*ListenerProfile
+	block               *ListenerProfile
+	tlsCertFile         string
+	tlsKeyFile          string
+	tlsConfig           *tls.Config
+	adminAddr           net.Addr
+	xclientHosts        NetList
+	xforwardHosts       NetList
+	trustedHosts        NetList
 	loglevel            log.Level
 	maxIdleSecs         int
+	maxConns            int
+	maxConnsPerIP       int
+	connRate            int
+	msgRate             int
+	rcptRate            int
+	greylist            bool
+	greylistPolicy      *GreylistPolicy
+	greylistDB          string
+	tarpit              *TarpitPolicy
+	dnsbl               *DNSBLPolicy
+	spf                 bool
+	spfPolicy           *SPFPolicy
+	dkimVerify          bool
+	dkimSigners         map[string]*DKIMSigner
+	dkimSignHeaders     []string
+	dkimSignHosts       NetList
+	dmarc               bool
+	dmarcPolicy         *DMARCPolicy
+	dmarcReports        *DMARCReportPolicy
+	publicSuffixes      *PublicSuffixList
+	arcVerify           bool
+	arcSeal             bool
+	arcDomain           string
+	arcSealer           *DKIMSigner
+	milters             *MilterPolicy
+	spamd               *SpamdPolicy
+	clamd               *ClamdPolicy
+	recipients          LookupTable
+	routing             *RoutingPolicy
+	aliases             map[string]LookupTable
+	catchAll            map[string]string
+	dnsServer           string
+	dnsTimeoutSecs      int
+	resolver            Resolver
 	maxMsgSize          int
 	memStatsRefreshSecs int
 	registry            metrics.Registry
@@ -40,6 +117,9 @@ type config struct {
 
 const (
 	defaultListenAddr          = "0.0.0.0:1025"
+	defaultGreylistDelay       = 5 * time.Minute
+	defaultGreylistRetry       = 4 * time.Hour
+	defaultGreylistExpiry      = 36 * 24 * time.Hour
 	defaultSoftwareIdent       = "Go25"
 	defaultMemStatsRefreshSecs = 10
 	defaultLogLevel            = log.TRACE
@@ -47,9 +127,43 @@ const (
 	defaultMaxMsgSize          = 16777216
 )
 
-// Return the local address on which this SMTP service is to listen.
-func (c *config) ListenLocal() *net.TCPAddr {
-	return c.listenAddr
+// Return the profiles of the listeners on which this SMTP service accepts
+// connections.
+func (c *config) Listeners() []*ListenerProfile {
+	return c.listeners
+}
+
+// Return the TLS settings used for STARTTLS and SMTPS, or nil if no
+// certificate has been configured.
+func (c *config) TLSConfig() *tls.Config {
+	return c.tlsConfig
+}
+
+// Return the networks from which front-end proxies may use XCLIENT.
+func (c *config) XclientHosts() NetList {
+	return c.xclientHosts
+}
+
+// Return the networks from which front-end proxies may use XFORWARD.
+func (c *config) XforwardHosts() NetList {
+	return c.xforwardHosts
+}
+
+// Return the networks whose clients may relay mail to any domain, as
+// authenticated and local clients may.
+func (c *config) TrustedHosts() NetList {
+	return c.trustedHosts
+}
+
+// Return the local address on which the admin service is to listen, or nil
+// if the admin service is disabled.
+func (c *config) AdminLocal() net.Addr {
+	return c.adminAddr
+}
+
+// Return the level at which log messages are emitted.
+func (c *config) LogLevel() log.Level {
+	return c.loglevel
 }
 
 // Return the timeout at which a session is considered idle and should be
@@ -58,6 +172,177 @@ func (c *config) MaxIdleSecs() int {
 	return c.maxIdleSecs
 }
 
+// Return the maximum number of concurrent SMTP connections, or zero if there
+// is no limit.
+func (c *config) MaxConns() int {
+	return c.maxConns
+}
+
+// Return the maximum number of concurrent SMTP connections from a single
+// client IP address, or zero if there is no limit.
+func (c *config) MaxConnsPerIP() int {
+	return c.maxConnsPerIP
+}
+
+// Return the number of connections allowed per minute from a single client
+// IP address, or zero if there is no limit.
+func (c *config) ConnRate() int {
+	return c.connRate
+}
+
+// Return the number of messages allowed per hour from a single client IP
+// address or authenticated user, or zero if there is no limit.
+func (c *config) MsgRate() int {
+	return c.msgRate
+}
+
+// Return the number of recipients allowed per hour from a single client IP
+// address or authenticated user, or zero if there is no limit.
+func (c *config) RcptRate() int {
+	return c.rcptRate
+}
+
+// Return the greylisting policy, or nil if greylisting is disabled.
+func (c *config) Greylisting() *GreylistPolicy {
+	if !c.greylist {
+		return nil
+	}
+	return c.greylistPolicy
+}
+
+// Return the path of the file in which greylisting state is kept, or an
+// empty string to keep it in memory only.
+func (c *config) GreylistDB() string {
+	return c.greylistDB
+}
+
+// Return the policy for delaying and disconnecting clients that make
+// errors.
+func (c *config) Tarpit() *TarpitPolicy {
+	return c.tarpit
+}
+
+// Return the DNS blocklist policy, or nil if no blocklists are configured.
+func (c *config) DNSBL() *DNSBLPolicy {
+	if len(c.dnsbl.Zones) == 0 {
+		return nil
+	}
+	return c.dnsbl
+}
+
+// Return the SPF policy, or nil if SPF checking is disabled.
+func (c *config) SPF() *SPFPolicy {
+	if !c.spf {
+		return nil
+	}
+	return c.spfPolicy
+}
+
+// Return whether the DKIM signatures of received messages are verified.
+func (c *config) DKIMVerify() bool {
+	return c.dkimVerify
+}
+
+// Return the key with which to sign messages from the given domain, or from
+// the nearest parent domain that has one, or nil if there is none.
+func (c *config) DKIMSigner(domain string) *DKIMSigner {
+	for domain != "" {
+		if s, ok := c.dkimSigners[domain]; ok {
+			return s
+		}
+		dot := strings.IndexByte(domain, '.')
+		if dot < 0 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+	return nil
+}
+
+// Return the names of the headers to sign with DKIM.
+func (c *config) DKIMSignHeaders() []string {
+	return c.dkimSignHeaders
+}
+
+// Return the networks whose messages are signed with DKIM, in addition to
+// those submitted by authenticated or local clients.
+func (c *config) DKIMSignHosts() NetList {
+	return c.dkimSignHosts
+}
+
+// Return the DMARC policy, or nil if DMARC evaluation is disabled.
+func (c *config) DMARC() *DMARCPolicy {
+	if !c.dmarc {
+		return nil
+	}
+	return c.dmarcPolicy
+}
+
+// Return the settings for collecting DMARC aggregate reports.
+func (c *config) DMARCReports() *DMARCReportPolicy {
+	return c.dmarcReports
+}
+
+// Return the Public Suffix List, or nil if none is configured.
+func (c *config) PublicSuffixes() *PublicSuffixList {
+	return c.publicSuffixes
+}
+
+// Return whether the ARC chains of received messages are validated. Chains
+// are always validated when sealing is enabled.
+func (c *config) ARCVerify() bool {
+	return c.arcVerify || c.arcSealer != nil
+}
+
+// Return the key with which to add ARC sets to received messages, or nil if
+// ARC sealing is disabled.
+func (c *config) ARCSealer() *DKIMSigner {
+	return c.arcSealer
+}
+
+// Return the settings for calling content filters, or nil if there are
+// none.
+func (c *config) Milters() *MilterPolicy {
+	if len(c.milters.Addrs) == 0 {
+		return nil
+	}
+	return c.milters
+}
+
+// Return the settings for checking messages with spamd, or nil if spamd is
+// not used.
+func (c *config) Spamd() *SpamdPolicy {
+	if c.spamd.Addr == nil {
+		return nil
+	}
+	return c.spamd
+}
+
+// Return the settings for scanning messages with clamd, or nil if clamd is
+// not used.
+func (c *config) Clamd() *ClamdPolicy {
+	if c.clamd.Addr == nil {
+		return nil
+	}
+	return c.clamd
+}
+
+// Return the table of addresses in local domains that mail is accepted for,
+// or nil if mail is accepted for any address in them.
+func (c *config) Recipients() LookupTable {
+	return c.recipients
+}
+
+// Return the settings for routing mail by the domain of its recipients.
+func (c *config) Routing() *RoutingPolicy {
+	return c.routing
+}
+
+// Return the resolver through which all DNS lookups are made.
+func (c *config) Resolver() Resolver {
+	return c.resolver
+}
+
 // Return the maximum size of a message allowed, in bytes.
 func (c *config) MaxMsgSize() int {
 	return c.maxMsgSize
@@ -83,14 +368,28 @@ func (c *config) Cores() int {
 	return c.cores
 }
 
+// Close the lookup tables opened for this configuration, once it has been
+// replaced or could not be used.
+func (c *config) Close() {
+	if c.recipients != nil {
+		c.recipients.Close()
+	}
+	for _, t := range c.aliases {
+		t.Close()
+	}
+}
+
 func (c *config) String() string {
 	return fmt.Sprintf(
-		"listen=%s domain=%s ident='%s' log=%s maxidle=%ds maxmsg=%dB statsrefresh=%ds cores=%d",
-		c.listenAddr,
+		"listen=%v admin=%v domain=%s ident='%s' log=%s maxidle=%ds maxconns=%d/%d maxmsg=%dB statsrefresh=%ds cores=%d",
+		c.listeners,
+		c.adminAddr,
 		c.domain,
 		c.ident,
 		c.loglevel,
 		c.maxIdleSecs,
+		c.maxConns,
+		c.maxConnsPerIP,
 		c.maxMsgSize,
 		c.memStatsRefreshSecs,
 		c.cores)
@@ -100,7 +399,7 @@ func (c *config) String() string {
 // path given is an empty string, the default configuration record will be
 // returned.
 func LoadConfig(path string) (Config, error) {
-	c := newConfig()
+	c := newConfig(metrics.NewRegistry())
 	err := c.setDefaults()
 	if err != nil {
 		return nil, err
@@ -110,17 +409,170 @@ func LoadConfig(path string) (Config, error) {
 			return nil, err
 		}
 	}
+	if err = c.finish(); err != nil {
+		return nil, err
+	}
 	log.SetLevel(c.loglevel)
+	metrics.RegisterRuntimeMemStats(c.registry)
+	go c.memStatsRefresh()
 	return c, nil
 }
 
-func newConfig() *config {
+// Return a new configuration record populated from the given file, to
+// replace the currently running configuration. Directives that cannot take
+// effect without a restart keep their running values in the returned record
+// and their names are returned so the caller can report them.
+func ReloadConfig(path string, running Config) (Config, []string, error) {
+	old, ok := running.(*config)
+	if !ok {
+		return nil, nil, errors.New("running configuration cannot be reloaded")
+	}
+	c := newConfig(old.registry)
+	if err := c.setDefaults(); err != nil {
+		return nil, nil, err
+	}
+	if path != "" {
+		if err := c.readConfig(path); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+	if err := c.finish(); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, c.keepRestartOnly(old), nil
+}
+
+func newConfig(registry metrics.Registry) *config {
 	return &config{
-		registry:   metrics.NewRegistry(),
+		registry:   registry,
 		domain:     "",
 		ident:      "",
 		listenAddr: nil,
+		adminAddr:  nil,
+	}
+}
+
+// Copy over values from the running configuration for those directives that
+// are only read at startup, returning the names of any that differ.
+func (c *config) keepRestartOnly(old *config) []string {
+	changed := make([]string, 0)
+	if !sameListeners(c.listeners, old.listeners) {
+		changed = append(changed, "listen/listener")
+		c.listenAddr = old.listenAddr
+		c.listeners = old.listeners
+	}
+	if fmt.Sprint(c.adminAddr) != fmt.Sprint(old.adminAddr) {
+		changed = append(changed, "adminlisten")
+		c.adminAddr = old.adminAddr
+	}
+	if c.cores != old.cores {
+		changed = append(changed, "cores")
+		c.cores = old.cores
+	}
+	if c.greylistDB != old.greylistDB {
+		changed = append(changed, "greylistdb")
+		c.greylistDB = old.greylistDB
+	}
+	if *c.dmarcReports != *old.dmarcReports {
+		changed = append(changed, "dmarcreport*")
+		c.dmarcReports = old.dmarcReports
+	}
+	if c.memStatsRefreshSecs != old.memStatsRefreshSecs {
+		changed = append(changed, "statsrefresh")
+		c.memStatsRefreshSecs = old.memStatsRefreshSecs
+	}
+	return changed
+}
+
+// Report whether two sets of listener profiles bind the same names to the
+// same addresses.
+func sameListeners(a, b []*ListenerProfile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Addr.String() != b[i].Addr.String() {
+			return false
+		}
+	}
+	return true
+}
+
+// Complete and check the configuration once all directives have been read.
+func (c *config) finish() (err error) {
+	if c.block != nil {
+		return errors.New(fmt.Sprintf("listener '%s' is missing its 'end' line", c.block.Name))
+	}
+	if c.tlsCertFile != "" || c.tlsKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.tlsCertFile, c.tlsKeyFile)
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to load TLS certificate: %v", err))
+		}
+		c.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	c.resolver = NewResolver(c.dnsServer, time.Second*time.Duration(c.dnsTimeoutSecs))
+	if c.dmarc && (!c.spf || !c.dkimVerify) {
+		return errors.New("'dmarc' requires 'spf' and 'dkimverify' to be enabled")
+	}
+	// Without the list, unrelated domains under suffixes like co.uk would
+	// share an organizational domain and pass relaxed alignment.
+	if c.dmarc && c.publicSuffixes == nil {
+		return errors.New("'dmarc' requires 'publicsuffixlist' to be set")
+	}
+	if c.arcSeal {
+		if c.arcDomain == "" {
+			c.arcDomain = c.domain
+		}
+		c.arcSealer = c.dkimSigners[strings.ToLower(c.arcDomain)]
+		if c.arcSealer == nil {
+			return errors.New(fmt.Sprintf("'arcseal' requires a 'dkimkey' for %s", c.arcDomain))
+		}
+		if _, ok := c.arcSealer.Key.(*rsa.PrivateKey); !ok {
+			return errors.New(fmt.Sprintf("'arcseal' requires an RSA key for %s", c.arcDomain))
+		}
+	}
+	if len(c.routing.Local) == 0 {
+		domain := strings.ToLower(c.domain)
+		c.routing.Local[domain] = &LocalDomain{Name: domain}
+	}
+	for domain := range c.routing.Relay {
+		if c.routing.Local[domain] != nil {
+			return errors.New(fmt.Sprintf("%s is in both 'localdomains' and 'relaydomains'", domain))
+		}
+	}
+	for domain, t := range c.aliases {
+		d := c.routing.Local[domain]
+		if d == nil {
+			return errors.New(fmt.Sprintf("'aliases' given for %s, which is not in 'localdomains'", domain))
+		}
+		d.Aliases = t
+	}
+	for domain, addr := range c.catchAll {
+		d := c.routing.Local[domain]
+		if d == nil {
+			return errors.New(fmt.Sprintf("'catchall' given for %s, which is not in 'localdomains'", domain))
+		}
+		d.CatchAll = addr
+	}
+	if c.dmarcReports.OrgName == "" {
+		c.dmarcReports.OrgName = c.domain
+	}
+	if c.dmarcReports.Email == "" {
+		c.dmarcReports.Email = "postmaster@" + c.domain
+	}
+	if len(c.listeners) == 0 {
+		p := NewListenerProfile(defaultListenerName)
+		p.Addr = c.listenAddr
+		c.listeners = append(c.listeners, p)
 	}
+	for _, p := range c.listeners {
+		if err = p.validate(c); err != nil {
+			return
+		}
+	}
+	return nil
 }
 
 func (c *config) setDefaults() (err error) {
@@ -142,8 +594,25 @@ func (c *config) setDefaults() (err error) {
 	c.maxIdleSecs = defaultMaxIdleSecs
 	c.maxMsgSize = defaultMaxMsgSize
 	c.cores = runtime.NumCPU()
-	metrics.RegisterRuntimeMemStats(c.registry)
-	go c.memStatsRefresh()
+	c.tarpit = &TarpitPolicy{Delay: defaultTarpitDelay, Max: defaultTarpitMax}
+	c.dnsbl = &DNSBLPolicy{Threshold: defaultDNSBLThreshold, Message: defaultDNSBLMessage}
+	c.dnsTimeoutSecs = defaultDNSTimeoutSecs
+	c.spfPolicy = NewSPFPolicy()
+	c.dkimSigners = make(map[string]*DKIMSigner)
+	c.dkimSignHeaders = DefaultDKIMSignHeaders
+	c.dmarcPolicy = NewDMARCPolicy()
+	c.dmarcReports = &DMARCReportPolicy{Interval: defaultDMARCReportInterval}
+	c.milters = &MilterPolicy{Default: MilterTempfail, Timeout: defaultMilterTimeout}
+	c.spamd = &SpamdPolicy{MaxSize: defaultSpamdMaxSize, Timeout: defaultSpamdTimeout}
+	c.clamd = &ClamdPolicy{MaxSize: defaultClamdMaxSize, Oversize: ClamdAccept, Timeout: defaultClamdTimeout}
+	c.routing = &RoutingPolicy{Local: make(map[string]*LocalDomain), Relay: make(map[string]bool)}
+	c.aliases = make(map[string]LookupTable)
+	c.catchAll = make(map[string]string)
+	c.greylistPolicy = &GreylistPolicy{
+		Delay:  defaultGreylistDelay,
+		Retry:  defaultGreylistRetry,
+		Expiry: defaultGreylistExpiry,
+	}
 	return
 }
 
@@ -152,6 +621,7 @@ func (c *config) readConfig(path string) (err error) {
 	if err != nil {
 		return
 	}
+	defer file.Close()
 	rd := bufio.NewReader(file)
 	idx := 0
 	for {
@@ -166,7 +636,13 @@ func (c *config) readConfig(path string) (err error) {
 		idx++
 		line = strings.Trim(line, "\r\n")
 		// skip comments and blank lines
-		if len(strings.Trim(line, " ")) == 0 || line[0] == '#' {
+		line = strings.Trim(line, " \t")
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if c.block != nil && strings.ToLower(line) == "end" {
+			c.listeners = append(c.listeners, c.block)
+			c.block = nil
 			continue
 		}
 		if err = c.parseLine(line, idx); err != nil {
@@ -178,9 +654,87 @@ func (c *config) readConfig(path string) (err error) {
 
 func (c *config) parseLine(line string, idx int) (err error) {
 	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 {
+		return errors.New(fmt.Sprintf("line %d: expected 'directive: argument'", idx))
+	}
 	directive := strings.Trim(parts[0], " ")
 	argument := strings.Trim(parts[1], " ")
+	if c.block != nil {
+		return c.block.parseLine(directive, argument, idx)
+	}
 	switch strings.ToLower(directive) {
+	case "adminlisten":
+		if c.adminAddr, err = ResolveAddr(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: failed to resolve 'adminlisten' address: %v", idx, err))
+		}
+	case "aliases":
+		f := strings.Fields(argument)
+		if len(f) != 2 || !validDomain(f[0]) {
+			return errors.New(fmt.Sprintf("line %d: expected 'aliases: <domain> <table>'", idx))
+		}
+		t, err := OpenLookupTable(f[1])
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d: failed to open alias table: %v", idx, err))
+		}
+		domain := strings.ToLower(f[0])
+		if old := c.aliases[domain]; old != nil {
+			old.Close()
+		}
+		c.aliases[domain] = t
+	case "arcdomain":
+		if !validDomain(argument) {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'arcdomain' ('%s')", idx, argument))
+		}
+		c.arcDomain = argument
+	case "arcseal":
+		if c.arcSeal, err = parseBool(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'arcseal' ('%s')", idx, argument))
+		}
+	case "arcverify":
+		if c.arcVerify, err = parseBool(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'arcverify' ('%s')", idx, argument))
+		}
+	case "catchall":
+		f := strings.Fields(argument)
+		if len(f) != 2 || !validDomain(f[0]) {
+			return errors.New(fmt.Sprintf("line %d: expected 'catchall: <domain> <address>'", idx))
+		}
+		domain := strings.ToLower(f[0])
+		if !strings.Contains(f[1], "@") {
+			f[1] += "@" + domain
+		}
+		c.catchAll[domain] = f[1]
+	case "clamd":
+		if c.clamd.Addr, err = ResolveAddr(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: failed to resolve 'clamd' address: %v", idx, err))
+		}
+	case "clamdfailopen":
+		if c.clamd.FailOpen, err = parseBool(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'clamdfailopen' ('%s')", idx, argument))
+		}
+	case "clamdmaxsize":
+		c.clamd.MaxSize, err = strconv.Atoi(argument)
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'clamdmaxsize' ('%s'): %v", idx, argument, err))
+		}
+		if c.clamd.MaxSize < 1 {
+			return errors.New(fmt.Sprintf("line %d: 'clamdmaxsize' value cannot be <1 byte", idx))
+		}
+	case "clamdoversize":
+		switch strings.ToLower(argument) {
+		case ClamdAccept, ClamdReject, ClamdTempfail:
+			c.clamd.Oversize = strings.ToLower(argument)
+		default:
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'clamdoversize' ('%s')", idx, argument))
+		}
+	case "clamdtimeout":
+		if c.clamd.Timeout, err = parseSecs("clamdtimeout", argument, idx); err != nil {
+			return err
+		}
+	case "connrate":
+		if c.connRate, err = parseLimit("connrate", argument, idx); err != nil {
+			return err
+		}
 	case "cores":
 		if len(argument) == 0 {
 			return errors.New(fmt.Sprintf("line %d: argument to 'cores' cannot be blank", idx))
@@ -189,6 +743,80 @@ func (c *config) parseLine(line string, idx int) (err error) {
 		if err != nil {
 			return errors.New(fmt.Sprintf("line %d: malformed integer: %s", idx, argument))
 		}
+	case "dkimkey":
+		f := strings.Fields(argument)
+		if len(f) != 3 {
+			return errors.New(fmt.Sprintf("line %d: expected 'dkimkey: <domain> <selector> <keyfile>'", idx))
+		}
+		s, err := LoadDKIMSigner(f[0], f[1], f[2])
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d: failed to load DKIM key: %v", idx, err))
+		}
+		c.dkimSigners[s.Domain] = s
+	case "dkimsignheaders":
+		c.dkimSignHeaders = strings.FieldsFunc(argument, func(r rune) bool { return r == ':' || r == ',' || r == ' ' })
+		if len(c.dkimSignHeaders) == 0 {
+			return errors.New(fmt.Sprintf("line %d: argument to 'dkimsignheaders' cannot be blank", idx))
+		}
+		signsFrom := false
+		for _, h := range c.dkimSignHeaders {
+			signsFrom = signsFrom || strings.EqualFold(h, "From")
+		}
+		if !signsFrom {
+			return errors.New(fmt.Sprintf("line %d: 'dkimsignheaders' must include From", idx))
+		}
+	case "dkimsignhosts":
+		if c.dkimSignHosts, err = ParseNetList(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'dkimsignhosts': %v", idx, err))
+		}
+	case "dkimverify":
+		if c.dkimVerify, err = parseBool(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'dkimverify' ('%s')", idx, argument))
+		}
+	case "dmarc":
+		if c.dmarc, err = parseBool(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'dmarc' ('%s')", idx, argument))
+		}
+	case "dmarcaction":
+		if err = c.dmarcPolicy.parseActions(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'dmarcaction': %v", idx, err))
+		}
+	case "dmarcreportdir":
+		c.dmarcReports.Dir = argument
+	case "dmarcreportemail":
+		c.dmarcReports.Email = argument
+	case "dmarcreportinterval":
+		if c.dmarcReports.Interval, err = parseSecs("dmarcreportinterval", argument, idx); err != nil {
+			return err
+		}
+	case "dmarcreportorg":
+		c.dmarcReports.OrgName = argument
+	case "dnsbl":
+		z, err := parseDNSBLZone(argument)
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'dnsbl': %v", idx, err))
+		}
+		c.dnsbl.Zones = append(c.dnsbl.Zones, z)
+	case "dnsblmessage":
+		if len(argument) == 0 {
+			return errors.New(fmt.Sprintf("line %d: argument to 'dnsblmessage' cannot be blank", idx))
+		}
+		c.dnsbl.Message = argument
+	case "dnsblthreshold":
+		if c.dnsbl.Threshold, err = parseLimit("dnsblthreshold", argument, idx); err != nil {
+			return err
+		}
+	case "dnsserver":
+		if _, _, err = net.SplitHostPort(argument); argument != "" && err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'dnsserver': %v", idx, err))
+		}
+		c.dnsServer = argument
+	case "dnstimeout":
+		var timeout time.Duration
+		if timeout, err = parseSecs("dnstimeout", argument, idx); err != nil {
+			return err
+		}
+		c.dnsTimeoutSecs = int(timeout / time.Second)
 	case "domain":
 		if len(argument) == 0 {
 			return errors.New(fmt.Sprintf("line %d: argument to 'domain' cannot be blank", idx))
@@ -203,6 +831,50 @@ func (c *config) parseLine(line string, idx int) (err error) {
 		if err = c.setListenAddr(argument); err != nil {
 			return errors.New(fmt.Sprintf("line %d: failed to resolve 'listen' address: %v", idx, err))
 		}
+	case "greylist":
+		if c.greylist, err = parseBool(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'greylist' ('%s')", idx, argument))
+		}
+	case "greylistallow":
+		nets, domains, err := parseGreylistAllow(argument)
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'greylistallow': %v", idx, err))
+		}
+		p := c.greylistPolicy
+		p.Allow = append(p.Allow, nets...)
+		p.Domain = append(p.Domain, domains...)
+	case "greylistdb":
+		c.greylistDB = argument
+	case "greylistdelay":
+		if c.greylistPolicy.Delay, err = parseSecs("greylistdelay", argument, idx); err != nil {
+			return err
+		}
+	case "greylistexpiry":
+		if c.greylistPolicy.Expiry, err = parseSecs("greylistexpiry", argument, idx); err != nil {
+			return err
+		}
+	case "greylistretry":
+		if c.greylistPolicy.Retry, err = parseSecs("greylistretry", argument, idx); err != nil {
+			return err
+		}
+	case "listener":
+		if len(argument) == 0 {
+			return errors.New(fmt.Sprintf("line %d: argument to 'listener' cannot be blank", idx))
+		}
+		for _, p := range c.listeners {
+			if p.Name == argument {
+				return errors.New(fmt.Sprintf("line %d: duplicate listener '%s'", idx, argument))
+			}
+		}
+		c.block = NewListenerProfile(argument)
+	case "localdomains":
+		for _, domain := range strings.FieldsFunc(argument, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			if !validDomain(domain) {
+				return errors.New(fmt.Sprintf("line %d: invalid domain in 'localdomains' ('%s')", idx, domain))
+			}
+			domain = strings.ToLower(domain)
+			c.routing.Local[domain] = &LocalDomain{Name: domain}
+		}
 	case "loglevel":
 		if len(argument) == 0 {
 			return errors.New(fmt.Sprintf("line %d: argument to 'loglevel' cannot be blank", idx))
@@ -219,6 +891,18 @@ func (c *config) parseLine(line string, idx int) (err error) {
 		if c.maxIdleSecs < 1 {
 			return errors.New(fmt.Sprintf("line %d: 'maxidle' value cannot be <1 second", idx))
 		}
+	case "maxconns":
+		if c.maxConns, err = parseLimit("maxconns", argument, idx); err != nil {
+			return err
+		}
+	case "maxconnsperip":
+		if c.maxConnsPerIP, err = parseLimit("maxconnsperip", argument, idx); err != nil {
+			return err
+		}
+	case "maxerrors":
+		if c.tarpit.MaxErrors, err = parseLimit("maxerrors", argument, idx); err != nil {
+			return err
+		}
 	case "maxmsgsize":
 		c.maxMsgSize, err = strconv.Atoi(argument)
 		if err != nil {
@@ -227,6 +911,84 @@ func (c *config) parseLine(line string, idx int) (err error) {
 		if c.maxMsgSize < 1 {
 			return errors.New(fmt.Sprintf("line %d: 'maxmsgsize' value cannot be <1 byte", idx))
 		}
+	case "milter":
+		addr, err := ResolveAddr(argument)
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d: failed to resolve 'milter' address: %v", idx, err))
+		}
+		c.milters.Addrs = append(c.milters.Addrs, addr)
+	case "milterdefault":
+		switch strings.ToLower(argument) {
+		case MilterAccept, MilterReject, MilterTempfail:
+			c.milters.Default = strings.ToLower(argument)
+		default:
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'milterdefault' ('%s')", idx, argument))
+		}
+	case "miltertimeout":
+		if c.milters.Timeout, err = parseSecs("miltertimeout", argument, idx); err != nil {
+			return err
+		}
+	case "msgrate":
+		if c.msgRate, err = parseLimit("msgrate", argument, idx); err != nil {
+			return err
+		}
+	case "rcptrate":
+		if c.rcptRate, err = parseLimit("rcptrate", argument, idx); err != nil {
+			return err
+		}
+	case "publicsuffixlist":
+		if c.publicSuffixes, err = LoadPublicSuffixList(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: failed to load public suffix list: %v", idx, err))
+		}
+	case "recipientdelimiter":
+		c.routing.Delimiter = argument
+	case "recipients":
+		t, err := OpenLookupTable(argument)
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d: failed to open recipient table: %v", idx, err))
+		}
+		if c.recipients != nil {
+			c.recipients.Close()
+		}
+		c.recipients = t
+	case "relaydomains":
+		for _, domain := range strings.FieldsFunc(argument, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			if !validDomain(domain) {
+				return errors.New(fmt.Sprintf("line %d: invalid domain in 'relaydomains' ('%s')", idx, domain))
+			}
+			c.routing.Relay[strings.ToLower(domain)] = true
+		}
+	case "spamd":
+		if c.spamd.Addr, err = ResolveAddr(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: failed to resolve 'spamd' address: %v", idx, err))
+		}
+	case "spamdmaxsize":
+		c.spamd.MaxSize, err = strconv.Atoi(argument)
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'spamdmaxsize' ('%s'): %v", idx, argument, err))
+		}
+		if c.spamd.MaxSize < 1 {
+			return errors.New(fmt.Sprintf("line %d: 'spamdmaxsize' value cannot be <1 byte", idx))
+		}
+	case "spamdreject":
+		c.spamd.Reject, err = strconv.ParseFloat(argument, 64)
+		if err != nil || c.spamd.Reject < 0 {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'spamdreject' ('%s')", idx, argument))
+		}
+	case "spamdtimeout":
+		if c.spamd.Timeout, err = parseSecs("spamdtimeout", argument, idx); err != nil {
+			return err
+		}
+	case "spamduser":
+		c.spamd.User = argument
+	case "spf":
+		if c.spf, err = parseBool(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'spf' ('%s')", idx, argument))
+		}
+	case "spfaction":
+		if err = c.spfPolicy.parseActions(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'spfaction': %v", idx, err))
+		}
 	case "statsrefresh":
 		c.memStatsRefreshSecs, err = strconv.Atoi(argument)
 		if err != nil {
@@ -235,6 +997,34 @@ func (c *config) parseLine(line string, idx int) (err error) {
 		if c.memStatsRefreshSecs < 1 {
 			return errors.New(fmt.Sprintf("line %d: 'statsrefresh' interval cannot be <1 second", idx))
 		}
+	case "tarpitafter":
+		if c.tarpit.After, err = parseLimit("tarpitafter", argument, idx); err != nil {
+			return err
+		}
+	case "tarpitdelay":
+		if c.tarpit.Delay, err = parseSecs("tarpitdelay", argument, idx); err != nil {
+			return err
+		}
+	case "tarpitmax":
+		if c.tarpit.Max, err = parseSecs("tarpitmax", argument, idx); err != nil {
+			return err
+		}
+	case "tlscert":
+		c.tlsCertFile = argument
+	case "tlskey":
+		c.tlsKeyFile = argument
+	case "trustedhosts":
+		if c.trustedHosts, err = ParseNetList(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'trustedhosts': %v", idx, err))
+		}
+	case "xclienthosts":
+		if c.xclientHosts, err = ParseNetList(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'xclienthosts': %v", idx, err))
+		}
+	case "xforwardhosts":
+		if c.xforwardHosts, err = ParseNetList(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'xforwardhosts': %v", idx, err))
+		}
 	default:
 		return errors.New(fmt.Sprintf("line %d: unrecognized directive: %s", idx, directive))
 	}
@@ -242,7 +1032,7 @@ func (c *config) parseLine(line string, idx int) (err error) {
 }
 
 func (c *config) setListenAddr(addr string) (err error) {
-	c.listenAddr, err = net.ResolveTCPAddr("tcp", addr)
+	c.listenAddr, err = ResolveAddr(addr)
 	return
 }
 
@@ -268,3 +1058,28 @@ func (c *config) parseLogLevel(s string) (log.Level, error) {
 	}
 	return -1, errors.New("unknown log level")
 }
+
+// Parse the argument to a directive that sets a limit, where zero means no
+// limit.
+func parseLimit(directive, argument string, idx int) (int, error) {
+	n, err := strconv.Atoi(argument)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("line %d: invalid argument to '%s' ('%s'): %v", idx, directive, argument, err))
+	}
+	if n < 0 {
+		return 0, errors.New(fmt.Sprintf("line %d: '%s' value cannot be <0", idx, directive))
+	}
+	return n, nil
+}
+
+// Parse the argument to a directive that sets a duration in seconds.
+func parseSecs(directive, argument string, idx int) (time.Duration, error) {
+	n, err := strconv.Atoi(argument)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("line %d: invalid argument to '%s' ('%s'): %v", idx, directive, argument, err))
+	}
+	if n < 1 {
+		return 0, errors.New(fmt.Sprintf("line %d: '%s' value cannot be <1 second", idx, directive))
+	}
+	return time.Second * time.Duration(n), nil
+}
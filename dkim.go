@@ -0,0 +1,441 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- DKIM -----------------------------------------------------------------
+
+// The result of verifying a DKIM signature, as named in Authentication-
+// Results headers (RFC 8601).
+type DKIMResult string
+
+const (
+	DKIMPass      DKIMResult = "pass"
+	DKIMFail      DKIMResult = "fail"
+	DKIMNeutral   DKIMResult = "neutral"
+	DKIMTempError DKIMResult = "temperror"
+	DKIMPermError DKIMResult = "permerror"
+)
+
+// The outcome of verifying one DKIM-Signature header of a message. Reason
+// explains any result other than a pass.
+type DKIMCheck struct {
+	Domain    string
+	Selector  string
+	Identity  string
+	Signature string
+	Result    DKIMResult
+	Reason    string
+}
+
+// A parsed DKIM-Signature header.
+type dkimSignature struct {
+	field       string
+	tags        map[string]string
+	algorithm   string
+	headerCanon string
+	bodyCanon   string
+	headers     []string
+	bodyLength  int
+	signature   []byte
+	bodyHash    []byte
+}
+
+const (
+	dkimMaxSignatures = 5
+	dkimMinRSABits    = 1024
+	dkimHeaderName    = "DKIM-Signature"
+)
+
+// An error that decides the result of a signature check.
+type dkimError struct {
+	result DKIMResult
+	reason string
+}
+
+func (e *dkimError) Error() string {
+	return e.reason
+}
+
+// Verify the DKIM signatures of a message, looking up keys through the
+// given resolver. At most dkimMaxSignatures signatures are checked.
+func VerifyDKIM(r Resolver, msg string) []*DKIMCheck {
+	headers, body := splitMessage(msg)
+	checks := make([]*DKIMCheck, 0)
+	for _, h := range headers {
+		if !isHeader(h, dkimHeaderName) {
+			continue
+		}
+		if len(checks) == dkimMaxSignatures {
+			break
+		}
+		checks = append(checks, verifySignature(r, h, headers, body))
+	}
+	return checks
+}
+
+func (c *DKIMCheck) String() string {
+	return fmt.Sprintf("%s (d=%s s=%s)", c.Result, c.Domain, c.Selector)
+}
+
+// Verify one DKIM-Signature header against the headers and body of its
+// message.
+func verifySignature(r Resolver, field string, headers []string, body string) *DKIMCheck {
+	c := &DKIMCheck{Result: DKIMPass}
+	sig, err := parseDKIMSignature(field)
+	if sig != nil {
+		c.Domain, c.Selector, c.Identity = sig.tags["d"], sig.tags["s"], sig.tags["i"]
+		c.Signature = sig.tags["b"]
+	}
+	if err == nil {
+		err = sig.verify(r, headers, body)
+	}
+	if err != nil {
+		c.Result, c.Reason = DKIMPermError, err.Error()
+		if de, ok := err.(*dkimError); ok {
+			c.Result = de.result
+		}
+	}
+	return c
+}
+
+// Parse and check the tags of a DKIM-Signature header.
+func parseDKIMSignature(field string) (*dkimSignature, error) {
+	tags, err := parseTagList(headerValue(field))
+	if err != nil {
+		return nil, &dkimError{DKIMNeutral, "malformed signature: " + err.Error()}
+	}
+	sig := &dkimSignature{field: field, tags: tags}
+	if tags["v"] != "1" {
+		return sig, &dkimError{DKIMNeutral, "unsupported signature version"}
+	}
+	return newDKIMSignature(field, tags, false)
+}
+
+// Check the tags of a DKIM-Signature header, or of an ARC-Message-Signature
+// header if arc is true. The two differ only in that the i= tag of the
+// latter holds the instance number of its ARC set.
+func newDKIMSignature(field string, tags map[string]string, arc bool) (*dkimSignature, error) {
+	var err error
+	sig := &dkimSignature{field: field, tags: tags, headerCanon: "simple", bodyCanon: "simple", bodyLength: -1}
+	for _, t := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[t]; !ok {
+			return sig, &dkimError{DKIMNeutral, "signature missing required tag " + t}
+		}
+	}
+	sig.algorithm = strings.ToLower(tags["a"])
+	if sig.algorithm != "rsa-sha256" && sig.algorithm != "ed25519-sha256" {
+		return sig, &dkimError{DKIMNeutral, "unsupported algorithm " + sig.algorithm}
+	}
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		sig.headerCanon = parts[0]
+		if len(parts) == 2 {
+			sig.bodyCanon = parts[1]
+		}
+		for _, canon := range []string{sig.headerCanon, sig.bodyCanon} {
+			if canon != "simple" && canon != "relaxed" {
+				return sig, &dkimError{DKIMNeutral, "unsupported canonicalization " + canon}
+			}
+		}
+	}
+	for _, h := range strings.Split(tags["h"], ":") {
+		sig.headers = append(sig.headers, strings.TrimSpace(h))
+	}
+	signsFrom := false
+	for _, h := range sig.headers {
+		signsFrom = signsFrom || strings.EqualFold(h, "From")
+	}
+	if !signsFrom {
+		return sig, &dkimError{DKIMNeutral, "From header not signed"}
+	}
+	if l, ok := tags["l"]; ok {
+		if sig.bodyLength, err = strconv.Atoi(l); err != nil || sig.bodyLength < 0 {
+			return sig, &dkimError{DKIMNeutral, "malformed body length"}
+		}
+	}
+	domain := strings.ToLower(tags["d"])
+	if i, ok := tags["i"]; ok && !arc {
+		at := strings.LastIndex(i, "@")
+		id := strings.ToLower(i[at+1:])
+		if at < 0 || (id != domain && !strings.HasSuffix(id, "."+domain)) {
+			return sig, &dkimError{DKIMNeutral, "identity not within signing domain"}
+		}
+	}
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return sig, &dkimError{DKIMNeutral, "malformed expiration"}
+		}
+		if time.Now().Unix() > expires {
+			return sig, &dkimError{DKIMNeutral, "signature expired"}
+		}
+	}
+	if sig.signature, err = base64.StdEncoding.DecodeString(tags["b"]); err != nil {
+		return sig, &dkimError{DKIMNeutral, "malformed signature data"}
+	}
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(tags["bh"]); err != nil {
+		return sig, &dkimError{DKIMNeutral, "malformed body hash"}
+	}
+	return sig, nil
+}
+
+// Check the body hash and signature.
+func (sig *dkimSignature) verify(r Resolver, headers []string, body string) error {
+	body = canonBody(body, sig.bodyCanon)
+	if sig.bodyLength >= 0 {
+		if sig.bodyLength > len(body) {
+			return &dkimError{DKIMFail, "body shorter than signed length"}
+		}
+		body = body[:sig.bodyLength]
+	}
+	bh := sha256.Sum256([]byte(body))
+	if string(bh[:]) != string(sig.bodyHash) {
+		return &dkimError{DKIMFail, "body hash did not verify"}
+	}
+	key, err := lookupDKIMKey(r, sig.tags["s"], sig.tags["d"], sig.algorithm)
+	if err != nil {
+		return err
+	}
+	hash := signedHeaderHash(headers, sig.headers, sig.headerCanon, stripSignatureData(sig.field))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, hash, sig.signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hash, sig.signature) {
+			err = errors.New("bad signature")
+		}
+	}
+	if err != nil {
+		return &dkimError{DKIMFail, "signature did not verify"}
+	}
+	return nil
+}
+
+// Fetch and parse the public key for a selector and domain, checking that
+// it suits the signature's algorithm.
+func lookupDKIMKey(r Resolver, selector, domain, algorithm string) (crypto.PublicKey, error) {
+	txts, err := r.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, &dkimError{DKIMPermError, "no key for signature"}
+		}
+		return nil, &dkimError{DKIMTempError, "key unavailable"}
+	}
+	if len(txts) != 1 {
+		return nil, &dkimError{DKIMPermError, "no single key record"}
+	}
+	tags, err := parseTagList(txts[0])
+	if err != nil {
+		return nil, &dkimError{DKIMPermError, "malformed key record"}
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, &dkimError{DKIMPermError, "unsupported key version"}
+	}
+	if h, ok := tags["h"]; ok && !strings.Contains(":"+strings.ToLower(h)+":", ":sha256:") {
+		return nil, &dkimError{DKIMPermError, "key does not allow sha256"}
+	}
+	kind := strings.ToLower(tags["k"])
+	if kind == "" {
+		kind = "rsa"
+	}
+	if !strings.HasPrefix(algorithm, kind+"-") {
+		return nil, &dkimError{DKIMPermError, "key type does not match algorithm"}
+	}
+	if tags["p"] == "" {
+		return nil, &dkimError{DKIMPermError, "key revoked"}
+	}
+	data, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, &dkimError{DKIMPermError, "malformed key data"}
+	}
+	if kind == "ed25519" {
+		if len(data) != ed25519.PublicKeySize {
+			return nil, &dkimError{DKIMPermError, "malformed key data"}
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	var key *rsa.PublicKey
+	if pub, err := x509.ParsePKIXPublicKey(data); err == nil {
+		key, _ = pub.(*rsa.PublicKey)
+	} else {
+		key, _ = x509.ParsePKCS1PublicKey(data)
+	}
+	if key == nil {
+		return nil, &dkimError{DKIMPermError, "malformed key data"}
+	}
+	if key.N.BitLen() < dkimMinRSABits {
+		return nil, &dkimError{DKIMPermError, "key too short"}
+	}
+	return key, nil
+}
+
+// Hash the headers named by a signature, taking each name's instances from
+// the bottom up, followed by the signature header itself without a trailing
+// line break.
+func signedHeaderHash(headers, names []string, canon, sigField string) []byte {
+	used := make(map[int]bool)
+	h := sha256.New()
+	for _, name := range names {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !used[i] && isHeader(headers[i], name) {
+				used[i] = true
+				h.Write([]byte(canonHeader(headers[i], canon)))
+				break
+			}
+		}
+	}
+	h.Write([]byte(strings.TrimSuffix(canonHeader(sigField, canon), "\r\n")))
+	return h.Sum(nil)
+}
+
+// Canonicalize a header field, given with its line break, by the simple or
+// relaxed algorithm of RFC 6376 section 3.4.
+func canonHeader(field, canon string) string {
+	if canon == "simple" {
+		return field
+	}
+	colon := strings.IndexByte(field, ':')
+	name := strings.ToLower(strings.TrimRight(field[:colon], " \t"))
+	value := strings.ReplaceAll(strings.TrimSuffix(field[colon+1:], "\r\n"), "\r\n", "")
+	return name + ":" + strings.TrimSpace(collapseWSP(value)) + "\r\n"
+}
+
+// Canonicalize a message body by the simple or relaxed algorithm of RFC
+// 6376 section 3.4.
+func canonBody(body, canon string) string {
+	if canon == "relaxed" {
+		lines := strings.Split(body, "\r\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(collapseWSP(line), " ")
+		}
+		body = strings.Join(lines, "\r\n")
+	}
+	body = strings.TrimRight(body, "\r\n")
+	if body == "" {
+		if canon == "relaxed" {
+			return ""
+		}
+		return "\r\n"
+	}
+	return body + "\r\n"
+}
+
+// Replace each run of spaces and tabs with a single space.
+func collapseWSP(s string) string {
+	var out strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			out.WriteByte(' ')
+			space = false
+		}
+		out.WriteByte(s[i])
+	}
+	if space {
+		out.WriteByte(' ')
+	}
+	return out.String()
+}
+
+// Return a DKIM-Signature header with the value of its b= tag removed, as
+// it is when hashed.
+func stripSignatureData(field string) string {
+	colon := strings.IndexByte(field, ':')
+	pos := colon + 1
+	for pos < len(field) {
+		end := strings.IndexByte(field[pos:], ';')
+		if end < 0 {
+			end = len(field) - pos
+		}
+		tag := field[pos : pos+end]
+		if eq := strings.IndexByte(tag, '='); eq >= 0 && strings.TrimSpace(tag[:eq]) == "b" {
+			value := strings.TrimSuffix(tag[eq+1:], "\r\n")
+			rest := tag[eq+1+len(value):]
+			return field[:pos+eq+1] + rest + field[pos+end:]
+		}
+		pos += end + 1
+	}
+	return field
+}
+
+// Parse a DKIM tag list ("tag=value; tag=value"), removing whitespace from
+// the values.
+func parseTagList(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		eq := strings.IndexByte(part, '=')
+		if eq < 0 {
+			return nil, errors.New("tag without value")
+		}
+		name := strings.TrimSpace(part[:eq])
+		if _, dup := tags[name]; dup || name == "" {
+			return nil, errors.New("duplicate or empty tag " + name)
+		}
+		tags[name] = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, part[eq+1:])
+	}
+	return tags, nil
+}
+
+// Split a message into its header fields, each with its continuation lines
+// and line break, and its body.
+func splitMessage(msg string) ([]string, string) {
+	headers := make([]string, 0)
+	for len(msg) > 0 {
+		if strings.HasPrefix(msg, "\r\n") {
+			return headers, msg[2:]
+		}
+		end := 0
+		for {
+			i := strings.Index(msg[end:], "\r\n")
+			if i < 0 {
+				end = len(msg)
+				break
+			}
+			end += i + 2
+			if end >= len(msg) || (msg[end] != ' ' && msg[end] != '\t') {
+				break
+			}
+		}
+		headers = append(headers, msg[:end])
+		msg = msg[end:]
+	}
+	return headers, ""
+}
+
+// Report whether a header field has the given name.
+func isHeader(field, name string) bool {
+	colon := strings.IndexByte(field, ':')
+	return colon >= 0 && strings.EqualFold(strings.TrimRight(field[:colon], " \t"), name)
+}
+
+// Return the value of a header field, unfolded, without its name or line
+// break.
+func headerValue(field string) string {
+	colon := strings.IndexByte(field, ':')
+	return strings.TrimSpace(strings.ReplaceAll(field[colon+1:], "\r\n", ""))
+}
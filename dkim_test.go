@@ -0,0 +1,183 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The example of RFC 6376 section 3.4.6.
+const canonExample = "A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"
+
+// A message whose headers and body both have whitespace that relaxed
+// canonicalization removes.
+const dkimTestMessage = "From: a@example.org\r\nSubject:  Hello \r\n\tthere\r\nTo: b@example.com\r\n\r\nHi  there \r\n\r\n\r\n"
+
+// Return a DKIM-Signature header for a message from example.org with the
+// given canonicalization, signing its From and Subject headers. Signatures
+// made this way can use simple canonicalization, which Sign does not.
+func testDKIMSignature(key ed25519.PrivateKey, canon, msg string) string {
+	headers, body := splitMessage(msg)
+	parts := strings.SplitN(canon, "/", 2)
+	bh := sha256.Sum256([]byte(canonBody(body, parts[1])))
+	field := fmt.Sprintf("DKIM-Signature: v=1; a=ed25519-sha256; c=%s; d=example.org; s=sel;\r\n\th=from:subject; bh=%s; b=",
+		canon, base64.StdEncoding.EncodeToString(bh[:]))
+	sig := ed25519.Sign(key, signedHeaderHash(headers, []string{"from", "subject"}, parts[0], field))
+	return field + base64.StdEncoding.EncodeToString(sig) + "\r\n"
+}
+
+// Return the key record publishing the given Ed25519 key.
+func ed25519KeyRecord(key ed25519.PrivateKey) string {
+	return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// Return a resolver publishing the given key for selector sel of example.org.
+func dkimResolver(record string) *fakeResolver {
+	return &fakeResolver{txt: map[string][]string{"sel._domainkey.example.org": {record}}}
+}
+
+func TestCanonHeader(t *testing.T) {
+	headers, _ := splitMessage(canonExample)
+	simple, relaxed := "", ""
+	for _, h := range headers {
+		simple += canonHeader(h, "simple")
+		relaxed += canonHeader(h, "relaxed")
+	}
+	if want := "A: X\r\nB : Y\t\r\n\tZ  \r\n"; simple != want {
+		t.Errorf("simple: got %q, want %q", simple, want)
+	}
+	if want := "a:X\r\nb:Y Z\r\n"; relaxed != want {
+		t.Errorf("relaxed: got %q, want %q", relaxed, want)
+	}
+}
+
+func TestCanonBody(t *testing.T) {
+	_, body := splitMessage(canonExample)
+	tests := []struct {
+		body, canon, want string
+	}{
+		{body, "simple", " C \r\nD \t E\r\n"},
+		{body, "relaxed", " C\r\nD E\r\n"},
+		{"", "simple", "\r\n"},
+		{"", "relaxed", ""},
+		{"\r\n\r\n", "simple", "\r\n"},
+		{"\r\n\r\n", "relaxed", ""},
+	}
+	for _, test := range tests {
+		if got := canonBody(test.body, test.canon); got != test.want {
+			t.Errorf("%s %q: got %q, want %q", test.canon, test.body, got, test.want)
+		}
+	}
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	key := newEd25519Key(t)
+	tests := []struct {
+		name     string
+		from, to string
+		simple   DKIMResult
+		relaxed  DKIMResult
+		reason   string
+	}{
+		{"unchanged", "", "", DKIMPass, DKIMPass, ""},
+		{"unsigned header changed", "To: b@", "To: c@", DKIMPass, DKIMPass, ""},
+		{"header whitespace changed", "Subject:  Hello \r\n\tthere", "Subject: Hello there", DKIMFail, DKIMPass, "signature did not verify"},
+		{"body whitespace changed", "Hi  there \r\n", "Hi there\r\n", DKIMFail, DKIMPass, "body hash did not verify"},
+		{"empty lines added", "\r\n\r\n\r\n", "\r\n\r\n\r\n\r\n\r\n", DKIMPass, DKIMPass, ""},
+		{"signed header changed", "Hello", "Goodbye", DKIMFail, DKIMFail, "signature did not verify"},
+		{"body changed", "Hi", "Bye", DKIMFail, DKIMFail, "body hash did not verify"},
+	}
+	r := dkimResolver(ed25519KeyRecord(key))
+	for _, test := range tests {
+		for canon, want := range map[string]DKIMResult{"simple/simple": test.simple, "relaxed/relaxed": test.relaxed} {
+			msg := dkimTestMessage
+			if test.from != "" {
+				msg = strings.Replace(msg, test.from, test.to, 1)
+			}
+			checks := VerifyDKIM(r, testDKIMSignature(key, canon, dkimTestMessage)+msg)
+			if len(checks) != 1 {
+				t.Fatalf("%s %s: got %d results", test.name, canon, len(checks))
+			}
+			c := checks[0]
+			if c.Result != want || (want == DKIMFail && c.Reason != test.reason) {
+				t.Errorf("%s %s: got %s (%s), want %s", test.name, canon, c.Result, c.Reason, want)
+			}
+			if c.Domain != "example.org" || c.Selector != "sel" {
+				t.Errorf("%s %s: got d=%s s=%s", test.name, canon, c.Domain, c.Selector)
+			}
+		}
+	}
+}
+
+func TestVerifyDKIMKeyErrors(t *testing.T) {
+	key := newEd25519Key(t)
+	msg := testDKIMSignature(key, "relaxed/relaxed", dkimTestMessage) + dkimTestMessage
+	tests := []struct {
+		resolver *fakeResolver
+		want     DKIMResult
+	}{
+		{&fakeResolver{}, DKIMPermError},
+		{&fakeResolver{fail: map[string]bool{"sel._domainkey.example.org": true}}, DKIMTempError},
+		{dkimResolver("v=DKIM1; k=ed25519; p="), DKIMPermError},
+		{dkimResolver("v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))), DKIMPermError},
+		{dkimResolver("v=DKIM1; k=ed25519; p=c2hvcnQ="), DKIMPermError},
+		{dkimResolver(ed25519KeyRecord(newEd25519Key(t))), DKIMFail},
+	}
+	for _, test := range tests {
+		if c := VerifyDKIM(test.resolver, msg)[0]; c.Result != test.want {
+			t.Errorf("%v: got %s (%s), want %s", test.resolver.txt, c.Result, c.Reason, test.want)
+		}
+	}
+}
+
+func TestVerifyDKIMNeutral(t *testing.T) {
+	for _, field := range []string{
+		"DKIM-Signature: v=2; a=ed25519-sha256; d=example.org; s=sel; h=from; bh=; b=\r\n",
+		"DKIM-Signature: v=1; a=rsa-sha1; d=example.org; s=sel; h=from; bh=; b=\r\n",
+		"DKIM-Signature: v=1; a=ed25519-sha256; d=example.org; s=sel; h=from; b=\r\n",
+		"DKIM-Signature: v=1; a=ed25519-sha256; d=example.org; s=sel; h=subject; bh=; b=\r\n",
+		"DKIM-Signature: v=1; a=ed25519-sha256; c=loose; d=example.org; s=sel; h=from; bh=; b=\r\n",
+		"DKIM-Signature: v=1; a=ed25519-sha256; d=example.org; i=a@example.net; s=sel; h=from; bh=; b=\r\n",
+		"DKIM-Signature: v=1; a=ed25519-sha256; d=example.org; s=sel; h=from; x=1; bh=; b=\r\n",
+		"DKIM-Signature: v=1; a; d=example.org\r\n",
+	} {
+		if c := VerifyDKIM(&fakeResolver{}, field+dkimTestMessage)[0]; c.Result != DKIMNeutral {
+			t.Errorf("%q: got %s (%s), want %s", field, c.Result, c.Reason, DKIMNeutral)
+		}
+	}
+}
+
+func TestDKIMAuthResults(t *testing.T) {
+	key := newEd25519Key(t)
+	signature := testDKIMSignature(key, "relaxed/relaxed", dkimTestMessage)
+	b := signature[strings.Index(signature, " b=")+3:][:8]
+	tests := []struct {
+		msg, want string
+	}{
+		{dkimTestMessage, "dkim=none"},
+		{signature + dkimTestMessage, "dkim=pass header.d=example.org header.s=sel header.b=" + b},
+		{signature + strings.Replace(dkimTestMessage, "Hi", "Bye", 1),
+			"dkim=fail (body hash did not verify) header.d=example.org header.s=sel header.b=" + b},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, "domain: mx.example.com", "localdomains: example.com", "dkimverify: yes")
+		cfg.resolver = dkimResolver(ed25519KeyRecord(key))
+		var session *SMTPSession
+		c := startSession(t, cfg, "198.51.100.7", func(s *SMTPSession) {
+			session = s
+		})
+		c.send(250, "EHLO client.example")
+		c.send(250, "MAIL FROM:<a@example.org>")
+		c.send(250, "RCPT TO:<b@example.com>")
+		c.send(354, "DATA")
+		c.send(250, "%s.", test.msg)
+		want := "Authentication-Results: mx.example.com;\r\n\t" + test.want + "\r\n"
+		if !strings.HasPrefix(session.message.Body, want) {
+			t.Errorf("got message:\n%s\nwant it to start with:\n%s", session.message.Body, want)
+		}
+	}
+}
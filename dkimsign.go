@@ -0,0 +1,166 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/codeslinger/log"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- DKIM signing ---------------------------------------------------------
+
+// A key with which to sign messages from one domain.
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+}
+
+// Headers signed unless the configuration says otherwise.
+var DefaultDKIMSignHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// Load a signing key for the given domain and selector from a PEM file
+// holding an RSA key, in PKCS #1 or PKCS #8 form, or an Ed25519 key in
+// PKCS #8 form.
+func LoadDKIMSigner(domain, selector, path string) (*DKIMSigner, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in " + path)
+	}
+	var key interface{}
+	if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, errors.New("unrecognized private key in " + path)
+		}
+	}
+	s := &DKIMSigner{Domain: strings.ToLower(domain), Selector: selector}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < dkimMinRSABits {
+			return nil, errors.New(fmt.Sprintf("RSA key in %s is shorter than %d bits", path, dkimMinRSABits))
+		}
+		s.Key = k
+	case ed25519.PrivateKey:
+		s.Key = k
+	default:
+		return nil, errors.New("private key in " + path + " is neither RSA nor Ed25519")
+	}
+	return s, nil
+}
+
+// Return a DKIM-Signature header signing the given message, with relaxed
+// canonicalization of its headers and body. Of the named headers, all those
+// present in the message are signed.
+func (s *DKIMSigner) Sign(msg string, names []string, now time.Time) (string, error) {
+	headers, body := splitMessage(msg)
+	algorithm := "rsa-sha256"
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		algorithm = "ed25519-sha256"
+	}
+	signed := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, h := range headers {
+			if isHeader(h, name) {
+				signed = append(signed, strings.ToLower(name))
+			}
+		}
+	}
+	bh := sha256.Sum256([]byte(canonBody(body, "relaxed")))
+	field := fmt.Sprintf("%s: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		dkimHeaderName, algorithm, s.Domain, s.Selector, now.Unix(),
+		strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bh[:]))
+	hash := signedHeaderHash(headers, signed, "relaxed", field)
+	var sig []byte
+	var err error
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		sig, err = s.Key.Sign(rand.Reader, hash, crypto.Hash(0))
+	} else {
+		sig, err = s.Key.Sign(rand.Reader, hash, crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	return field + foldBase64(base64.StdEncoding.EncodeToString(sig)) + "\r\n", nil
+}
+
+// Sign the current message if it was submitted by a local or trusted client
+// and a key is configured for the domain of its From header.
+func (s *SMTPSession) signDKIM() {
+	if !s.submitted() {
+		return
+	}
+	headers, _ := splitMessage(s.message.Body)
+	signer := s.cfg.DKIMSigner(FromDomain(headers))
+	if signer == nil {
+		return
+	}
+	field, err := signer.Sign(s.message.Body, s.cfg.DKIMSignHeaders(), time.Now())
+	if err != nil {
+		log.Error("%s: failed to sign message for %s: %v", s.remote, signer.Domain, err)
+		return
+	}
+	log.Info("%s: signed message with d=%s s=%s", s.remote, signer.Domain, signer.Selector)
+	s.message.Body = field + s.message.Body
+}
+
+// Report whether the current message was submitted by an authenticated,
+// local or trusted client, rather than relayed to us from elsewhere. The
+// listener's mode does not count: anyone can connect to a submission port.
+func (s *SMTPSession) submitted() bool {
+	_, unix := s.remote.(*UnixPeer)
+	return s.authenticated || unix || s.cfg.DKIMSignHosts().Contains(RemoteIP(s.remote))
+}
+
+// Return the domain of the single author address in the From header of a
+// message, or an empty string if there is not exactly one.
+func FromDomain(headers []string) string {
+	domain := ""
+	for _, h := range headers {
+		if !isHeader(h, "From") {
+			continue
+		}
+		if domain != "" {
+			return ""
+		}
+		addrs, err := mail.ParseAddressList(headerValue(h))
+		if err != nil || len(addrs) != 1 {
+			return ""
+		}
+		at := strings.LastIndex(addrs[0].Address, "@")
+		domain = strings.ToLower(addrs[0].Address[at+1:])
+	}
+	return domain
+}
+
+// Break a long base64 value over several lines, as header values should be.
+func foldBase64(s string) string {
+	const width = 72
+	var out strings.Builder
+	for len(s) > width {
+		out.WriteString(s[:width])
+		out.WriteString("\r\n\t ")
+		s = s[width:]
+	}
+	out.WriteString(s)
+	return out.String()
+}
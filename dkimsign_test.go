@@ -0,0 +1,187 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write a private key to a PEM file in PKCS #8 form and return its path.
+func writeDKIMKey(t *testing.T, key crypto.Signer) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// --- Signing --------------------------------------------------------------
+
+func TestSignSubmittedOnly(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(*SMTPSession)
+		signed bool
+	}{
+		{"unauthenticated", nil, false},
+		{"submission listener", func(s *SMTPSession) {
+			p := *s.profile
+			p.Mode = ModeSubmission
+			s.profile = &p
+		}, false},
+		{"authenticated", func(s *SMTPSession) {
+			s.authenticated = true
+		}, true},
+	}
+	key := writeDKIMKey(t, newEd25519Key(t))
+	for _, test := range tests {
+		cfg := testConfig(t,
+			"domain: mx.example.com",
+			"localdomains: example.com",
+			"dkimkey: example.com sel "+key)
+		var session *SMTPSession
+		c := startSession(t, cfg, "198.51.100.7", func(s *SMTPSession) {
+			session = s
+			if test.setup != nil {
+				test.setup(s)
+			}
+		})
+		c.send(250, "EHLO client.example")
+		c.send(250, "MAIL FROM:<a@example.com>")
+		c.send(250, "RCPT TO:<user@example.com>")
+		c.send(354, "DATA")
+		c.send(250, "From: a@example.com\r\nSubject: hi\r\n\r\nhello\r\n.")
+		if signed := strings.Contains(session.message.Body, "DKIM-Signature:"); signed != test.signed {
+			t.Errorf("%s: signed is %v, want %v", test.name, signed, test.signed)
+		}
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := newEd25519Key(t)
+	tests := []struct {
+		key       crypto.Signer
+		algorithm string
+		record    string
+	}{
+		{rsaKey, "rsa-sha256", "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)},
+		{edKey, "ed25519-sha256", ed25519KeyRecord(edKey)},
+	}
+	for _, test := range tests {
+		signer, err := LoadDKIMSigner("Example.org", "sel", writeDKIMKey(t, test.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		field, err := signer.Sign(dkimTestMessage, DefaultDKIMSignHeaders, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(field, "a="+test.algorithm+";") || !strings.Contains(field, "d=example.org;") {
+			t.Errorf("%s: got %q", test.algorithm, field)
+		}
+		checks := VerifyDKIM(dkimResolver(test.record), field+dkimTestMessage)
+		if len(checks) != 1 || checks[0].Result != DKIMPass {
+			t.Errorf("%s: got %v", test.algorithm, checks)
+		}
+		checks = VerifyDKIM(dkimResolver(test.record), field+strings.Replace(dkimTestMessage, "Hello", "Goodbye", 1))
+		if len(checks) != 1 || checks[0].Result != DKIMFail {
+			t.Errorf("%s: changed message got %v", test.algorithm, checks)
+		}
+	}
+}
+
+func TestSignHeaderList(t *testing.T) {
+	signer := &DKIMSigner{Domain: "example.org", Selector: "sel", Key: newEd25519Key(t)}
+	msg := "From: a@example.org\r\nTo: b@example.com\r\nTo: c@example.com\r\nX-Other: 1\r\n\r\nhi\r\n"
+	field, err := signer.Sign(msg, []string{"From", "Subject", "To"}, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := parseTagList(headerValue(field))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags["h"] != "from:to:to" {
+		t.Errorf("got h=%s, want from:to:to", tags["h"])
+	}
+	if tags["t"] != "1700000000" || tags["c"] != "relaxed/relaxed" {
+		t.Errorf("got t=%s c=%s", tags["t"], tags["c"])
+	}
+}
+
+func TestLoadDKIMSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := filepath.Join(t.TempDir(), "pkcs1.pem")
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if err := os.WriteFile(pkcs1, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := LoadDKIMSigner("Example.ORG", "sel", pkcs1); err != nil || s.Domain != "example.org" {
+		t.Errorf("PKCS #1 key: got %v (%v)", s, err)
+	}
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{garbage, filepath.Join(t.TempDir(), "missing.pem")} {
+		if _, err := LoadDKIMSigner("example.org", "sel", path); err == nil {
+			t.Errorf("%s: key loaded", filepath.Base(path))
+		}
+	}
+}
+
+func TestDKIMSignerForDomain(t *testing.T) {
+	key := writeDKIMKey(t, newEd25519Key(t))
+	c := testConfig(t, "dkimkey: example.com sel "+key, "dkimkey: sub.example.com other "+key)
+	tests := map[string]string{
+		"example.com":          "sel",
+		"mail.example.com":     "sel",
+		"sub.example.com":      "other",
+		"deep.sub.example.com": "other",
+		"notexample.com":       "",
+		"example.org":          "",
+		"":                     "",
+	}
+	for domain, selector := range tests {
+		s := c.DKIMSigner(domain)
+		if (s == nil && selector != "") || (s != nil && s.Selector != selector) {
+			t.Errorf("%s: got %v, want selector %q", domain, s, selector)
+		}
+	}
+	if _, err := parseTestConfig("dkimsignheaders: Subject To"); err == nil {
+		t.Error("'dkimsignheaders' without From accepted")
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/codeslinger/log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// --- DMARC ----------------------------------------------------------------
+
+// The result of evaluating DMARC for a message (RFC 7489).
+type DMARCResult string
+
+const (
+	DMARCPass      DMARCResult = "pass"
+	DMARCFail      DMARCResult = "fail"
+	DMARCNone      DMARCResult = "none"
+	DMARCTempError DMARCResult = "temperror"
+	DMARCPermError DMARCResult = "permerror"
+)
+
+// Dispositions of a message, as requested by a domain's policy and as
+// applied by the local DMARC actions.
+const (
+	DMARCDispNone       = "none"
+	DMARCDispQuarantine = "quarantine"
+	DMARCDispReject     = "reject"
+)
+
+// DMARC settings from the configuration, giving the disposition actually
+// applied to failing messages for each policy a domain may request.
+type DMARCPolicy struct {
+	Actions map[string]string
+}
+
+// A domain's published DMARC record.
+type DMARCRecord struct {
+	P     string
+	SP    string
+	Pct   int
+	ADKIM string
+	ASPF  string
+	RUA   []string
+}
+
+// The outcome of evaluating DMARC for a message. Domain is the domain of
+// the message's From header and PolicyDomain the domain whose record
+// applied; Policy is the policy the record requested for the message and
+// Disposition what was done with it.
+type DMARCCheck struct {
+	Domain       string
+	PolicyDomain string
+	Record       *DMARCRecord
+	Result       DMARCResult
+	SPFAligned   bool
+	DKIMAligned  bool
+	Policy       string
+	Disposition  string
+}
+
+var dmarcTempError = errors.New("temporary DMARC lookup error")
+
+// The rules of the Public Suffix List, used to find the organizational
+// domain of a name.
+type PublicSuffixList struct {
+	rules     map[string]bool
+	wildcards map[string]bool
+	exception map[string]bool
+}
+
+// Create a policy that applies whatever domains request.
+func NewDMARCPolicy() *DMARCPolicy {
+	return &DMARCPolicy{Actions: map[string]string{
+		DMARCDispQuarantine: DMARCDispQuarantine,
+		DMARCDispReject:     DMARCDispReject,
+	}}
+}
+
+// Set actions from a list of "policy=disposition" pairs, like
+// "reject=quarantine, quarantine=none".
+func (p *DMARCPolicy) parseActions(s string) error {
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		kv := strings.SplitN(strings.ToLower(f), "=", 2)
+		if len(kv) != 2 {
+			return errors.New(fmt.Sprintf("expected 'policy=disposition': %s", f))
+		}
+		if _, ok := p.Actions[kv[0]]; !ok {
+			return errors.New(fmt.Sprintf("unknown DMARC policy: %s", kv[0]))
+		}
+		switch kv[1] {
+		case DMARCDispNone, DMARCDispQuarantine, DMARCDispReject:
+			p.Actions[kv[0]] = kv[1]
+		default:
+			return errors.New(fmt.Sprintf("unknown DMARC disposition: %s", kv[1]))
+		}
+	}
+	return nil
+}
+
+// Evaluate DMARC for a message whose From header has the given domain,
+// given the results of its SPF and DKIM checks.
+func EvaluateDMARC(r Resolver, psl *PublicSuffixList, domain string, spf *SPFCheck, dkim []*DKIMCheck) *DMARCCheck {
+	c := &DMARCCheck{Domain: domain, Result: DMARCNone, Disposition: DMARCDispNone}
+	if domain == "" {
+		return c
+	}
+	org := psl.OrgDomain(domain)
+	rec, err := lookupDMARC(r, domain)
+	c.PolicyDomain = domain
+	if err == nil && rec == nil && org != domain {
+		rec, err = lookupDMARC(r, org)
+		c.PolicyDomain = org
+	}
+	if err != nil {
+		if err == dmarcTempError {
+			c.Result = DMARCTempError
+		} else {
+			c.Result = DMARCPermError
+		}
+		return c
+	}
+	if rec == nil {
+		c.PolicyDomain = ""
+		return c
+	}
+	c.Record = rec
+	if spf != nil && spf.Result == SPFPass {
+		c.SPFAligned = aligned(psl, spf.Domain, domain, rec.ASPF)
+	}
+	for _, d := range dkim {
+		if d.Result == DKIMPass && aligned(psl, strings.ToLower(d.Domain), domain, rec.ADKIM) {
+			c.DKIMAligned = true
+		}
+	}
+	c.Policy = rec.P
+	if c.PolicyDomain != domain && rec.SP != "" {
+		c.Policy = rec.SP
+	}
+	if c.SPFAligned || c.DKIMAligned {
+		c.Result = DMARCPass
+		return c
+	}
+	c.Result = DMARCFail
+	c.Disposition = c.Policy
+	// Messages outside the sampled percentage get the next less strict
+	// policy (RFC 7489 section 6.6.4).
+	if rec.Pct < 100 && rand.Intn(100) >= rec.Pct {
+		switch c.Disposition {
+		case DMARCDispReject:
+			c.Disposition = DMARCDispQuarantine
+		case DMARCDispQuarantine:
+			c.Disposition = DMARCDispNone
+		}
+	}
+	return c
+}
+
+func (c *DMARCCheck) String() string {
+	return fmt.Sprintf("%s (%s p=%s dis=%s)", c.Result, c.Domain, c.Policy, c.Disposition)
+}
+
+// Fetch and parse the DMARC record of a domain, or nil if it has none.
+// Temporary DNS failures are reported as dmarcTempError.
+func lookupDMARC(r Resolver, domain string) (*DMARCRecord, error) {
+	txts, err := r.LookupTXT("_dmarc." + domain)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, dmarcTempError
+	}
+	var found []string
+	for _, t := range txts {
+		if strings.HasPrefix(t, "v=DMARC1;") || t == "v=DMARC1" || strings.HasPrefix(t, "v=DMARC1 ") {
+			found = append(found, t)
+		}
+	}
+	if len(found) != 1 {
+		return nil, nil
+	}
+	tags, err := parseTagList(found[0])
+	if err != nil {
+		return nil, err
+	}
+	rec := &DMARCRecord{P: strings.ToLower(tags["p"]), SP: strings.ToLower(tags["sp"]), Pct: 100, ADKIM: "r", ASPF: "r"}
+	switch rec.P {
+	case DMARCDispNone, DMARCDispQuarantine, DMARCDispReject:
+	default:
+		// A record with a bad policy but somewhere to send reports is
+		// treated as asking for reports only (RFC 7489 section 6.6.3).
+		if tags["rua"] == "" {
+			return nil, errors.New("invalid DMARC policy")
+		}
+		rec.P = DMARCDispNone
+	}
+	switch rec.SP {
+	case "", DMARCDispNone, DMARCDispQuarantine, DMARCDispReject:
+	default:
+		rec.SP = ""
+	}
+	if pct, err := strconv.Atoi(tags["pct"]); err == nil && pct >= 0 && pct <= 100 {
+		rec.Pct = pct
+	}
+	if strings.ToLower(tags["adkim"]) == "s" {
+		rec.ADKIM = "s"
+	}
+	if strings.ToLower(tags["aspf"]) == "s" {
+		rec.ASPF = "s"
+	}
+	for _, uri := range strings.Split(tags["rua"], ",") {
+		if strings.HasPrefix(strings.ToLower(uri), "mailto:") {
+			rec.RUA = append(rec.RUA, uri[len("mailto:"):])
+		}
+	}
+	return rec, nil
+}
+
+// Report whether an authenticated domain is aligned with the From domain in
+// the given mode: identical in strict mode, or sharing an organizational
+// domain in relaxed mode.
+func aligned(psl *PublicSuffixList, authenticated, from, mode string) bool {
+	if authenticated == from {
+		return true
+	}
+	return mode != "s" && psl.OrgDomain(authenticated) == psl.OrgDomain(from)
+}
+
+// Evaluate DMARC for the current message, recording the result for
+// aggregate reports. If the message must be refused, the reply code and text
+// are returned.
+func (s *SMTPSession) checkDMARC(body string) (int, string) {
+	p := s.cfg.DMARC()
+	if p == nil || s.authenticated || s.message.SPF == nil {
+		return 0, ""
+	}
+	headers, _ := splitMessage(body)
+	domain := FromDomain(headers)
+	// Without a single author domain there is no policy to check against,
+	// so the message is refused (RFC 7489 section 6.6.1).
+	if domain == "" {
+		return 550, "5.7.1 Message must have exactly one From address"
+	}
+	c := EvaluateDMARC(s.cfg.Resolver(), s.cfg.PublicSuffixes(), domain, s.message.SPF, s.message.DKIM)
+	if c.Result == DMARCFail {
+		if action, ok := p.Actions[c.Disposition]; ok {
+			c.Disposition = action
+		}
+	}
+	s.message.DMARC = c
+	s.shared.DMARCReports.Record(c, s.message)
+	log.Info("%s: DMARC %s", s.remote, c)
+	switch c.Disposition {
+	case DMARCDispReject:
+		return 550, fmt.Sprintf("5.7.1 Unauthenticated email from %s is not accepted due to domain's DMARC policy", c.Domain)
+	case DMARCDispQuarantine:
+		s.message.Quarantine = "DMARC policy of " + c.PolicyDomain
+	}
+	return 0, ""
+}
+
+// Load the Public Suffix List from a file in its published format.
+func LoadPublicSuffixList(path string) (*PublicSuffixList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	l := &PublicSuffixList{
+		rules:     make(map[string]bool),
+		wildcards: make(map[string]bool),
+		exception: make(map[string]bool),
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "//") {
+			continue
+		}
+		rule := strings.ToLower(f[0])
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			l.exception[rule[1:]] = true
+		case strings.HasPrefix(rule, "*."):
+			l.wildcards[rule[2:]] = true
+		default:
+			l.rules[rule] = true
+		}
+	}
+	return l, scanner.Err()
+}
+
+// Return the organizational domain of a name: its public suffix and one
+// more label. Without a list, the last label is taken as the public suffix.
+func (l *PublicSuffixList) OrgDomain(name string) string {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	suffix := len(labels) - 1
+	if l != nil {
+		for i := range labels {
+			candidate := strings.Join(labels[i:], ".")
+			if l.exception[candidate] {
+				suffix = i + 1
+				break
+			}
+			if l.rules[candidate] || (i+1 < len(labels) && l.wildcards[strings.Join(labels[i+1:], ".")]) {
+				suffix = i
+				break
+			}
+		}
+	}
+	if suffix == 0 {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[suffix-1:], ".")
+}
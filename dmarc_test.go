@@ -0,0 +1,117 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// --- DMARC ----------------------------------------------------------------
+
+// Write a small Public Suffix List for tests and return its path.
+func testPublicSuffixList(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "psl.dat")
+	if err := os.WriteFile(path, []byte("// test list\ncom\nuk\nco.uk\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func dmarcConfig(t *testing.T, r *fakeResolver) *config {
+	c := testConfig(t,
+		"domain: mx.example.com",
+		"spf: yes",
+		"dkimverify: yes",
+		"dmarc: yes",
+		"publicsuffixlist: "+testPublicSuffixList(t))
+	c.resolver = r
+	return c
+}
+
+func TestDMARCRequiresOneFrom(t *testing.T) {
+	r := &fakeResolver{txt: map[string][]string{
+		"_dmarc.example.org": {"v=DMARC1; p=none"},
+	}}
+	tests := []struct {
+		headers string
+		code    int
+	}{
+		{"From: a@example.org\r\n", 250},
+		{"From: a@example.org\r\nFrom: b@elsewhere.example\r\n", 550},
+		{"From: a@example.org, b@example.org\r\n", 550},
+		{"From: not an address\r\n", 550},
+		{"Subject: no author\r\n", 550},
+	}
+	for _, test := range tests {
+		c := startSession(t, dmarcConfig(t, r), "198.51.100.7", nil)
+		c.send(250, "EHLO client.example")
+		c.send(250, "MAIL FROM:<a@example.org>")
+		c.send(250, "RCPT TO:<user@mx.example.com>")
+		c.send(354, "DATA")
+		if got := c.cmd("%s\r\nhello\r\n.", strings.TrimSuffix(test.headers, "\r\n")); got != test.code {
+			t.Errorf("%q: got reply %d, want %d", test.headers, got, test.code)
+		}
+	}
+}
+
+func TestDMARCConfigRequiresPublicSuffixList(t *testing.T) {
+	c := newConfig(nil)
+	if err := c.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range []string{"spf: yes", "dkimverify: yes", "dmarc: yes"} {
+		if err := c.parseLine(line, i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.finish(); err == nil {
+		t.Error("DMARC enabled without a public suffix list")
+	}
+}
+
+func TestDMARCTempError(t *testing.T) {
+	r := &fakeResolver{fail: map[string]bool{"_dmarc.example.org": true}}
+	if c := EvaluateDMARC(r, nil, "example.org", nil, nil); c.Result != DMARCTempError {
+		t.Errorf("got %s, want %s", c.Result, DMARCTempError)
+	}
+}
+
+func TestOrgDomain(t *testing.T) {
+	psl, err := LoadPublicSuffixList(testPublicSuffixList(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"a.co.uk":             "a.co.uk",
+		"mail.a.co.uk":        "a.co.uk",
+		"b.co.uk":             "b.co.uk",
+		"mail.example.com":    "example.com",
+		"example.com":         "example.com",
+		"x.y.example.example": "example.example",
+	}
+	for name, want := range tests {
+		if got := psl.OrgDomain(name); got != want {
+			t.Errorf("OrgDomain(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestDMARCQuarantine(t *testing.T) {
+	r := &fakeResolver{txt: map[string][]string{
+		"_dmarc.example.org": {"v=DMARC1; p=quarantine"},
+	}}
+	var session *SMTPSession
+	c := startSession(t, dmarcConfig(t, r), "198.51.100.7", func(s *SMTPSession) {
+		session = s
+	})
+	c.send(250, "EHLO client.example")
+	c.send(250, "MAIL FROM:<a@example.org>")
+	c.send(250, "RCPT TO:<user@mx.example.com>")
+	c.send(354, "DATA")
+	c.send(250, "From: a@example.org\r\n\r\nhello\r\n.")
+	if !strings.Contains(session.message.Body, "X-Quarantine: DMARC policy of example.org\r\n") {
+		t.Errorf("quarantined message not marked:\n%s", session.message.Body)
+	}
+}
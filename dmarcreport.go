@@ -0,0 +1,227 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/codeslinger/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- DMARC aggregate reports ----------------------------------------------
+
+// Settings for collecting DMARC aggregate reports (RFC 7489 section 7.2).
+// Reports are written to Dir as XML files every Interval, one per policy
+// domain, for sending on to the domains' report addresses.
+type DMARCReportPolicy struct {
+	Dir      string
+	Interval time.Duration
+	OrgName  string
+	Email    string
+}
+
+// Evaluation results collected for the current reporting period.
+type DMARCReporter struct {
+	lock    sync.Mutex
+	policy  *DMARCReportPolicy
+	begin   time.Time
+	domains map[string]*dmarcDomainReport
+}
+
+// The rows collected for one policy domain.
+type dmarcDomainReport struct {
+	published dmarcPublished
+	rua       []string
+	rows      map[string]*dmarcRecord
+	order     []string
+}
+
+const defaultDMARCReportInterval = 24 * time.Hour
+
+// The XML document of an aggregate report, as given in RFC 7489 appendix C.
+type dmarcFeedback struct {
+	XMLName  xml.Name       `xml:"feedback"`
+	Metadata dmarcMetadata  `xml:"report_metadata"`
+	Policy   dmarcPublished `xml:"policy_published"`
+	Records  []*dmarcRecord `xml:"record"`
+}
+
+type dmarcMetadata struct {
+	OrgName  string `xml:"org_name"`
+	Email    string `xml:"email"`
+	ReportID string `xml:"report_id"`
+	Begin    int64  `xml:"date_range>begin"`
+	End      int64  `xml:"date_range>end"`
+}
+
+type dmarcPublished struct {
+	Domain string `xml:"domain"`
+	ADKIM  string `xml:"adkim"`
+	ASPF   string `xml:"aspf"`
+	P      string `xml:"p"`
+	SP     string `xml:"sp"`
+	Pct    int    `xml:"pct"`
+}
+
+type dmarcRecord struct {
+	SourceIP     string            `xml:"row>source_ip"`
+	Count        int               `xml:"row>count"`
+	Disposition  string            `xml:"row>policy_evaluated>disposition"`
+	DKIM         string            `xml:"row>policy_evaluated>dkim"`
+	SPF          string            `xml:"row>policy_evaluated>spf"`
+	HeaderFrom   string            `xml:"identifiers>header_from"`
+	EnvelopeFrom string            `xml:"identifiers>envelope_from,omitempty"`
+	DKIMResults  []dmarcDKIMResult `xml:"auth_results>dkim"`
+	SPFResults   []dmarcSPFResult  `xml:"auth_results>spf"`
+}
+
+type dmarcDKIMResult struct {
+	Domain   string `xml:"domain"`
+	Selector string `xml:"selector,omitempty"`
+	Result   string `xml:"result"`
+}
+
+type dmarcSPFResult struct {
+	Domain string `xml:"domain"`
+	Scope  string `xml:"scope"`
+	Result string `xml:"result"`
+}
+
+// Create a collector for aggregate reports and start writing them out, or
+// return nil if no report directory is configured.
+func NewDMARCReporter(p *DMARCReportPolicy) *DMARCReporter {
+	if p.Dir == "" {
+		return nil
+	}
+	d := &DMARCReporter{
+		policy:  p,
+		begin:   time.Now(),
+		domains: make(map[string]*dmarcDomainReport),
+	}
+	go d.writeLoop()
+	return d
+}
+
+// Record the evaluation of a message. Identical rows within a period are
+// counted together.
+func (d *DMARCReporter) Record(c *DMARCCheck, m *SMTPMessage) {
+	if d == nil || c.Record == nil {
+		return
+	}
+	row := &dmarcRecord{
+		SourceIP:    fmt.Sprint(RemoteIP(m.Remote)),
+		Disposition: c.Disposition,
+		DKIM:        passOrFail(c.DKIMAligned),
+		SPF:         passOrFail(c.SPFAligned),
+		HeaderFrom:  c.Domain,
+	}
+	if at := strings.LastIndex(m.From, "@"); at >= 0 {
+		row.EnvelopeFrom = strings.ToLower(m.From[at+1:])
+	}
+	for _, k := range m.DKIM {
+		row.DKIMResults = append(row.DKIMResults, dmarcDKIMResult{k.Domain, k.Selector, string(k.Result)})
+	}
+	if m.SPF != nil {
+		scope := "mfrom"
+		if m.SPF.Identity == "helo" {
+			scope = "helo"
+		}
+		row.SPFResults = append(row.SPFResults, dmarcSPFResult{m.SPF.Domain, scope, string(m.SPF.Result)})
+	}
+	key := fmt.Sprintf("%v", *row)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	r, ok := d.domains[c.PolicyDomain]
+	if !ok {
+		r = &dmarcDomainReport{rows: make(map[string]*dmarcRecord)}
+		d.domains[c.PolicyDomain] = r
+	}
+	rec := c.Record
+	r.published = dmarcPublished{c.PolicyDomain, rec.ADKIM, rec.ASPF, rec.P, rec.SP, rec.Pct}
+	r.rua = rec.RUA
+	if existing, ok := r.rows[key]; ok {
+		existing.Count++
+		return
+	}
+	row.Count = 1
+	r.rows[key] = row
+	r.order = append(r.order, key)
+}
+
+// Write out reports for the period so far and start a new period.
+func (d *DMARCReporter) Flush() {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	begin, end, domains := d.begin, time.Now(), d.domains
+	d.begin, d.domains = end, make(map[string]*dmarcDomainReport)
+	d.lock.Unlock()
+	names := make([]string, 0, len(domains))
+	for name := range domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r := domains[name]
+		path, err := d.write(name, r, begin, end)
+		if err != nil {
+			log.Error("failed to write DMARC report for %s: %v", name, err)
+			continue
+		}
+		log.Info("wrote DMARC report for %s (%d rows) to %s, rua=%s",
+			name, len(r.rows), path, strings.Join(r.rua, ","))
+	}
+}
+
+// Write the report for one policy domain, returning the path of the file.
+// Files are named as attachments of report messages are (RFC 7489 section
+// 7.2.1.1) and are replaced atomically.
+func (d *DMARCReporter) write(domain string, r *dmarcDomainReport, begin, end time.Time) (string, error) {
+	doc := &dmarcFeedback{
+		Metadata: dmarcMetadata{
+			OrgName:  d.policy.OrgName,
+			Email:    d.policy.Email,
+			ReportID: fmt.Sprintf("%d.%s@%s", begin.Unix(), domain, d.policy.OrgName),
+			Begin:    begin.Unix(),
+			End:      end.Unix(),
+		},
+		Policy: r.published,
+	}
+	for _, key := range r.order {
+		doc.Records = append(doc.Records, r.rows[key])
+	}
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(d.policy.Dir, fmt.Sprintf("%s!%s!%d!%d.xml", d.policy.OrgName, domain, begin.Unix(), end.Unix()))
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, append([]byte(xml.Header), data...), 0644); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
+
+func (d *DMARCReporter) writeLoop() {
+	for {
+		time.Sleep(d.policy.Interval)
+		d.Flush()
+	}
+}
+
+func passOrFail(ok bool) string {
+	if ok {
+		return "pass"
+	}
+	return "fail"
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/codeslinger/log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// --- DNS blocklists -------------------------------------------------------
+
+// A DNS blocklist zone. A client is listed when the zone returns an address
+// for it among Codes, or any address if Codes is empty, and a listing adds
+// Weight to the client's score.
+type DNSBLZone struct {
+	Zone   string
+	Codes  []ipRange
+	Weight int
+}
+
+// DNS blocklist settings from the configuration. Clients whose score across
+// all zones reaches Threshold are rejected with Message, in which "$ip" and
+// "$zone" are replaced by the client address and the zones listing it, and
+// "$txt" by the TXT record the first of those zones gives for the client.
+type DNSBLPolicy struct {
+	Zones     []*DNSBLZone
+	Threshold int
+	Message   string
+}
+
+// An inclusive range of addresses returned by a blocklist.
+type ipRange struct {
+	first net.IP
+	last  net.IP
+}
+
+const (
+	defaultDNSBLThreshold = 1
+	defaultDNSBLMessage   = "Service unavailable; client [$ip] blocked using $zone"
+)
+
+// Look the given client address up in all zones at once, returning its total
+// score and the zones that list it. Zones that cannot be queried are
+// treated as not listing the client.
+func (p *DNSBLPolicy) Check(r Resolver, ip net.IP) (int, []*DNSBLZone) {
+	hits := make([]bool, len(p.Zones))
+	var wg sync.WaitGroup
+	for i, z := range p.Zones {
+		wg.Add(1)
+		go func(i int, z *DNSBLZone) {
+			defer wg.Done()
+			hits[i] = z.lists(r, ip)
+		}(i, z)
+	}
+	wg.Wait()
+	score, listed := 0, make([]*DNSBLZone, 0)
+	for i, z := range p.Zones {
+		if hits[i] {
+			score += z.Weight
+			listed = append(listed, z)
+		}
+	}
+	return score, listed
+}
+
+// Format the rejection message for a client listed in the given zones.
+func (p *DNSBLPolicy) reply(r Resolver, ip net.IP, listed []*DNSBLZone) string {
+	names := make([]string, len(listed))
+	for i, z := range listed {
+		names[i] = z.Zone
+	}
+	txt := ""
+	if strings.Contains(p.Message, "$txt") {
+		if records, err := r.LookupTXT(dnsblName(ip, listed[0].Zone)); err == nil {
+			txt = strings.Join(records, " ")
+		}
+	}
+	return strings.NewReplacer("$ip", ip.String(), "$zone", strings.Join(names, ", "), "$txt", txt).Replace(p.Message)
+}
+
+// Report whether this zone lists the given client address.
+func (z *DNSBLZone) lists(r Resolver, ip net.IP) bool {
+	name := dnsblName(ip, z.Zone)
+	addrs, err := r.LookupIP(name)
+	if err != nil {
+		if !IsNotFound(err) {
+			log.Warn("DNSBL lookup of %s failed: %v", name, err)
+		}
+		return false
+	}
+	for _, a := range addrs {
+		if len(z.Codes) == 0 {
+			return true
+		}
+		for _, c := range z.Codes {
+			if c.contains(a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check the client against the configured blocklists before greeting it,
+// rejecting it if it is listed. Trusted clients are not checked.
+func (s *SMTPSession) checkDNSBL() Verdict {
+	p := s.cfg.DNSBL()
+	ip := RemoteIP(s.remote)
+	if p == nil || ip == nil || s.trusted() {
+		return Continue
+	}
+	score, listed := p.Check(s.cfg.Resolver(), ip)
+	if len(listed) == 0 || score < p.Threshold {
+		return Continue
+	}
+	s.shared.DNSBLRejected.Inc(1)
+	msg := p.reply(s.cfg.Resolver(), ip, listed)
+	log.Warn("%s: rejected by DNSBL, score %d: %s", s.remote, score, msg)
+	s.respond(554, "5.7.1 "+msg)
+	return Terminate
+}
+
+func (r ipRange) contains(ip net.IP) bool {
+	ip = ip.To16()
+	return ip != nil && bytes.Compare(ip, r.first) >= 0 && bytes.Compare(ip, r.last) <= 0
+}
+
+// Build the name to query in a zone for the given address: the octets of an
+// IPv4 address or the nibbles of an IPv6 address, in reverse order.
+func dnsblName(ip net.IP, zone string) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", v4[3], v4[2], v4[1], v4[0], zone)
+	}
+	ip = ip.To16()
+	parts := make([]string, 0, 33)
+	for i := len(ip) - 1; i >= 0; i-- {
+		parts = append(parts, strconv.FormatUint(uint64(ip[i]&0xf), 16), strconv.FormatUint(uint64(ip[i]>>4), 16))
+	}
+	return strings.Join(append(parts, zone), ".")
+}
+
+// Parse a blocklist zone given as "zone[=codes][*weight]", where codes is a
+// comma-separated list of addresses or ranges of them, like "127.0.0.2" or
+// "127.0.0.4-127.0.0.7".
+func parseDNSBLZone(s string) (*DNSBLZone, error) {
+	z := &DNSBLZone{Weight: 1}
+	if star := strings.LastIndex(s, "*"); star >= 0 {
+		w, err := strconv.Atoi(s[star+1:])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("malformed weight: %s", s[star+1:]))
+		}
+		z.Weight, s = w, s[:star]
+	}
+	if eq := strings.Index(s, "="); eq >= 0 {
+		for _, c := range strings.Split(s[eq+1:], ",") {
+			bounds := strings.SplitN(strings.TrimSpace(c), "-", 2)
+			first := net.ParseIP(bounds[0])
+			last := first
+			if len(bounds) == 2 {
+				last = net.ParseIP(bounds[1])
+			}
+			if first == nil || last == nil {
+				return nil, errors.New(fmt.Sprintf("malformed result code: %s", c))
+			}
+			z.Codes = append(z.Codes, ipRange{first.To16(), last.To16()})
+		}
+		s = s[:eq]
+	}
+	z.Zone = strings.ToLower(strings.Trim(s, ". "))
+	if z.Zone == "" {
+		return nil, errors.New("zone cannot be blank")
+	}
+	return z, nil
+}
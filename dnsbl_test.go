@@ -0,0 +1,98 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func dnsblResolver() *fakeResolver {
+	return &fakeResolver{
+		ip: map[string][]net.IP{
+			"7.100.51.198.bl.example":     {net.ParseIP("127.0.0.2")},
+			"7.100.51.198.policy.example": {net.ParseIP("127.0.0.10")},
+			"8.100.51.198.policy.example": {net.ParseIP("127.0.0.4")},
+		},
+		txt: map[string][]string{
+			"7.100.51.198.bl.example": {"listed for spam"},
+		},
+		fail: map[string]bool{
+			"7.100.51.198.slow.example": true,
+			"8.100.51.198.slow.example": true,
+		},
+	}
+}
+
+func TestDNSBLCheck(t *testing.T) {
+	r := dnsblResolver()
+	tests := []struct {
+		zones []string
+		ip    string
+		score int
+	}{
+		{[]string{"bl.example"}, "198.51.100.7", 1},
+		{[]string{"bl.example"}, "198.51.100.8", 0},
+		{[]string{"slow.example"}, "198.51.100.7", 0},
+		{[]string{"bl.example*3", "slow.example"}, "198.51.100.7", 3},
+		{[]string{"policy.example=127.0.0.2-127.0.0.5"}, "198.51.100.7", 0},
+		{[]string{"policy.example=127.0.0.2-127.0.0.5"}, "198.51.100.8", 1},
+		{[]string{"bl.example*2", "policy.example=127.0.0.10"}, "198.51.100.7", 3},
+	}
+	for _, test := range tests {
+		p := &DNSBLPolicy{Threshold: 1}
+		for _, spec := range test.zones {
+			z, err := parseDNSBLZone(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Zones = append(p.Zones, z)
+		}
+		if score, _ := p.Check(r, net.ParseIP(test.ip)); score != test.score {
+			t.Errorf("%v %s: got score %d, want %d", test.zones, test.ip, score, test.score)
+		}
+	}
+}
+
+func TestDNSBLName(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1":   "1.2.0.192.bl.example",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.bl.example",
+	}
+	for ip, want := range tests {
+		if got := dnsblName(net.ParseIP(ip), "bl.example"); got != want {
+			t.Errorf("dnsblName(%s) = %s, want %s", ip, got, want)
+		}
+	}
+}
+
+func TestDNSBLSession(t *testing.T) {
+	tests := []struct {
+		ip   string
+		code int
+	}{
+		{"198.51.100.7", 554},
+		{"198.51.100.8", 220},
+		{"192.0.2.7", 220},
+	}
+	for _, test := range tests {
+		c := testConfig(t,
+			"dnsbl: bl.example",
+			"dnsbl: slow.example",
+			"dnsblmessage: $ip listed by $zone: $txt",
+			"trustedhosts: 192.0.2.0/24")
+		c.resolver = dnsblResolver()
+		// The trusted client would be listed if it were checked.
+		c.resolver.(*fakeResolver).ip["7.2.0.192.bl.example"] = []net.IP{net.ParseIP("127.0.0.2")}
+		client := openSession(t, c, test.ip, nil)
+		code, msg, err := client.ReadResponse(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != test.code {
+			t.Errorf("%s: got reply %d %s, want %d", test.ip, code, msg, test.code)
+		}
+		if code == 554 && msg != "5.7.1 198.51.100.7 listed by bl.example: listed for spam" {
+			t.Errorf("%s: got message %q", test.ip, msg)
+		}
+	}
+}
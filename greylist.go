@@ -0,0 +1,248 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/codeslinger/log"
+	"github.com/rcrowley/go-metrics"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Greylisting ----------------------------------------------------------
+
+// A record of delivery attempts for one (client network, sender, recipient)
+// triplet.
+type greyEntry struct {
+	first   time.Time
+	passed  bool
+	expires time.Time
+}
+
+// Greylisting state, kept in memory and saved periodically to a file so it
+// survives restarts.
+type Greylist struct {
+	lock     sync.Mutex
+	path     string
+	entries  map[string]*greyEntry
+	policy   *GreylistPolicy
+	dirty    bool
+	deferred metrics.Counter
+	passed   metrics.Counter
+}
+
+// Greylisting settings from the configuration.
+type GreylistPolicy struct {
+	Delay  time.Duration
+	Retry  time.Duration
+	Expiry time.Duration
+	Allow  NetList
+	Domain []string
+}
+
+const (
+	greylistSaveSecs = 60
+	greylistV4Prefix = 24
+	greylistV6Prefix = 64
+)
+
+// Create greylisting state backed by the given file, loading any entries
+// saved there. An empty path keeps state in memory only.
+func NewGreylist(path string, r metrics.Registry) *Greylist {
+	g := &Greylist{
+		path:     path,
+		entries:  make(map[string]*greyEntry),
+		deferred: metrics.NewCounter(),
+		passed:   metrics.NewCounter(),
+	}
+	r.Register("smtp.greylist.deferred", g.deferred)
+	r.Register("smtp.greylist.passed", g.passed)
+	if path != "" {
+		if err := g.load(); err != nil && !os.IsNotExist(err) {
+			log.Error("failed to load greylist from %s: %v", path, err)
+		}
+	}
+	go g.saveLoop()
+	return g
+}
+
+// Report whether a message from the given client and sender to the given
+// recipient should be accepted now, or deferred until the client retries.
+func (g *Greylist) Check(p *GreylistPolicy, ip net.IP, from, rcpt string) bool {
+	if ip == nil || p.Allow.Contains(ip) || p.allowsDomain(from) {
+		return true
+	}
+	key := greyKey(ip, from, rcpt)
+	now := time.Now()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.policy = p
+	e, ok := g.entries[key]
+	if ok && e.passed && now.Before(e.expires) {
+		e.expires = now.Add(p.Expiry)
+		g.dirty = true
+		return true
+	}
+	if !ok || e.passed || now.Sub(e.first) > p.Retry {
+		g.entries[key] = &greyEntry{first: now}
+		g.dirty = true
+		g.deferred.Inc(1)
+		return false
+	}
+	if now.Sub(e.first) < p.Delay {
+		g.deferred.Inc(1)
+		return false
+	}
+	e.passed = true
+	e.expires = now.Add(p.Expiry)
+	g.dirty = true
+	g.passed.Inc(1)
+	return true
+}
+
+// Throw away entries that have expired under the most recently used policy:
+// triplets never retried within the retry window and allowed triplets not
+// seen again within the expiry period.
+func (g *Greylist) Prune() {
+	now := time.Now()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	p := g.policy
+	if p == nil {
+		return
+	}
+	for key, e := range g.entries {
+		if (e.passed && now.After(e.expires)) || (!e.passed && now.Sub(e.first) > p.Retry) {
+			delete(g.entries, key)
+			g.dirty = true
+		}
+	}
+}
+
+// Write the greylist to its file if it has changed since it was last saved.
+// The file is replaced atomically so a crash cannot leave it truncated.
+func (g *Greylist) Save() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.path == "" || !g.dirty {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(g.path), filepath.Base(g.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for key, e := range g.entries {
+		fmt.Fprintf(w, "%s\t%d\t%t\t%d\n", key, e.first.Unix(), e.passed, e.expires.Unix())
+	}
+	if err = w.Flush(); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), g.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	g.dirty = false
+	return nil
+}
+
+// Stop saving the greylist, once another process has taken it over.
+func (g *Greylist) Detach() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.path = ""
+}
+
+// Read entries saved by Save.
+func (g *Greylist) load() error {
+	file, err := os.Open(g.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f := strings.Split(scanner.Text(), "\t")
+		if len(f) != 4 {
+			continue
+		}
+		first, err1 := strconv.ParseInt(f[1], 10, 64)
+		passed, err2 := strconv.ParseBool(f[2])
+		expires, err3 := strconv.ParseInt(f[3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		g.entries[f[0]] = &greyEntry{
+			first:   time.Unix(first, 0),
+			passed:  passed,
+			expires: time.Unix(expires, 0),
+		}
+	}
+	log.Info("loaded %d greylist entries from %s", len(g.entries), g.path)
+	return scanner.Err()
+}
+
+func (g *Greylist) saveLoop() {
+	for {
+		time.Sleep(time.Second * greylistSaveSecs)
+		g.Prune()
+		if err := g.Save(); err != nil {
+			log.Error("failed to save greylist to %s: %v", g.path, err)
+		}
+	}
+}
+
+// Report whether the sender's domain, or a parent of it, is allowed to skip
+// greylisting.
+func (p *GreylistPolicy) allowsDomain(from string) bool {
+	at := strings.LastIndex(from, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(from[at+1:])
+	for _, d := range p.Domain {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a list of networks and sender domains allowed to skip greylisting.
+func parseGreylistAllow(s string) (NetList, []string, error) {
+	nets := make(NetList, 0)
+	domains := make([]string, 0)
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		if n, err := ParseNetList(f); err == nil {
+			nets = append(nets, n...)
+		} else if strings.Contains(f, "/") || strings.Contains(f, ":") {
+			return nil, nil, err
+		} else {
+			domains = append(domains, strings.ToLower(strings.TrimPrefix(f, ".")))
+		}
+	}
+	return nets, domains, nil
+}
+
+// Build the key for a triplet. Clients are grouped by network, since large
+// senders often retry from a different host in the same pool.
+func greyKey(ip net.IP, from, rcpt string) string {
+	var network net.IP
+	if v4 := ip.To4(); v4 != nil {
+		network = v4.Mask(net.CIDRMask(greylistV4Prefix, 32))
+	} else {
+		network = ip.Mask(net.CIDRMask(greylistV6Prefix, 128))
+	}
+	return network.String() + "/" + strings.ToLower(from) + "/" + strings.ToLower(rcpt)
+}
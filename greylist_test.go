@@ -0,0 +1,52 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestGreylistAllowAccumulates(t *testing.T) {
+	c := testConfig(t,
+		"greylist: yes",
+		"greylistallow: 192.0.2.0/24, google.com",
+		"greylistallow: 2001:db8::/32 .outlook.com")
+	p := c.Greylisting()
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		if !p.Allow.Contains(net.ParseIP(ip)) {
+			t.Errorf("%s not allowed", ip)
+		}
+	}
+	if got := strings.Join(p.Domain, ","); got != "google.com,outlook.com" {
+		t.Errorf("got domains %s", got)
+	}
+}
+
+func TestGreylistSkipsTrusted(t *testing.T) {
+	tests := []struct {
+		remote string
+		setup  func(*SMTPSession)
+		code   int
+	}{
+		{"198.51.100.7", nil, 451},
+		{"192.0.2.1", nil, 250},
+		{"198.51.100.7", func(s *SMTPSession) { s.authenticated = true }, 250},
+		{"", func(s *SMTPSession) {
+			s.remote = &UnixPeer{Path: "/var/run/go25.sock", Pid: -1, Uid: -1, Gid: -1}
+		}, 250},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t,
+			"domain: mx.example.com",
+			"localdomains: example.com",
+			"trustedhosts: 192.0.2.0/24",
+			"greylist: yes")
+		c := startSession(t, cfg, test.remote, test.setup)
+		c.send(250, "EHLO client.example")
+		c.send(250, "MAIL FROM:<a@elsewhere.example>")
+		if got := c.cmd("RCPT TO:<user@example.com>"); got != test.code {
+			t.Errorf("%q: got reply %d, want %d", test.remote, got, test.code)
+		}
+	}
+}
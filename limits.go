@@ -0,0 +1,101 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"github.com/rcrowley/go-metrics"
+	"net"
+	"sync"
+)
+
+// --- Connection limits ----------------------------------------------------
+
+// Tracks the number of open SMTP connections, overall and per client IP
+// address, across all listeners.
+type ConnLimiter struct {
+	lock     sync.Mutex
+	total    int
+	perIP    map[string]int
+	active   metrics.Gauge
+	clients  metrics.Gauge
+	rejected metrics.Counter
+}
+
+// Create a new connection limiter, exporting its counts to the given
+// registry.
+func NewConnLimiter(r metrics.Registry) *ConnLimiter {
+	l := &ConnLimiter{
+		perIP:    make(map[string]int),
+		active:   metrics.NewGauge(),
+		clients:  metrics.NewGauge(),
+		rejected: metrics.NewCounter(),
+	}
+	r.Register("smtp.connections.active", l.active)
+	r.Register("smtp.connections.clients", l.clients)
+	r.Register("smtp.connections.rejected", l.rejected)
+	return l
+}
+
+// Count a newly-accepted connection, unless that would take the total over
+// max, a limit of zero meaning no limit. Returns false if the connection
+// should be refused.
+func (l *ConnLimiter) Admit(max int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if max > 0 && l.total >= max {
+		l.rejected.Inc(1)
+		return false
+	}
+	l.total++
+	l.update()
+	return true
+}
+
+// Stop counting a connection previously accepted by Admit.
+func (l *ConnLimiter) Leave() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.total--
+	l.update()
+}
+
+// Count an admitted connection against the given client, unless that would
+// take the client's count over maxPerIP, a limit of zero meaning no limit.
+// Clients without an IP address are not counted. Returns false if the
+// connection should be refused.
+func (l *ConnLimiter) Acquire(ip net.IP, maxPerIP int) bool {
+	if ip == nil {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	key := ip.String()
+	if maxPerIP > 0 && l.perIP[key] >= maxPerIP {
+		l.rejected.Inc(1)
+		return false
+	}
+	l.perIP[key]++
+	l.update()
+	return true
+}
+
+// Stop counting a connection against a client, as previously done by
+// Acquire.
+func (l *ConnLimiter) Release(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	key := ip.String()
+	if l.perIP[key] <= 1 {
+		delete(l.perIP, key)
+	} else {
+		l.perIP[key]--
+	}
+	l.update()
+}
+
+func (l *ConnLimiter) update() {
+	l.active.Update(int64(l.total))
+	l.clients.Update(int64(len(l.perIP)))
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestMaxConns(t *testing.T) {
+	c := testConfig(t, "domain: mx.example.com", "maxconns: 1")
+	svc := NewSMTPService(c, c.Listeners()[0], NewServerState(c), make(chan int, 1))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go RunService(svc, l)
+	defer l.Close()
+
+	dial := func(code int) *textproto.Conn {
+		conn, err := textproto.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadResponse(code); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	first := dial(220)
+	dial(421).Close()
+	first.Cmd("QUIT")
+	first.ReadResponse(221)
+	first.Close()
+	svc.active.Wait()
+	dial(220).Close()
+}
+
+// Refusing a connection must not wait for the client to read the reply.
+func TestAdmitDoesNotBlock(t *testing.T) {
+	c := testConfig(t, "domain: mx.example.com", "maxconns: 1")
+	svc := NewSMTPService(c, c.Listeners()[0], NewServerState(c), make(chan int, 1))
+	first, _ := net.Pipe()
+	if !svc.Admit(first) {
+		t.Fatal("first connection refused")
+	}
+	server, client := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		done <- svc.Admit(server)
+	}()
+	select {
+	case admitted := <-done:
+		if admitted {
+			t.Fatal("connection over the limit admitted")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Admit waited for the client")
+	}
+	if _, _, err := textproto.NewConn(client).ReadResponse(421); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	c := testConfig(t)
+	l := NewConnLimiter(c.Metrics())
+	ip := net.ParseIP("192.0.2.1")
+	if !l.Admit(2) || !l.Admit(2) || l.Admit(2) {
+		t.Error("total limit not enforced")
+	}
+	if !l.Acquire(ip, 1) || l.Acquire(ip, 1) || !l.Acquire(nil, 1) {
+		t.Error("per-client limit not enforced")
+	}
+	l.Release(ip)
+	l.Leave()
+	if !l.Admit(2) || !l.Acquire(ip, 1) {
+		t.Error("released connections still counted")
+	}
+}
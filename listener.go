@@ -0,0 +1,251 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Listener profiles ----------------------------------------------------
+
+type ListenerMode int
+
+const (
+	ModeSMTP ListenerMode = iota
+	ModeSubmission
+	ModeSMTPS
+	ModeLMTP
+)
+
+// Which clients may use a command that reveals addresses, such as VRFY.
+type CommandAccess int
+
+const (
+	AccessTrusted CommandAccess = iota
+	AccessNone
+	AccessAll
+)
+
+// Settings for one listening socket and the sessions accepted on it.
+type ListenerProfile struct {
+	Name        string
+	Addr        net.Addr
+	SocketMode  os.FileMode
+	SocketUid   int
+	SocketGid   int
+	Mode        ListenerMode
+	Proxy       bool
+	ProxyFrom   NetList
+	RequireTLS  bool
+	RequireAuth bool
+	MaxMsgSize  int
+	Banner      string
+	GreetPause  time.Duration
+	Vrfy        CommandAccess
+	Expn        CommandAccess
+}
+
+const defaultListenerName = "smtp"
+
+func (m ListenerMode) String() string {
+	switch m {
+	case ModeSMTP:
+		return "smtp"
+	case ModeSubmission:
+		return "submission"
+	case ModeSMTPS:
+		return "smtps"
+	case ModeLMTP:
+		return "lmtp"
+	}
+	return "unknown"
+}
+
+// Create a new listener profile with default settings.
+func NewListenerProfile(name string) *ListenerProfile {
+	return &ListenerProfile{
+		Name:        name,
+		Addr:        nil,
+		SocketMode:  0,
+		SocketUid:   -1,
+		SocketGid:   -1,
+		Mode:        ModeSMTP,
+		Proxy:       false,
+		ProxyFrom:   nil,
+		RequireTLS:  false,
+		RequireAuth: false,
+		MaxMsgSize:  0,
+		Banner:      "",
+		GreetPause:  0,
+		Vrfy:        AccessTrusted,
+		Expn:        AccessTrusted,
+	}
+}
+
+func (p *ListenerProfile) String() string {
+	return fmt.Sprintf("%s=%s/%s", p.Name, p.Addr, p.Mode)
+}
+
+// Apply a single directive from within a 'listener' block.
+func (p *ListenerProfile) parseLine(directive, argument string, idx int) (err error) {
+	switch strings.ToLower(directive) {
+	case "address":
+		if p.Addr, err = ResolveAddr(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: failed to resolve 'address': %v", idx, err))
+		}
+	case "banner":
+		p.Banner = argument
+	case "expn":
+		if p.Expn, err = parseAccess(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'expn' ('%s')", idx, argument))
+		}
+	case "greetpause":
+		if p.GreetPause, err = parseSecs("greetpause", argument, idx); err != nil {
+			return err
+		}
+	case "maxmsgsize":
+		p.MaxMsgSize, err = strconv.Atoi(argument)
+		if err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'maxmsgsize' ('%s'): %v", idx, argument, err))
+		}
+		if p.MaxMsgSize < 1 {
+			return errors.New(fmt.Sprintf("line %d: 'maxmsgsize' value cannot be <1 byte", idx))
+		}
+	case "mode":
+		if err = p.setMode(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: %v", idx, err))
+		}
+	case "proxyprotocol":
+		if p.Proxy, err = parseBool(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'proxyprotocol' ('%s')", idx, argument))
+		}
+	case "proxytrusted":
+		if p.ProxyFrom, err = ParseNetList(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'proxytrusted': %v", idx, err))
+		}
+	case "requireauth":
+		if p.RequireAuth, err = parseBool(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'requireauth' ('%s')", idx, argument))
+		}
+	case "requiretls":
+		if p.RequireTLS, err = parseBool(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'requiretls' ('%s')", idx, argument))
+		}
+	case "socketmode":
+		mode, err := strconv.ParseUint(argument, 8, 32)
+		if err != nil || mode > 0777 {
+			return errors.New(fmt.Sprintf("line %d: invalid octal argument to 'socketmode' ('%s')", idx, argument))
+		}
+		p.SocketMode = os.FileMode(mode)
+	case "socketowner":
+		if err = p.setSocketOwner(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'socketowner' ('%s'): %v", idx, argument, err))
+		}
+	case "vrfy":
+		if p.Vrfy, err = parseAccess(argument); err != nil {
+			return errors.New(fmt.Sprintf("line %d: invalid argument to 'vrfy' ('%s')", idx, argument))
+		}
+	default:
+		return errors.New(fmt.Sprintf("line %d: unrecognized listener directive: %s", idx, directive))
+	}
+	return nil
+}
+
+// Set the mode of this listener.
+func (p *ListenerProfile) setMode(s string) error {
+	switch strings.ToLower(s) {
+	case "smtp":
+		p.Mode = ModeSMTP
+	case "submission":
+		p.Mode = ModeSubmission
+	case "smtps":
+		p.Mode = ModeSMTPS
+	case "lmtp":
+		p.Mode = ModeLMTP
+	default:
+		return errors.New(fmt.Sprintf("unknown listener mode: %s", s))
+	}
+	return nil
+}
+
+// Set the owner of this listener's socket file from a "user" or
+// "user:group" argument.
+func (p *ListenerProfile) setSocketOwner(s string) error {
+	parts := strings.SplitN(s, ":", 2)
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		return err
+	}
+	if p.SocketUid, err = strconv.Atoi(u.Uid); err != nil {
+		return err
+	}
+	gid := u.Gid
+	if len(parts) == 2 {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			return err
+		}
+		gid = g.Gid
+	}
+	p.SocketGid, err = strconv.Atoi(gid)
+	return err
+}
+
+// Check that this listener has everything it needs to run.
+func (p *ListenerProfile) validate(c *config) error {
+	if p.Addr == nil {
+		return errors.New(fmt.Sprintf("listener '%s' has no 'address'", p.Name))
+	}
+	_, isUnix := p.Addr.(*net.UnixAddr)
+	if !isUnix && (p.SocketMode != 0 || p.SocketUid != -1) {
+		return errors.New(fmt.Sprintf("listener '%s' sets socket permissions but is not a Unix socket", p.Name))
+	}
+	if p.Proxy && len(p.ProxyFrom) == 0 {
+		return errors.New(fmt.Sprintf("listener '%s' uses 'proxyprotocol' but has no 'proxytrusted' networks", p.Name))
+	}
+	if (p.Mode == ModeSMTPS || p.RequireTLS) && c.tlsConfig == nil {
+		return errors.New(fmt.Sprintf("listener '%s' needs 'tlscert' and 'tlskey' to be set", p.Name))
+	}
+	// There is no AUTH command: clients are authenticated by a front-end
+	// that passes their login on with XCLIENT.
+	if p.Mode == ModeSubmission && !p.RequireAuth {
+		return errors.New(fmt.Sprintf("submission listener '%s' must set 'requireauth'", p.Name))
+	}
+	if p.RequireAuth && len(c.xclientHosts) == 0 {
+		return errors.New(fmt.Sprintf("listener '%s' uses 'requireauth' but no 'xclienthosts' are set to authenticate its clients", p.Name))
+	}
+	return nil
+}
+
+// Parse an argument saying which clients may use a command: yes for all,
+// no for none, or trusted for authenticated, local and trusted clients.
+func parseAccess(s string) (CommandAccess, error) {
+	if strings.ToLower(s) == "trusted" {
+		return AccessTrusted, nil
+	}
+	all, err := parseBool(s)
+	if err != nil {
+		return AccessNone, errors.New("expected yes, no or trusted")
+	}
+	if all {
+		return AccessAll, nil
+	}
+	return AccessNone, nil
+}
+
+// Parse a yes/no configuration argument.
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes", "true", "on", "1":
+		return true, nil
+	case "no", "false", "off", "0":
+		return false, nil
+	}
+	return false, errors.New("expected yes or no")
+}
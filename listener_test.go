@@ -0,0 +1,55 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"testing"
+)
+
+func TestRequireAuthConfig(t *testing.T) {
+	tests := []struct {
+		xclient string
+		lines   []string
+		ok      bool
+	}{
+		{"", []string{"mode: submission"}, false},
+		{"", []string{"mode: submission", "requireauth: yes"}, false},
+		{"", []string{"requireauth: yes"}, false},
+		{"10.0.0.0/8", []string{"mode: submission"}, false},
+		{"10.0.0.0/8", []string{"mode: submission", "requireauth: yes"}, true},
+		{"10.0.0.0/8", []string{"requireauth: yes"}, true},
+	}
+	for _, test := range tests {
+		lines := []string{"listener: submission", "address: 127.0.0.1:587"}
+		if test.xclient != "" {
+			lines = append([]string{"xclienthosts: " + test.xclient}, lines...)
+		}
+		lines = append(append(lines, test.lines...), "end")
+		if _, err := parseTestConfig(lines...); (err == nil) != test.ok {
+			t.Errorf("xclienthosts %q %q: got error %v", test.xclient, test.lines, err)
+		}
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	cfg := testConfig(t,
+		"domain: mx.example.com",
+		"localdomains: example.com",
+		"xclienthosts: 10.0.0.0/8",
+		"listener: submission",
+		"address: 127.0.0.1:587",
+		"mode: submission",
+		"requireauth: yes",
+		"end")
+	c := startSession(t, cfg, "198.51.100.7", nil)
+	c.send(250, "EHLO client.example")
+	c.send(530, "MAIL FROM:<a@example.com>")
+
+	c = startSession(t, cfg, "10.1.2.3", nil)
+	c.send(250, "EHLO proxy.example")
+	c.send(220, "XCLIENT ADDR=198.51.100.7")
+	c.send(250, "EHLO client.example")
+	c.send(530, "MAIL FROM:<a@example.com>")
+	c.send(220, "XCLIENT LOGIN=alice")
+	c.send(250, "EHLO client.example")
+	c.send(250, "MAIL FROM:<a@example.com>")
+}
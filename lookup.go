@@ -0,0 +1,295 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/codeslinger/log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Lookup tables --------------------------------------------------------
+
+// A table of keys and values kept in a file, such as the list of addresses
+// mail is accepted for. Keys are looked up in lower case. Tables notice when
+// their file changes and reload it, until they are closed.
+type LookupTable interface {
+	Lookup(key string) (string, bool, error)
+	String() string
+	Close() error
+}
+
+// A table read into memory from a text file. The first field of each line
+// is a key and the rest of the line its value, so Postfix-style tables can
+// be used as they are. Blank lines and lines beginning with # are ignored.
+type flatTable struct {
+	lock    sync.RWMutex
+	watch   fileWatch
+	entries map[string]string
+}
+
+// A table in a constant database file, as built by cdbmake, which is read
+// from disk on each lookup and so suits large tables.
+type cdbTable struct {
+	lock   sync.RWMutex
+	watch  fileWatch
+	file   *os.File
+	closed bool
+}
+
+// The state of a table's file when it was last loaded.
+type fileWatch struct {
+	lock    sync.Mutex
+	path    string
+	mod     time.Time
+	size    int64
+	checked time.Time
+}
+
+var (
+	cdbCorrupt  = errors.New("corrupt cdb file: record past end of file")
+	tableClosed = errors.New("lookup table has been closed")
+)
+
+const (
+	lookupCheckInterval = time.Second
+	cdbHeaderSize       = 2048
+	cdbTablePrefix      = "cdb:"
+	flatTablePrefix     = "file:"
+)
+
+// Open the table given in the configuration as "cdb:<path>" for a constant
+// database, or as a path, optionally prefixed with "file:", for a text file.
+func OpenLookupTable(spec string) (LookupTable, error) {
+	if strings.HasPrefix(spec, cdbTablePrefix) {
+		t := &cdbTable{watch: fileWatch{path: spec[len(cdbTablePrefix):]}}
+		return t, t.load()
+	}
+	t := &flatTable{watch: fileWatch{path: strings.TrimPrefix(spec, flatTablePrefix)}}
+	return t, t.load()
+}
+
+// --- Text files ---
+
+func (t *flatTable) Lookup(key string) (string, bool, error) {
+	t.refresh()
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	v, ok := t.entries[strings.ToLower(key)]
+	return v, ok, nil
+}
+
+func (t *flatTable) String() string {
+	return t.watch.path
+}
+
+// A text file is not held open, so there is nothing to release.
+func (t *flatTable) Close() error {
+	return nil
+}
+
+// Reload the file if it has changed, keeping the old entries if it cannot be
+// read.
+func (t *flatTable) refresh() {
+	if !t.watch.changed() {
+		return
+	}
+	if err := t.load(); err != nil {
+		log.Error("failed to reload %s: %v", t.watch.path, err)
+		return
+	}
+	log.Info("reloaded %s", t.watch.path)
+}
+
+func (t *flatTable) load() error {
+	file, err := os.Open(t.watch.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			key, value = line[:i], strings.TrimSpace(line[i:])
+		}
+		key = strings.ToLower(key)
+		if _, ok := entries[key]; !ok {
+			entries[key] = value
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	t.entries = entries
+	t.watch.loaded(info)
+	t.lock.Unlock()
+	return nil
+}
+
+// --- Constant databases ---
+
+func (t *cdbTable) Lookup(key string) (string, bool, error) {
+	t.refresh()
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.closed {
+		return "", false, tableClosed
+	}
+	return cdbGet(t.file, t.watch.size, strings.ToLower(key))
+}
+
+func (t *cdbTable) String() string {
+	return cdbTablePrefix + t.watch.path
+}
+
+// Close the file. Lookups in a closed table fail.
+func (t *cdbTable) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	return t.file.Close()
+}
+
+// Reopen the file if it has been replaced, keeping the old one open if the
+// new one cannot be.
+func (t *cdbTable) refresh() {
+	if !t.watch.changed() {
+		return
+	}
+	if err := t.load(); err != nil {
+		log.Error("failed to reopen %s: %v", t.watch.path, err)
+		return
+	}
+	log.Info("reopened %s", t.watch.path)
+}
+
+func (t *cdbTable) load() error {
+	file, err := os.Open(t.watch.path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() < cdbHeaderSize {
+		err = errors.New("file too short to be a cdb")
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		file.Close()
+		return tableClosed
+	}
+	old := t.file
+	t.file = file
+	t.watch.loaded(info)
+	t.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Look a key up in a constant database file of the given size. The format is
+// described at http://cr.yp.to/cdb/cdb.txt.
+func cdbGet(file *os.File, size int64, key string) (string, bool, error) {
+	h := cdbHash(key)
+	buf := make([]byte, 8)
+	if _, err := file.ReadAt(buf, int64(h%256)*8); err != nil {
+		return "", false, err
+	}
+	pos := binary.LittleEndian.Uint32(buf)
+	slots := binary.LittleEndian.Uint32(buf[4:])
+	if slots == 0 {
+		return "", false, nil
+	}
+	if int64(pos)+int64(slots)*8 > size {
+		return "", false, cdbCorrupt
+	}
+	slot := (h >> 8) % slots
+	for i := uint32(0); i < slots; i++ {
+		if _, err := file.ReadAt(buf, int64(pos)+int64(slot)*8); err != nil {
+			return "", false, err
+		}
+		hash := binary.LittleEndian.Uint32(buf)
+		rec := binary.LittleEndian.Uint32(buf[4:])
+		if rec == 0 {
+			return "", false, nil
+		}
+		if hash == h {
+			if _, err := file.ReadAt(buf, int64(rec)); err != nil {
+				return "", false, err
+			}
+			klen := binary.LittleEndian.Uint32(buf)
+			dlen := binary.LittleEndian.Uint32(buf[4:])
+			if int64(rec)+8+int64(klen)+int64(dlen) > size {
+				return "", false, cdbCorrupt
+			}
+			if int(klen) == len(key) {
+				data := make([]byte, klen+dlen)
+				if _, err := file.ReadAt(data, int64(rec)+8); err != nil {
+					return "", false, err
+				}
+				if string(data[:klen]) == key {
+					return string(data[klen:]), true, nil
+				}
+			}
+		}
+		slot = (slot + 1) % slots
+	}
+	return "", false, nil
+}
+
+func cdbHash(key string) uint32 {
+	h := uint32(5381)
+	for i := 0; i < len(key); i++ {
+		h = ((h << 5) + h) ^ uint32(key[i])
+	}
+	return h
+}
+
+// --- Watching files ---
+
+// Report whether the file appears to have changed since it was loaded,
+// looking at it no more than once every lookupCheckInterval.
+func (w *fileWatch) changed() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := time.Now()
+	if now.Sub(w.checked) < lookupCheckInterval {
+		return false
+	}
+	w.checked = now
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(w.mod) || info.Size() != w.size
+}
+
+// Record the state of the file just loaded.
+func (w *fileWatch) loaded(info os.FileInfo) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.mod, w.size, w.checked = info.ModTime(), info.Size(), time.Now()
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Build a constant database holding the given entries, as cdbmake would.
+func makeCDB(entries map[string]string) []byte {
+	type slot struct{ hash, pos uint32 }
+	var tables [256][]slot
+	data := make([]byte, cdbHeaderSize)
+	for k, v := range entries {
+		h := cdbHash(k)
+		tables[h%256] = append(tables[h%256], slot{h, uint32(len(data))})
+		rec := make([]byte, 8)
+		binary.LittleEndian.PutUint32(rec, uint32(len(k)))
+		binary.LittleEndian.PutUint32(rec[4:], uint32(len(v)))
+		data = append(append(append(data, rec...), k...), v...)
+	}
+	for i, t := range tables {
+		n := uint32(len(t) * 2)
+		binary.LittleEndian.PutUint32(data[i*8:], uint32(len(data)))
+		binary.LittleEndian.PutUint32(data[i*8+4:], n)
+		table := make([]byte, n*8)
+		for _, s := range t {
+			j := (s.hash >> 8) % n
+			for binary.LittleEndian.Uint32(table[j*8+4:]) != 0 {
+				j = (j + 1) % n
+			}
+			binary.LittleEndian.PutUint32(table[j*8:], s.hash)
+			binary.LittleEndian.PutUint32(table[j*8+4:], s.pos)
+		}
+		data = append(data, table...)
+	}
+	return data
+}
+
+func writeCDB(t *testing.T, data []byte) LookupTable {
+	path := filepath.Join(t.TempDir(), "table.cdb")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	table, err := OpenLookupTable(cdbTablePrefix + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func TestCDBLookup(t *testing.T) {
+	table := writeCDB(t, makeCDB(map[string]string{
+		"alice": "alice@example.org",
+		"bob":   "",
+	}))
+	tests := []struct {
+		key, value string
+		found      bool
+	}{
+		{"alice", "alice@example.org", true},
+		{"ALICE", "alice@example.org", true},
+		{"bob", "", true},
+		{"carol", "", false},
+	}
+	for _, test := range tests {
+		v, found, err := table.Lookup(test.key)
+		if err != nil || v != test.value || found != test.found {
+			t.Errorf("%s: got %q %v (%v), want %q %v", test.key, v, found, err, test.value, test.found)
+		}
+	}
+}
+
+func TestCDBCorrupt(t *testing.T) {
+	data := makeCDB(map[string]string{"alice": "alice@example.org"})
+	// Claim a value far longer than the file.
+	binary.LittleEndian.PutUint32(data[cdbHeaderSize+4:], 1<<31)
+	if _, _, err := writeCDB(t, data).Lookup("alice"); err != cdbCorrupt {
+		t.Errorf("got error %v, want %v", err, cdbCorrupt)
+	}
+
+	data = makeCDB(map[string]string{"alice": "alice@example.org"})
+	// Point the key's hash table past the end of the file.
+	h := cdbHash("alice") % 256
+	binary.LittleEndian.PutUint32(data[h*8:], uint32(len(data)))
+	if _, _, err := writeCDB(t, data).Lookup("alice"); err != cdbCorrupt {
+		t.Errorf("got error %v, want %v", err, cdbCorrupt)
+	}
+}
+
+func TestCDBClose(t *testing.T) {
+	table := writeCDB(t, makeCDB(map[string]string{"alice": "alice@example.org"}))
+	if err := table.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := table.Lookup("alice"); err != tableClosed {
+		t.Errorf("got error %v, want %v", err, tableClosed)
+	}
+	if err := table.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
@@ -11,7 +11,6 @@ import (
 )
 
 var configPath *string
-var cfg Config
 
 func init() {
 	configPath = flag.String("config", "", "Path to configuration file")
@@ -26,19 +25,30 @@ func main() {
 	}
 	log.Info("loaded config: %s", cfg)
 	runtime.GOMAXPROCS(cfg.Cores())
-	exitChan := trapSignals()
-	go RunTCP(NewSMTPService(cfg, exitChan))
-	<-exitChan
+	server := NewServer(*configPath, cfg)
+	trapSignals(server)
+	if err := server.Start(); err != nil {
+		return
+	}
+	<-server.Exited()
+	server.Stop()
 }
 
-func trapSignals() chan int {
-	exitChan := make(chan int)
+func trapSignals(server *Server) {
 	signalChan := make(chan os.Signal, 1)
 	go func() {
-		s := <-signalChan
-		log.Info("received signal %d", s)
-		exitChan <- 1
+		for s := range signalChan {
+			log.Info("received signal %d", s)
+			switch s {
+			case syscall.SIGHUP:
+				server.Reload()
+			case syscall.SIGUSR2:
+				go server.Upgrade()
+			default:
+				server.Exited() <- 1
+				return
+			}
+		}
 	}()
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	return exitChan
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
 }
@@ -3,25 +3,198 @@ package main
 
 import (
 	"container/list"
+	"fmt"
 	"net"
+	"strings"
+	"time"
 )
 
 // --- SMTP message submission ----------------------------------------------
 
 // Represents a single SMTP message submission.
 type SMTPMessage struct {
-	Remote *net.TCPAddr
-	From   string
-	To     *list.List
-	Body   string
+	Remote     net.Addr     // *net.TCPAddr, or *UnixPeer for Unix socket clients
+	Helo       string       // name given in HELO or EHLO
+	Login      string       // authenticated user, if any
+	Proto      string       // protocol, as in Received: headers
+	Forward    *ForwardInfo // original client given by XFORWARD, if any
+	HeloSPF    *SPFCheck    // SPF check of the HELO name, if enabled
+	SPF        *SPFCheck    // SPF check of the sender, or HeloSPF for a null sender
+	DKIM       []*DKIMCheck // result of verifying each DKIM signature, if enabled
+	DMARC      *DMARCCheck  // DMARC evaluation, if enabled
+	ARC        *ARCCheck    // ARC chain validation, if enabled
+	Spam       *SpamdResult // spamd's verdict, if checked
+	Virus      string       // name of the virus clamd found, if any
+	Discarded  bool         // a content filter asked for it to be thrown away
+	Quarantine string       // why it should be held for review, if it should
+	From       string
+	Rcpts      []string   // recipients as the client gave them
+	To         *list.List // addresses to deliver to, after alias expansion
+	Body       string
+}
+
+// Attributes of the original client of a message, as passed on by a trusted
+// front-end with XFORWARD. Empty fields were not given or were unavailable.
+type ForwardInfo struct {
+	Name   string
+	Addr   string
+	Port   string
+	Proto  string
+	Helo   string
+	Ident  string
+	Source string
 }
 
 // Create a new record for an SMTP message submission.
-func NewSMTPMessage(addr *net.TCPAddr) *SMTPMessage {
+func NewSMTPMessage(addr net.Addr) *SMTPMessage {
 	return &SMTPMessage{
-		Remote: addr,
-		From:   "",
-		To:     list.New(),
-		Body:   "",
+		Remote:     addr,
+		Helo:       "",
+		Login:      "",
+		Proto:      "ESMTP",
+		Forward:    nil,
+		HeloSPF:    nil,
+		SPF:        nil,
+		DKIM:       nil,
+		DMARC:      nil,
+		ARC:        nil,
+		Spam:       nil,
+		Virus:      "",
+		Discarded:  false,
+		Quarantine: "",
+		From:       "",
+		Rcpts:      nil,
+		To:         list.New(),
+		Body:       "",
+	}
+}
+
+// Format the Received: header to be added to this message by the given host.
+// The original client given by XFORWARD is named in preference to the
+// front-end that relayed the message.
+func (m *SMTPMessage) ReceivedHeader(by string, now time.Time) string {
+	helo, name, addr, proto := m.Helo, "", fmt.Sprint(m.Remote), m.Proto
+	if ip := RemoteIP(m.Remote); ip != nil {
+		addr = ip.String()
+	}
+	if f := m.Forward; f != nil {
+		if f.Helo != "" {
+			helo = f.Helo
+		}
+		if f.Addr != "" {
+			addr = f.Addr
+		}
+		if f.Proto != "" {
+			proto = f.Proto
+		}
+		name = f.Name
+	}
+	if name == "" {
+		name = "unknown"
+	}
+	return fmt.Sprintf("Received: from %s (%s [%s])\r\n\tby %s with %s;\r\n\t%s\r\n",
+		helo, name, addr, by, proto, now.Format(time.RFC1123Z))
+}
+
+// Format the X-Quarantine: header asking for this message to be held for
+// review, or an empty string if it need not be.
+func (m *SMTPMessage) QuarantineHeader() string {
+	if m.Quarantine == "" {
+		return ""
+	}
+	return "X-Quarantine: " + m.Quarantine + "\r\n"
+}
+
+// Format the Authentication-Results: header (RFC 8601) recording the checks
+// made on this message by the given host, or an empty string if no checks
+// were made.
+func (m *SMTPMessage) AuthResultsHeader(authserv string) string {
+	results := m.authResults()
+	if len(results) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Authentication-Results: %s;\r\n\t%s\r\n", authserv, strings.Join(results, ";\r\n\t"))
+}
+
+// Return the result entries of the checks made on this message, as given
+// in Authentication-Results and ARC-Authentication-Results headers.
+func (m *SMTPMessage) authResults() []string {
+	results := make([]string, 0)
+	if c := m.SPF; c != nil {
+		if c.Identity == "helo" {
+			results = append(results, fmt.Sprintf("spf=%s smtp.helo=%s", c.Result, c.Helo))
+		} else {
+			results = append(results, fmt.Sprintf("spf=%s smtp.mailfrom=%s", c.Result, c.Sender))
+		}
+	}
+	if m.DKIM != nil && len(m.DKIM) == 0 {
+		results = append(results, "dkim=none")
+	}
+	for _, c := range m.DKIM {
+		r := "dkim=" + string(c.Result)
+		if c.Reason != "" {
+			r += " (" + c.Reason + ")"
+		}
+		if c.Domain != "" {
+			r += " header.d=" + c.Domain
+		}
+		if c.Selector != "" {
+			r += " header.s=" + c.Selector
+		}
+		if len(c.Signature) >= 8 {
+			r += " header.b=" + c.Signature[:8]
+		}
+		results = append(results, r)
+	}
+	if c := m.DMARC; c != nil {
+		r := "dmarc=" + string(c.Result)
+		if c.Record != nil {
+			r += fmt.Sprintf(" (p=%s dis=%s)", c.Policy, c.Disposition)
+		}
+		if c.Domain != "" {
+			r += " header.from=" + c.Domain
+		}
+		results = append(results, r)
+	}
+	if c := m.ARC; c != nil {
+		r := "arc=" + c.Result
+		if c.Reason != "" {
+			r += " (" + c.Reason + ")"
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func (m *SMTPMessage) String() string {
+	s := fmt.Sprintf("client=%s helo=%s from=<%s> rcpts=%d size=%d",
+		m.Remote, m.Helo, m.From, m.To.Len(), len(m.Body))
+	if m.Login != "" {
+		s += fmt.Sprintf(" login=%s", m.Login)
+	}
+	if m.SPF != nil {
+		s += fmt.Sprintf(" spf=%s", m.SPF.Result)
+	}
+	for _, c := range m.DKIM {
+		s += fmt.Sprintf(" dkim=%s", c)
+	}
+	if m.DMARC != nil {
+		s += fmt.Sprintf(" dmarc=%s", m.DMARC.Result)
+	}
+	if m.ARC != nil {
+		s += fmt.Sprintf(" arc=%s", m.ARC)
+	}
+	if m.Spam != nil {
+		s += fmt.Sprintf(" spam=%s", m.Spam)
+	}
+	if m.Virus != "" {
+		s += fmt.Sprintf(" virus=%s", m.Virus)
+	}
+	if m.Quarantine != "" {
+		s += fmt.Sprintf(" quarantine=%q", m.Quarantine)
+	}
+	if f := m.Forward; f != nil {
+		s += fmt.Sprintf(" orig_client=%s[%s]:%s orig_helo=%s", f.Name, f.Addr, f.Port, f.Helo)
 	}
+	return s
 }
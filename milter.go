@@ -0,0 +1,679 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/codeslinger/log"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Milter ---------------------------------------------------------------
+
+// Settings for the external content filters called with the Sendmail milter
+// protocol, in the order they are to be called. Default says what to do when
+// a filter cannot be reached or misbehaves: carry on without it, or refuse
+// the command it was called for, permanently or temporarily.
+type MilterPolicy struct {
+	Addrs   []net.Addr
+	Default string
+	Timeout time.Duration
+}
+
+// A session's connection to one filter. Done is set once the filter has
+// accepted the connection, and skip once it has accepted the current
+// message, after which it is not called again for them.
+type milterConn struct {
+	addr     net.Addr
+	conn     net.Conn
+	timeout  time.Duration
+	actions  uint32
+	protocol uint32
+	done     bool
+	skip     bool
+}
+
+// A modification requested by a filter at the end of a message.
+type milterChange struct {
+	reply byte
+	data  []byte
+}
+
+const (
+	MilterAccept   = "accept"
+	MilterReject   = "reject"
+	MilterTempfail = "tempfail"
+
+	defaultMilterTimeout = 30 * time.Second
+	milterVersion        = 6
+	milterChunkSize      = 65535
+	milterMaxPacket      = 1 << 20
+)
+
+// Commands sent to filters.
+const (
+	smficAbort   = 'A'
+	smficBody    = 'B'
+	smficConnect = 'C'
+	smficMacro   = 'D'
+	smficEOB     = 'E'
+	smficHelo    = 'H'
+	smficHeader  = 'L'
+	smficMail    = 'M'
+	smficEOH     = 'N'
+	smficOptNeg  = 'O'
+	smficQuit    = 'Q'
+	smficRcpt    = 'R'
+	smficData    = 'T'
+)
+
+// Replies from filters.
+const (
+	smfirAddRcpt    = '+'
+	smfirDelRcpt    = '-'
+	smfirAccept     = 'a'
+	smfirReplBody   = 'b'
+	smfirContinue   = 'c'
+	smfirDiscard    = 'd'
+	smfirChgFrom    = 'e'
+	smfirAddHeader  = 'h'
+	smfirInsHeader  = 'i'
+	smfirChgHeader  = 'm'
+	smfirProgress   = 'p'
+	smfirQuarantine = 'q'
+	smfirReject     = 'r'
+	smfirSkip       = 's'
+	smfirTempfail   = 't'
+	smfirReplyCode  = 'y'
+)
+
+// Modifications filters may make at the end of a message. Quarantining is
+// not supported.
+const (
+	smfifAddHdrs    = 0x01
+	smfifChgBody    = 0x02
+	smfifAddRcpt    = 0x04
+	smfifDelRcpt    = 0x08
+	smfifChgHdrs    = 0x10
+	smfifQuarantine = 0x20
+	smfifChgFrom    = 0x40
+
+	milterActions = smfifAddHdrs | smfifChgBody | smfifAddRcpt | smfifDelRcpt | smfifChgHdrs | smfifChgFrom
+)
+
+// Steps filters may ask not to be sent, or not to reply to.
+const (
+	smfipNoConnect = 0x01
+	smfipNoHelo    = 0x02
+	smfipNoMail    = 0x04
+	smfipNoRcpt    = 0x08
+	smfipNoBody    = 0x10
+	smfipNoHdrs    = 0x20
+	smfipNoEOH     = 0x40
+	smfipNrHdr     = 0x80
+	smfipNoUnknown = 0x100
+	smfipNoData    = 0x200
+	smfipSkip      = 0x400
+	smfipNrConn    = 0x1000
+	smfipNrHelo    = 0x2000
+	smfipNrMail    = 0x4000
+	smfipNrRcpt    = 0x8000
+	smfipNrData    = 0x10000
+	smfipNrUnknown = 0x20000
+	smfipNrEOH     = 0x40000
+	smfipNrBody    = 0x80000
+
+	milterProtocol = smfipNoConnect | smfipNoHelo | smfipNoMail | smfipNoRcpt |
+		smfipNoBody | smfipNoHdrs | smfipNoEOH | smfipNrHdr | smfipNoUnknown |
+		smfipNoData | smfipSkip | smfipNrConn | smfipNrHelo | smfipNrMail |
+		smfipNrRcpt | smfipNrData | smfipNrUnknown | smfipNrEOH | smfipNrBody
+)
+
+// For each command, the protocol flags with which a filter asks not to be
+// sent it and not to reply to it.
+var milterStepFlags = map[byte][2]uint32{
+	smficConnect: {smfipNoConnect, smfipNrConn},
+	smficHelo:    {smfipNoHelo, smfipNrHelo},
+	smficMail:    {smfipNoMail, smfipNrMail},
+	smficRcpt:    {smfipNoRcpt, smfipNrRcpt},
+	smficData:    {smfipNoData, smfipNrData},
+	smficHeader:  {smfipNoHdrs, smfipNrHdr},
+	smficEOH:     {smfipNoEOH, smfipNrEOH},
+	smficBody:    {smfipNoBody, smfipNrBody},
+}
+
+// The action a filter must have been granted to make each modification.
+var milterChangeActions = map[byte]uint32{
+	smfirAddHeader:  smfifAddHdrs,
+	smfirInsHeader:  smfifAddHdrs,
+	smfirChgHeader:  smfifChgHdrs,
+	smfirReplBody:   smfifChgBody,
+	smfirAddRcpt:    smfifAddRcpt,
+	smfirDelRcpt:    smfifDelRcpt,
+	smfirChgFrom:    smfifChgFrom,
+	smfirQuarantine: smfifQuarantine,
+}
+
+// Connect to a filter and negotiate the protocol with it.
+func dialMilter(addr net.Addr, timeout time.Duration) (*milterConn, error) {
+	conn, err := net.DialTimeout(addr.Network(), addr.String(), timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newMilterConn(addr, conn, timeout)
+}
+
+// Negotiate the protocol with a filter over a new connection to it. The
+// connection is closed if that fails.
+func newMilterConn(addr net.Addr, conn net.Conn, timeout time.Duration) (*milterConn, error) {
+	m := &milterConn{addr: addr, conn: conn, timeout: timeout}
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:], milterVersion)
+	binary.BigEndian.PutUint32(data[4:], milterActions)
+	binary.BigEndian.PutUint32(data[8:], milterProtocol)
+	var reply byte
+	err := m.send(smficOptNeg, data)
+	if err == nil {
+		reply, data, err = m.read()
+	}
+	if err == nil && (reply != smficOptNeg || len(data) < 12) {
+		err = errors.New("malformed option negotiation reply")
+	}
+	if err == nil {
+		version := binary.BigEndian.Uint32(data[0:])
+		m.actions = binary.BigEndian.Uint32(data[4:]) & milterActions
+		m.protocol = binary.BigEndian.Uint32(data[8:])
+		if version < 2 || version > milterVersion {
+			err = errors.New(fmt.Sprintf("unsupported protocol version %d", version))
+		} else if extra := m.protocol &^ milterProtocol; extra != 0 {
+			err = errors.New(fmt.Sprintf("unsupported protocol flags %#x", extra))
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Send a command, along with the macros defined for it, and return the
+// filter's reply. Commands the filter asked not to be sent or not to reply
+// to are taken as if it had replied to continue.
+func (m *milterConn) call(cmd byte, macros []string, data []byte) (byte, []byte, error) {
+	flags := milterStepFlags[cmd]
+	if m.protocol&flags[0] != 0 {
+		return smfirContinue, nil, nil
+	}
+	if len(macros) > 0 {
+		if err := m.send(smficMacro, append([]byte{cmd}, nulJoin(macros...)...)); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := m.send(cmd, data); err != nil {
+		return 0, nil, err
+	}
+	if m.protocol&flags[1] != 0 {
+		return smfirContinue, nil, nil
+	}
+	return m.reply()
+}
+
+// Read the filter's reply to a command, waiting for as long as it reports
+// that it is making progress.
+func (m *milterConn) reply() (byte, []byte, error) {
+	for {
+		reply, data, err := m.read()
+		if err != nil || reply != smfirProgress {
+			return reply, data, err
+		}
+	}
+}
+
+// Write one packet to the filter.
+func (m *milterConn) send(cmd byte, data []byte) error {
+	buf := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)+1))
+	buf[4] = cmd
+	copy(buf[5:], data)
+	if err := m.conn.SetWriteDeadline(time.Now().Add(m.timeout)); err != nil {
+		return err
+	}
+	_, err := m.conn.Write(buf)
+	return err
+}
+
+// Read one packet from the filter.
+func (m *milterConn) read() (byte, []byte, error) {
+	if err := m.conn.SetReadDeadline(time.Now().Add(m.timeout)); err != nil {
+		return 0, nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(m.conn, size[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 1 || n > milterMaxPacket {
+		return 0, nil, errors.New(fmt.Sprintf("bad packet length %d", n))
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(m.conn, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+// Say goodbye to the filter and disconnect.
+func (m *milterConn) close() {
+	if m.conn == nil {
+		return
+	}
+	m.send(smficQuit, nil)
+	m.conn.Close()
+	m.conn = nil
+}
+
+// Connect to the configured filters and tell them about the client. If the
+// session must not go on, the client is told why and Terminate returned.
+func (s *SMTPSession) connectMilters() Verdict {
+	s.closeMilters()
+	p := s.cfg.Milters()
+	if p == nil {
+		return Continue
+	}
+	for _, addr := range p.Addrs {
+		m, err := dialMilter(addr, p.Timeout)
+		if err != nil {
+			if code, msg := s.milterFailed(&milterConn{addr: addr}, smficConnect, err); code != 0 {
+				s.respond(code, msg)
+				return Terminate
+			}
+			continue
+		}
+		s.milters = append(s.milters, m)
+	}
+	macros := []string{"j", s.cfg.ServingDomain(), "{daemon_name}", s.profile.Name}
+	if ip := RemoteIP(s.remote); ip != nil {
+		macros = append(macros, "{client_addr}", ip.String())
+	}
+	if code, msg := s.milterStep(smficConnect, macros, s.milterConnectData()); code != 0 {
+		log.Warn("%s: milter refused connection: %d %s", s.remote, code, msg)
+		s.respond(code, msg)
+		return Terminate
+	}
+	return Continue
+}
+
+// Tell the filters the client's HELO name.
+func (s *SMTPSession) milterHelo() (int, string) {
+	return s.milterStep(smficHelo, nil, nulJoin(s.helo))
+}
+
+// Tell the filters the sender of a new message, which has just been
+// started.
+func (s *SMTPSession) milterMail(from string) (int, string) {
+	for _, m := range s.milters {
+		m.skip = false
+	}
+	s.message.Discarded = s.discard
+	macros := []string{"{mail_addr}", from}
+	if s.authenticated && s.login != "" {
+		macros = append(macros, "{auth_authen}", s.login)
+	}
+	return s.milterStep(smficMail, macros, nulJoin("<"+from+">"))
+}
+
+// Tell the filters about a recipient of the current message.
+func (s *SMTPSession) milterRcpt(rcpt string) (int, string) {
+	return s.milterStep(smficRcpt, []string{"{rcpt_addr}", rcpt}, nulJoin("<"+rcpt+">"))
+}
+
+// Tell the filters that the client is about to send the message.
+func (s *SMTPSession) milterData() (int, string) {
+	return s.milterStep(smficData, nil, nil)
+}
+
+// Pass the current message to each filter in turn, applying the changes each
+// one asks for before calling the next.
+func (s *SMTPSession) milterMessage() (int, string) {
+	for _, m := range s.milters {
+		if s.discarding() {
+			break
+		}
+		if m.conn == nil || m.done || m.skip {
+			continue
+		}
+		code, msg, err := s.filterMessage(m)
+		if err != nil {
+			code, msg = s.milterFailed(m, smficEOB, err)
+		}
+		if code != 0 {
+			return code, msg
+		}
+	}
+	return 0, ""
+}
+
+// Tell the filters that the current message has been abandoned.
+func (s *SMTPSession) milterAbort() {
+	for _, m := range s.milters {
+		m.skip = false
+		if m.conn == nil || m.done {
+			continue
+		}
+		if err := m.send(smficAbort, nil); err != nil {
+			s.milterFailed(m, smficAbort, err)
+		}
+	}
+}
+
+// Disconnect from all filters.
+func (s *SMTPSession) closeMilters() {
+	for _, m := range s.milters {
+		m.close()
+	}
+	s.milters = nil
+	s.discard = false
+}
+
+// Send a command to each filter in turn, stopping at the first that refuses
+// it. If one did, the reply to give the client is returned.
+func (s *SMTPSession) milterStep(cmd byte, macros []string, data []byte) (int, string) {
+	for _, m := range s.milters {
+		if s.discarding() {
+			break
+		}
+		if m.conn == nil || m.done || m.skip {
+			continue
+		}
+		reply, payload, err := m.call(cmd, macros, data)
+		var code int
+		var msg string
+		if err != nil {
+			code, msg = s.milterFailed(m, cmd, err)
+		} else {
+			code, msg = s.milterReply(m, cmd, reply, payload)
+		}
+		if code != 0 {
+			return code, msg
+		}
+	}
+	return 0, ""
+}
+
+// Send the current message to one filter and apply the changes it asks for
+// if it accepts the message. If it refused the message, the reply to give
+// the client is returned.
+func (s *SMTPSession) filterMessage(m *milterConn) (int, string, error) {
+	headers, body := splitMessage(s.message.Body)
+	for _, h := range headers {
+		colon := strings.IndexByte(h, ':')
+		if colon < 0 {
+			continue
+		}
+		value := strings.TrimLeft(strings.TrimSuffix(h[colon+1:], "\r\n"), " \t")
+		data := nulJoin(strings.TrimRight(h[:colon], " \t"), strings.ReplaceAll(value, "\r\n", "\n"))
+		reply, payload, err := m.call(smficHeader, nil, data)
+		if err != nil || reply != smfirContinue {
+			return s.milterEndReply(m, smficHeader, reply, payload, err)
+		}
+	}
+	reply, payload, err := m.call(smficEOH, nil, nil)
+	if err != nil || reply != smfirContinue {
+		return s.milterEndReply(m, smficEOH, reply, payload, err)
+	}
+	if body != "" {
+		body += "\r\n"
+	}
+	for len(body) > 0 {
+		chunk := body
+		if len(chunk) > milterChunkSize {
+			chunk = chunk[:milterChunkSize]
+		}
+		body = body[len(chunk):]
+		reply, payload, err = m.call(smficBody, nil, []byte(chunk))
+		if err == nil && reply == smfirSkip {
+			break
+		}
+		if err != nil || reply != smfirContinue {
+			return s.milterEndReply(m, smficBody, reply, payload, err)
+		}
+	}
+	var changes []milterChange
+	reply, payload, err = m.call(smficEOB, nil, nil)
+	for err == nil {
+		if _, ok := milterChangeActions[reply]; !ok {
+			break
+		}
+		changes = append(changes, milterChange{reply, payload})
+		reply, payload, err = m.reply()
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	code, msg := s.milterReply(m, smficEOB, reply, payload)
+	if code == 0 && len(changes) > 0 {
+		s.applyMilterChanges(m, changes)
+	}
+	return code, msg, nil
+}
+
+// Act on a filter's reply to part of a message, or on the error got instead.
+func (s *SMTPSession) milterEndReply(m *milterConn, cmd, reply byte, data []byte, err error) (int, string, error) {
+	if err != nil {
+		return 0, "", err
+	}
+	code, msg := s.milterReply(m, cmd, reply, data)
+	return code, msg, nil
+}
+
+// Act on a filter's reply to a command, returning the reply to give the
+// client if the filter refused the command.
+func (s *SMTPSession) milterReply(m *milterConn, cmd, reply byte, data []byte) (int, string) {
+	session := cmd == smficConnect || cmd == smficHelo
+	switch reply {
+	case smfirContinue:
+	case smfirAccept:
+		if session {
+			m.done = true
+		} else {
+			m.skip = true
+		}
+	case smfirDiscard:
+		log.Info("%s: milter %s asked to discard mail", s.remote, m.addr)
+		if session || s.message == nil {
+			s.discard = true
+		} else {
+			s.message.Discarded = true
+		}
+	case smfirReject, smfirTempfail:
+		return milterRefusal(cmd, reply)
+	case smfirReplyCode:
+		text := strings.TrimRight(string(data), "\x00")
+		if i := strings.Index(text, "\r\n"); i >= 0 {
+			text = text[:i]
+		}
+		if len(text) < 5 || (text[3] != ' ' && text[3] != '-') {
+			return s.milterFailed(m, cmd, errors.New(fmt.Sprintf("malformed reply code %q", text)))
+		}
+		code, err := strconv.Atoi(text[:3])
+		if err != nil || code < 400 || code > 599 {
+			return s.milterFailed(m, cmd, errors.New(fmt.Sprintf("malformed reply code %q", text)))
+		}
+		return code, text[4:]
+	default:
+		return s.milterFailed(m, cmd, errors.New(fmt.Sprintf("unexpected reply '%c'", reply)))
+	}
+	return 0, ""
+}
+
+// Give up on a filter that could not be reached or misbehaved, returning the
+// reply to give the client according to the configured default action.
+func (s *SMTPSession) milterFailed(m *milterConn, cmd byte, err error) (int, string) {
+	log.Warn("%s: milter %s failed: %v", s.remote, m.addr, err)
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+	switch s.cfg.Milters().Default {
+	case MilterReject:
+		return milterRefusal(cmd, smfirReject)
+	case MilterTempfail:
+		return milterRefusal(cmd, smfirTempfail)
+	}
+	return 0, ""
+}
+
+// Apply the modifications a filter asked for to the current message.
+func (s *SMTPSession) applyMilterChanges(m *milterConn, changes []milterChange) {
+	headers, body := splitMessage(s.message.Body)
+	newBody, replaced := "", false
+	for _, c := range changes {
+		if m.actions&milterChangeActions[c.reply] == 0 {
+			log.Warn("%s: milter %s made a change it did not ask to ('%c'), ignored", s.remote, m.addr, c.reply)
+			continue
+		}
+		data, index := c.data, 0
+		if c.reply == smfirInsHeader || c.reply == smfirChgHeader {
+			if len(data) < 4 {
+				continue
+			}
+			index, data = int(binary.BigEndian.Uint32(data)), data[4:]
+		}
+		args := strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+		switch c.reply {
+		case smfirAddHeader:
+			if len(args) == 2 {
+				headers = append(headers, milterField(args[0], args[1]))
+			}
+		case smfirInsHeader:
+			if len(args) == 2 {
+				if index > len(headers) {
+					index = len(headers)
+				}
+				headers = append(headers[:index], append([]string{milterField(args[0], args[1])}, headers[index:]...)...)
+			}
+		case smfirChgHeader:
+			if len(args) == 2 {
+				headers = changeHeader(headers, args[0], index, args[1])
+			}
+		case smfirReplBody:
+			if !replaced {
+				newBody, replaced = "", true
+			}
+			newBody += string(c.data)
+		case smfirAddRcpt:
+			s.message.To.PushBack(strings.Trim(args[0], "<>"))
+		case smfirDelRcpt:
+			rcpt := strings.Trim(args[0], "<>")
+			for e := s.message.To.Front(); e != nil; {
+				next := e.Next()
+				if strings.EqualFold(e.Value.(string), rcpt) {
+					s.message.To.Remove(e)
+				}
+				e = next
+			}
+		case smfirChgFrom:
+			s.message.From = strings.Trim(args[0], "<>")
+		}
+	}
+	if replaced {
+		body = strings.TrimSuffix(newBody, "\r\n")
+	}
+	s.message.Body = strings.Join(headers, "") + "\r\n" + body
+}
+
+// Report whether the rest of the current message, or of the session, is to
+// be discarded without calling filters any further.
+func (s *SMTPSession) discarding() bool {
+	return s.discard || (s.message != nil && s.message.Discarded)
+}
+
+// Format the client's details as given to filters when it connects.
+func (s *SMTPSession) milterConnectData() []byte {
+	ip := RemoteIP(s.remote)
+	if ip == nil {
+		return append(nulJoin("localhost"), 'U')
+	}
+	name := s.clientName
+	if name == "" {
+		name = "[" + ip.String() + "]"
+	}
+	family, port := byte('4'), 0
+	if ip.To4() == nil {
+		family = '6'
+	}
+	if a, ok := s.remote.(*net.TCPAddr); ok {
+		port = a.Port
+	}
+	data := append(nulJoin(name), family, byte(port>>8), byte(port))
+	return append(data, nulJoin(ip.String())...)
+}
+
+// Return the reply given for a command a filter rejected or temporarily
+// failed without saying how.
+func milterRefusal(cmd, reply byte) (int, string) {
+	if reply == smfirTempfail {
+		if cmd == smficConnect {
+			return 421, "4.7.1 Service unavailable - try again later"
+		}
+		return 451, "4.7.1 Service unavailable - try again later"
+	}
+	switch cmd {
+	case smficConnect:
+		return 554, "5.7.1 Service unavailable"
+	case smficHeader, smficEOH, smficBody, smficEOB:
+		return 550, "5.7.1 Message content rejected"
+	}
+	return 550, "5.7.1 Command rejected"
+}
+
+// Change the header with the given name that is the index'th of that name,
+// counting from 1, or delete it if the new value is empty. A new header is
+// added if there are fewer of that name.
+func changeHeader(headers []string, name string, index int, value string) []string {
+	n := 0
+	for i, h := range headers {
+		if !isHeader(h, name) {
+			continue
+		}
+		if n++; n == index {
+			if value == "" {
+				return append(headers[:i], headers[i+1:]...)
+			}
+			headers[i] = milterField(name, value)
+			return headers
+		}
+	}
+	if value != "" {
+		headers = append(headers, milterField(name, value))
+	}
+	return headers
+}
+
+// Format a header field from a name and a value given by a filter, whose
+// lines are separated by bare newlines. Continuation lines are indented if
+// the filter did not do so.
+func milterField(name, value string) string {
+	lines := strings.Split(strings.ReplaceAll(value, "\r\n", "\n"), "\n")
+	for i := 1; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], " ") && !strings.HasPrefix(lines[i], "\t") {
+			lines[i] = "\t" + lines[i]
+		}
+	}
+	return name + ": " + strings.TrimLeft(strings.Join(lines, "\r\n"), " ") + "\r\n"
+}
+
+// Join strings, terminating each with a NUL, as strings are sent to
+// filters.
+func nulJoin(s ...string) []byte {
+	var buf []byte
+	for _, v := range s {
+		buf = append(append(buf, v...), 0)
+	}
+	return buf
+}
@@ -0,0 +1,333 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// --- Test filter ----------------------------------------------------------
+
+// A filter on the far end of an in-memory connection. It answers each
+// command it has not asked not to reply to with the replies given for it, or
+// with continue, and records the commands it is sent. A reply of 0 makes it
+// hang up instead.
+type fakeMilter struct {
+	version  uint32
+	actions  uint32
+	protocol uint32
+	replies  map[byte][]milterChange
+	mu       sync.Mutex
+	seen     []byte
+}
+
+// Connect to the filter and negotiate the protocol with it.
+func (f *fakeMilter) dial() (*milterConn, error) {
+	server, client := net.Pipe()
+	go f.serve(server)
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8891}
+	return newMilterConn(addr, client, time.Second)
+}
+
+func (f *fakeMilter) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		switch buf[0] {
+		case smficOptNeg:
+			data := make([]byte, 12)
+			binary.BigEndian.PutUint32(data[0:], f.version)
+			binary.BigEndian.PutUint32(data[4:], f.actions)
+			binary.BigEndian.PutUint32(data[8:], f.protocol)
+			writeMilterPacket(conn, smficOptNeg, data)
+			continue
+		case smficMacro:
+			continue
+		case smficQuit:
+			return
+		}
+		f.mu.Lock()
+		f.seen = append(f.seen, buf[0])
+		f.mu.Unlock()
+		if buf[0] == smficAbort || f.protocol&milterStepFlags[buf[0]][1] != 0 {
+			continue
+		}
+		replies, ok := f.replies[buf[0]]
+		if !ok {
+			replies = []milterChange{{smfirContinue, nil}}
+		}
+		for _, r := range replies {
+			if r.reply == 0 {
+				return
+			}
+			writeMilterPacket(conn, r.reply, r.data)
+		}
+	}
+}
+
+// Return the commands the filter has been sent, waiting a little for the
+// given one if it has not been yet.
+func (f *fakeMilter) commands(want byte) string {
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.mu.Lock()
+		seen := string(f.seen)
+		f.mu.Unlock()
+		if strings.IndexByte(seen, want) >= 0 || time.Now().After(deadline) {
+			return seen
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func writeMilterPacket(conn net.Conn, cmd byte, data []byte) {
+	buf := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)+1))
+	buf[4] = cmd
+	copy(buf[5:], data)
+	conn.Write(buf)
+}
+
+// Return a filter granted every action, replying to commands as given.
+func newFakeMilter(replies map[byte][]milterChange) *fakeMilter {
+	return &fakeMilter{version: milterVersion, actions: milterActions, replies: replies}
+}
+
+// Return the data of a reply that changes the index'th header.
+func milterIndexed(index uint32, s ...string) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, index)
+	return append(data, nulJoin(s...)...)
+}
+
+func milterConfig(t *testing.T, lines ...string) *config {
+	return testConfig(t, append([]string{
+		"domain: mx.example.com",
+		"localdomains: example.com",
+		"milter: 127.0.0.1:1",
+	}, lines...)...)
+}
+
+// Start a session, past HELO, whose client is calling the given filters.
+func milterSession(t *testing.T, c *config, filters ...*fakeMilter) (*testClient, *SMTPSession) {
+	server, client := net.Pipe()
+	addr := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40000}
+	s := NewSMTPSession(&addrConn{server, addr}, c, c.Listeners()[0], NewServerState(c))
+	for _, f := range filters {
+		m, err := f.dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.milters = append(s.milters, m)
+	}
+	s.helo = "client.example"
+	s.state = heloReceived
+	go func() {
+		defer server.Close()
+		defer s.Close()
+		for s.Process() != Terminate {
+		}
+	}()
+	return &testClient{Conn: textproto.NewConn(client), t: t, conn: client}, s
+}
+
+// --- Milter ---------------------------------------------------------------
+
+func TestMilterNegotiation(t *testing.T) {
+	f := &fakeMilter{
+		version:  milterVersion,
+		actions:  smfifAddHdrs | smfifQuarantine,
+		protocol: smfipNoHelo | smfipNrMail,
+	}
+	m, err := f.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.actions != smfifAddHdrs {
+		t.Errorf("got actions %#x, want %#x", m.actions, smfifAddHdrs)
+	}
+	for _, cmd := range []byte{smficHelo, smficMail, smficRcpt} {
+		if reply, _, err := m.call(cmd, nil, nil); err != nil || reply != smfirContinue {
+			t.Errorf("'%c': got reply '%c' (%v)", cmd, reply, err)
+		}
+	}
+	if got := f.commands(smficRcpt); got != "MR" {
+		t.Errorf("filter was sent %q, want \"MR\"", got)
+	}
+
+	for _, bad := range []*fakeMilter{
+		{version: 1},
+		{version: milterVersion + 1},
+		{version: milterVersion, protocol: 0x800000},
+	} {
+		if _, err := bad.dial(); err == nil {
+			t.Errorf("version %d protocol %#x accepted", bad.version, bad.protocol)
+		}
+	}
+}
+
+func TestMilterReplies(t *testing.T) {
+	tests := []struct {
+		reply byte
+		data  string
+		code  int
+	}{
+		{smfirContinue, "", 250},
+		{smfirAccept, "", 250},
+		{smfirDiscard, "", 250},
+		{smfirReject, "", 550},
+		{smfirTempfail, "", 451},
+		{smfirReplyCode, "553 5.7.1 Go away\x00", 553},
+		{smfirReplyCode, "250 OK\x00", 451},
+		{smfirReplyCode, "bogus\x00", 451},
+		{'z', "", 451},
+	}
+	for _, test := range tests {
+		f := newFakeMilter(map[byte][]milterChange{
+			smficMail: {{test.reply, []byte(test.data)}},
+		})
+		c, s := milterSession(t, milterConfig(t), f)
+		if got := c.cmd("MAIL FROM:<a@elsewhere.example>"); got != test.code {
+			t.Errorf("'%c' %q: got reply %d, want %d", test.reply, test.data, got, test.code)
+			continue
+		}
+		if test.code != 250 {
+			continue
+		}
+		c.send(250, "RCPT TO:<user@example.com>")
+		seen := f.commands(smficRcpt)
+		switch test.reply {
+		case smfirAccept:
+			if strings.IndexByte(seen, smficRcpt) >= 0 {
+				t.Errorf("filter that accepted the message was sent RCPT")
+			}
+		case smfirDiscard:
+			if !s.message.Discarded {
+				t.Errorf("message not discarded")
+			}
+		}
+	}
+}
+
+func TestMilterChanges(t *testing.T) {
+	f := newFakeMilter(map[byte][]milterChange{
+		smficEOB: {
+			{smfirAddHeader, nulJoin("X-Added", "yes")},
+			{smfirInsHeader, milterIndexed(0, "X-First", "1")},
+			{smfirChgHeader, milterIndexed(1, "Subject", "changed")},
+			{smfirChgHeader, milterIndexed(1, "X-Gone", "")},
+			{smfirReplBody, []byte("new\r\n")},
+			{smfirReplBody, []byte("body\r\n")},
+			{smfirAddRcpt, nulJoin("<extra@example.com>")},
+			{smfirDelRcpt, nulJoin("<user@example.com>")},
+			{smfirAccept, nil},
+		},
+	})
+	unprivileged := newFakeMilter(map[byte][]milterChange{
+		smficEOB: {{smfirAddHeader, nulJoin("X-Ignored", "yes")}, {smfirContinue, nil}},
+	})
+	unprivileged.actions = 0
+	c, s := milterSession(t, milterConfig(t), f, unprivileged)
+	c.send(250, "MAIL FROM:<a@elsewhere.example>")
+	c.send(250, "RCPT TO:<user@example.com>")
+	c.send(354, "DATA")
+	c.send(250, "Subject: hi\r\nX-Gone: soon\r\n\r\nhello\r\n.")
+	headers, body := splitMessage(s.message.Body)
+	if !strings.HasPrefix(headers[0], "X-First: 1\r\n") {
+		t.Errorf("first header is %q", headers[0])
+	}
+	all := strings.Join(headers, "")
+	for _, h := range []string{"Subject: changed\r\n", "X-Added: yes\r\n"} {
+		if !strings.Contains(all, h) {
+			t.Errorf("header %q missing:\n%s", h, all)
+		}
+	}
+	for _, h := range []string{"Subject: hi", "X-Gone:", "X-Ignored:"} {
+		if strings.Contains(all, h) {
+			t.Errorf("header %q present:\n%s", h, all)
+		}
+	}
+	if body != "new\r\nbody" {
+		t.Errorf("got body %q", body)
+	}
+	if s.message.To.Len() != 1 || s.message.To.Front().Value.(string) != "extra@example.com" {
+		t.Errorf("recipients not changed")
+	}
+}
+
+func TestMilterDefault(t *testing.T) {
+	tests := map[string]int{
+		MilterAccept:   250,
+		MilterReject:   550,
+		MilterTempfail: 451,
+	}
+	for policy, code := range tests {
+		f := newFakeMilter(map[byte][]milterChange{smficMail: {{0, nil}}})
+		c, _ := milterSession(t, milterConfig(t, "milterdefault: "+policy), f)
+		if got := c.cmd("MAIL FROM:<a@elsewhere.example>"); got != code {
+			t.Errorf("%s: got reply %d, want %d", policy, got, code)
+		}
+	}
+}
+
+func TestMilterDefaultUnreachable(t *testing.T) {
+	tests := map[string]int{
+		MilterAccept:   220,
+		MilterReject:   554,
+		MilterTempfail: 421,
+	}
+	for policy, code := range tests {
+		c := openSession(t, milterConfig(t, "milterdefault: "+policy), "198.51.100.7", nil)
+		c.expect(code)
+	}
+}
+
+func TestMilterAbort(t *testing.T) {
+	refuse := func(cmd byte) map[byte][]milterChange {
+		return map[byte][]milterChange{cmd: {{smfirReject, nil}}}
+	}
+
+	// A later filter refuses the sender.
+	first, second := newFakeMilter(nil), newFakeMilter(refuse(smficMail))
+	c, _ := milterSession(t, milterConfig(t), first, second)
+	c.send(550, "MAIL FROM:<a@elsewhere.example>")
+	if got := first.commands(smficAbort); got != "MA" {
+		t.Errorf("MAIL: first filter was sent %q, want \"MA\"", got)
+	}
+
+	// A later filter refuses DATA, which ends the transaction.
+	first, second = newFakeMilter(nil), newFakeMilter(refuse(smficData))
+	c, _ = milterSession(t, milterConfig(t), first, second)
+	c.send(250, "MAIL FROM:<a@elsewhere.example>")
+	c.send(250, "RCPT TO:<user@example.com>")
+	c.send(550, "DATA")
+	if got := first.commands(smficAbort); got != "MRTA" {
+		t.Errorf("DATA: first filter was sent %q, want \"MRTA\"", got)
+	}
+	c.send(503, "RCPT TO:<user@example.com>")
+	c.send(250, "MAIL FROM:<a@elsewhere.example>")
+
+	// An earlier filter refuses the message before a later one sees it.
+	first, second = newFakeMilter(refuse(smficEOB)), newFakeMilter(nil)
+	c, _ = milterSession(t, milterConfig(t), first, second)
+	c.send(250, "MAIL FROM:<a@elsewhere.example>")
+	c.send(250, "RCPT TO:<user@example.com>")
+	c.send(354, "DATA")
+	c.send(550, "Subject: hi\r\n\r\nhello\r\n.")
+	if got := second.commands(smficAbort); got != "MRTA" {
+		t.Errorf("message: second filter was sent %q, want \"MRTA\"", got)
+	}
+}
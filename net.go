@@ -2,31 +2,57 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/codeslinger/log"
 	"net"
+	"os"
+	"strings"
 )
 
-type TCPService interface {
-	SetClientOptions(*net.TCPConn) error
-	Handle(*net.TCPConn)
-	Addr() *net.TCPAddr
+// A service accepting connections on a TCP or Unix domain socket.
+type Service interface {
+	SetClientOptions(net.Conn) error
+	Handle(net.Conn)
+	Addr() net.Addr
 	Shutdown()
 }
 
-func RunTCP(t TCPService) {
-	l, err := net.ListenTCP("tcp", t.Addr())
-	if err != nil {
-		log.Error("failed to bind to local address %s", t.Addr())
-		t.Shutdown()
-		return
+// Implemented by services that want the socket file of a Unix domain socket
+// listener to have particular permissions. A zero mode or negative ID leaves
+// the corresponding attribute unchanged.
+type socketPermer interface {
+	SocketPerms() (mode os.FileMode, uid, gid int)
+}
+
+// Implemented by services that limit or keep count of the connections they
+// take. Admit is called before a goroutine is started for a connection, and
+// is left to close any connection it refuses.
+type admitter interface {
+	Admit(net.Conn) bool
+}
+
+// Prefix marking a configured address as a Unix domain socket path.
+const unixAddrPrefix = "unix:"
+
+// Accept connections for the given service until its listener is closed. If
+// no listener is given, one is bound to the service's address.
+func RunService(t Service, l net.Listener) {
+	if l == nil {
+		var err error
+		if l, err = Listen(t); err != nil {
+			return
+		}
 	}
 	defer l.Close()
 
 	log.Info("listening for connections on %s", t.Addr())
 	for {
-		conn, err := l.AcceptTCP()
-		if err != nil {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			log.Info("stopped listening for connections on %s", t.Addr())
+			return
+		} else if err != nil {
 			log.Error("failed to accept connection: %v", err)
 			continue
 		}
@@ -34,9 +60,143 @@ func RunTCP(t TCPService) {
 			conn.Close()
 			continue
 		}
+		if a, ok := t.(admitter); ok && !a.Admit(conn) {
+			continue
+		}
 		log.Trace(func() string {
-			return fmt.Sprintf("%s: client connected to %s", conn.RemoteAddr(), t.Addr())
+			return fmt.Sprintf("%s: client connected to %s", RemoteAddr(conn), t.Addr())
 		})
 		go t.Handle(conn)
 	}
 }
+
+// Bind a listening socket to the given service's address, shutting the
+// service down if that fails.
+func Listen(t Service) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	switch addr := t.Addr().(type) {
+	case *net.TCPAddr:
+		l, err = net.ListenTCP("tcp", addr)
+	case *net.UnixAddr:
+		// A socket file left behind by an unclean exit would make the bind
+		// fail, but only remove it if it really is a socket.
+		if fi, serr := os.Lstat(addr.Name); serr == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr.Name)
+		}
+		var ul *net.UnixListener
+		if ul, err = net.ListenUnix("unix", addr); err == nil {
+			if err = setSocketPerms(t, addr.Name); err != nil {
+				ul.Close()
+			} else {
+				l = ul
+			}
+		}
+	default:
+		err = errors.New("unsupported address type")
+	}
+	if err != nil {
+		log.Error("failed to bind to local address %s: %v", t.Addr(), err)
+		t.Shutdown()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Apply any permissions the service asks for to its socket file.
+func setSocketPerms(t Service, path string) error {
+	sp, ok := t.(socketPermer)
+	if !ok {
+		return nil
+	}
+	mode, uid, gid := sp.SocketPerms()
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if uid >= 0 || gid >= 0 {
+		return os.Chown(path, uid, gid)
+	}
+	return nil
+}
+
+// Parse a configured listening address, which is either a TCP host:port or
+// a Unix domain socket path prefixed with "unix:".
+func ResolveAddr(s string) (net.Addr, error) {
+	if strings.HasPrefix(s, unixAddrPrefix) {
+		path := s[len(unixAddrPrefix):]
+		if path == "" {
+			return nil, errors.New("missing socket path")
+		}
+		return &net.UnixAddr{Name: path, Net: "unix"}, nil
+	}
+	return net.ResolveTCPAddr("tcp", s)
+}
+
+// Return the address of the peer on the given connection. For Unix domain
+// sockets this carries the peer's credentials rather than an address.
+func RemoteAddr(conn net.Conn) net.Addr {
+	if uc, ok := conn.(*net.UnixConn); ok {
+		return NewUnixPeer(uc)
+	}
+	return conn.RemoteAddr()
+}
+
+// Return the IP address of a remote peer, or nil if it has none.
+func RemoteIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return nil
+}
+
+// A list of IP networks, as given in configuration.
+type NetList []*net.IPNet
+
+// Parse a comma- or space-separated list of CIDR networks. Bare addresses
+// are taken to be single-host networks.
+func ParseNetList(s string) (NetList, error) {
+	list := make(NetList, 0)
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("invalid address: %s", f))
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+// Report whether the given address is in any of the networks in the list.
+func (n NetList) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n NetList) String() string {
+	s := make([]string, len(n))
+	for i, network := range n {
+		s[i] = network.String()
+	}
+	return strings.Join(s, ",")
+}
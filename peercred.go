@@ -0,0 +1,40 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// --- Unix domain socket peers ---------------------------------------------
+
+// The peer of a Unix domain socket connection, identified by the
+// credentials of the connecting process.
+type UnixPeer struct {
+	Path  string
+	Pid   int
+	Uid   int
+	Gid   int
+	Known bool
+}
+
+// Create a record of the peer on the given Unix domain socket connection,
+// looking up its credentials where the platform supports it.
+func NewUnixPeer(conn *net.UnixConn) *UnixPeer {
+	p := &UnixPeer{Path: conn.LocalAddr().String(), Pid: -1, Uid: -1, Gid: -1}
+	if pid, uid, gid, err := peerCredentials(conn); err == nil {
+		p.Pid, p.Uid, p.Gid, p.Known = pid, uid, gid, true
+	}
+	return p
+}
+
+func (p *UnixPeer) Network() string {
+	return "unix"
+}
+
+func (p *UnixPeer) String() string {
+	if !p.Known {
+		return fmt.Sprintf("unix:%s", p.Path)
+	}
+	return fmt.Sprintf("unix:%s(pid=%d,uid=%d,gid=%d)", p.Path, p.Pid, p.Uid, p.Gid)
+}
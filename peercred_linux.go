@@ -0,0 +1,28 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// Look up the process ID, user ID and group ID of the process on the other
+// end of a Unix domain socket using SO_PEERCRED.
+func peerCredentials(conn *net.UnixConn) (pid, uid, gid int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var cred *syscall.Ucred
+	var cerr error
+	err = raw.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	return int(cred.Pid), int(cred.Uid), int(cred.Gid), nil
+}
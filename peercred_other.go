@@ -0,0 +1,14 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Peer credentials are only looked up on Linux.
+func peerCredentials(conn *net.UnixConn) (pid, uid, gid int, err error) {
+	return -1, -1, -1, errors.New("peer credentials not supported on this platform")
+}
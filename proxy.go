@@ -0,0 +1,152 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- HAProxy PROXY protocol -----------------------------------------------
+
+// A connection whose client address was given in a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+const (
+	proxyV1MaxLength = 107
+	proxyV2HeaderLen = 16
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	MalformedProxyHeader = errors.New("malformed PROXY protocol header")
+)
+
+// Read a PROXY protocol header of either version from the given connection
+// and return a connection that reports the client address from the header.
+// Connections the proxy opened on its own behalf (v1 UNKNOWN, v2 LOCAL)
+// keep the proxy's own address.
+func ReadProxyHeader(conn net.Conn, timeout time.Time) (net.Conn, error) {
+	if err := conn.SetReadDeadline(timeout); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(conn, MaxLineLength)
+	sig, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr
+	if bytes.Equal(sig, proxyV1Prefix) {
+		remote, err = readProxyV1(r)
+	} else if !bytes.Equal(sig, proxyV2Signature[:len(sig)]) {
+		err = MalformedProxyHeader
+	} else if sig, err = r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+		remote, err = readProxyV2(r)
+	} else if err == nil {
+		err = MalformedProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Parse a v1 (text) header, e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 5678 25".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, MalformedProxyHeader
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, MalformedProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, MalformedProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, MalformedProxyHeader
+	}
+	if (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, MalformedProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// Parse a v2 (binary) header. Any TLVs following the addresses are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	verCmd, family := hdr[12], hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, MalformedProxyHeader
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch verCmd & 0xf {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, MalformedProxyHeader
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, MalformedProxyHeader
+		}
+		ip := net.IP(append([]byte(nil), body[0:4]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, MalformedProxyHeader
+		}
+		ip := net.IP(append([]byte(nil), body[0:16]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// Unspecified or unsupported families carry no usable client address.
+	return nil, nil
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The address of the proxy in these tests.
+var testProxyAddr = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000}
+
+// Read a PROXY header from a connection on which the proxy sends the given
+// bytes and then closes it. The rest of what it sent is returned too.
+func readProxy(t *testing.T, data []byte) (net.Addr, string, error) {
+	server, client := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	defer server.Close()
+	conn, err := ReadProxyHeader(&addrConn{server, testProxyAddr}, time.Now().Add(time.Second))
+	if err != nil {
+		return nil, "", err
+	}
+	rest, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.RemoteAddr(), string(rest), nil
+}
+
+// Return a v2 header with the given command and address family, followed by
+// the given address block.
+func proxyV2(cmd, family byte, body []byte) []byte {
+	hdr := append([]byte(nil), proxyV2Signature...)
+	hdr = append(hdr, 0x20|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(body)))
+	return append(hdr, body...)
+}
+
+func TestProxyV1(t *testing.T) {
+	tests := []struct {
+		header string
+		remote string
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 5678 25\r\n", "192.0.2.1:5678"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 5678 25\r\n", "[2001:db8::1]:5678"},
+		{"PROXY UNKNOWN\r\n", testProxyAddr.String()},
+		{"PROXY UNKNOWN 192.0.2.1 192.0.2.2 5678 25\r\n", testProxyAddr.String()},
+	}
+	for _, test := range tests {
+		remote, rest, err := readProxy(t, []byte(test.header+"EHLO client.example\r\n"))
+		if err != nil {
+			t.Errorf("%q: %v", test.header, err)
+			continue
+		}
+		if remote.String() != test.remote {
+			t.Errorf("%q: got client %s, want %s", test.header, remote, test.remote)
+		}
+		if rest != "EHLO client.example\r\n" {
+			t.Errorf("%q: got %q after the header", test.header, rest)
+		}
+	}
+}
+
+func TestProxyV1Malformed(t *testing.T) {
+	for _, header := range []string{
+		"PROXY TCP4 192.0.2.1 192.0.2.2 5678 25\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 5678\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.2 5678 25\r\n",
+		"PROXY TCP6 192.0.2.1 192.0.2.2 5678 25\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 70000 25\r\n",
+		"PROXY TCP4 client 192.0.2.2 5678 25\r\n",
+		"PROXY UDP4 192.0.2.1 192.0.2.2 5678 25\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 5678 25" + strings.Repeat(" ", proxyV1MaxLength) + "\r\n",
+		"PROXY TCP4 192.0.2.1",
+		"EHLO client.example\r\n",
+		"PROX",
+	} {
+		if remote, _, err := readProxy(t, []byte(header)); err == nil {
+			t.Errorf("%q: got client %s", header, remote)
+		}
+	}
+}
+
+func TestProxyV2(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0x16, 0x2e, 0, 25}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	copy(v6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(v6[32:], 5678)
+	binary.BigEndian.PutUint16(v6[34:], 25)
+	tlvs := []byte{0x01, 0, 2, 'h', '2', 0x04, 0, 0}
+	tests := []struct {
+		name   string
+		header []byte
+		remote string
+	}{
+		{"TCP4", proxyV2(1, 0x11, v4), "192.0.2.1:5678"},
+		{"TCP6", proxyV2(1, 0x21, v6), "[2001:db8::1]:5678"},
+		{"TCP4 with TLVs", proxyV2(1, 0x11, append(append([]byte(nil), v4...), tlvs...)), "192.0.2.1:5678"},
+		{"LOCAL", proxyV2(0, 0x11, v4), testProxyAddr.String()},
+		{"LOCAL without addresses", proxyV2(0, 0, nil), testProxyAddr.String()},
+		{"unspecified family", proxyV2(1, 0, tlvs), testProxyAddr.String()},
+		{"Unix socket", proxyV2(1, 0x31, make([]byte, 216)), testProxyAddr.String()},
+	}
+	for _, test := range tests {
+		remote, rest, err := readProxy(t, append(test.header, "EHLO client.example\r\n"...))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if remote.String() != test.remote {
+			t.Errorf("%s: got client %s, want %s", test.name, remote, test.remote)
+		}
+		if rest != "EHLO client.example\r\n" {
+			t.Errorf("%s: got %q after the header", test.name, rest)
+		}
+	}
+}
+
+func TestProxyV2Malformed(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0x16, 0x2e, 0, 25}
+	badVersion := proxyV2(1, 0x11, v4)
+	badVersion[12] = 0x11
+	truncated := proxyV2(1, 0x11, v4)
+	binary.BigEndian.PutUint16(truncated[14:], 0xffff)
+	tests := map[string][]byte{
+		"version 1":           badVersion,
+		"unknown command":     proxyV2(2, 0x11, v4),
+		"short IPv4 block":    proxyV2(1, 0x11, v4[:8]),
+		"short IPv6 block":    proxyV2(1, 0x21, make([]byte, 20)),
+		"truncated body":      truncated,
+		"truncated header":    proxyV2(1, 0x11, nil)[:14],
+		"truncated signature": proxyV2Signature[:8],
+		"bad signature":       append([]byte("\r\n\r\n\x00\r\nQUIX\n"), v4...),
+	}
+	for name, header := range tests {
+		if remote, _, err := readProxy(t, header); err == nil {
+			t.Errorf("%s: got client %s", name, remote)
+		}
+	}
+}
+
+// Only trusted proxies may say who the client is: a header from anyone else
+// is treated as an SMTP command, and the client keeps its own address.
+func TestProxyUntrusted(t *testing.T) {
+	c := testConfig(t,
+		"domain: mx.example.com",
+		"localdomains: example.com",
+		"trustedhosts: 192.0.2.0/24",
+		"listener: proxied",
+		"address: 127.0.0.1:25",
+		"proxyprotocol: yes",
+		"proxytrusted: 10.0.0.0/8",
+		"end")
+	svc := NewSMTPService(c, c.Listeners()[0], NewServerState(c), make(chan int, 1))
+	tests := []struct {
+		remote  string
+		trusted bool
+		relay   int
+	}{
+		{"10.0.0.1", true, 250},
+		{"198.51.100.7", false, 554},
+	}
+	for _, test := range tests {
+		server, client := net.Pipe()
+		if !svc.Admit(server) {
+			t.Fatal("connection not admitted")
+		}
+		addr := &net.TCPAddr{IP: net.ParseIP(test.remote), Port: 50000}
+		go svc.Handle(&addrConn{server, addr})
+		tc := &testClient{Conn: textproto.NewConn(client), t: t, conn: client}
+		header := "PROXY TCP4 192.0.2.1 192.0.2.2 5678 25"
+		if test.trusted {
+			go client.Write([]byte(header + "\r\n"))
+			tc.expect(220)
+		} else {
+			tc.expect(220)
+			tc.send(500, "%s", header)
+		}
+		tc.send(250, "EHLO client.example")
+		tc.send(250, "MAIL FROM:<a@elsewhere.example>")
+		if got := tc.cmd("RCPT TO:<user@elsewhere.example>"); got != test.relay {
+			t.Errorf("from %s: got reply %d to relay attempt, want %d", test.remote, got, test.relay)
+		}
+		tc.Close()
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"fmt"
+	"github.com/rcrowley/go-metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --- Rate limits ----------------------------------------------------------
+
+// Kinds of event that are rate limited.
+const (
+	RateConnections = "conn"
+	RateMessages    = "msg"
+	RateRecipients  = "rcpt"
+)
+
+const rateLimitPruneSecs = 60
+
+// A token bucket holding up to capacity tokens, refilled at capacity tokens
+// per period.
+type tokenBucket struct {
+	tokens   float64
+	capacity float64
+	period   time.Duration
+	last     time.Time
+}
+
+// Token-bucket rate limits on events, keyed by the client IP address or
+// authenticated user responsible for them.
+type RateLimiter struct {
+	lock     sync.Mutex
+	buckets  map[string]*tokenBucket
+	rejected metrics.Counter
+}
+
+// Create a new rate limiter, exporting its rejection count to the given
+// registry.
+func NewRateLimiter(r metrics.Registry) *RateLimiter {
+	l := &RateLimiter{
+		buckets:  make(map[string]*tokenBucket),
+		rejected: metrics.NewCounter(),
+	}
+	r.Register("smtp.ratelimit.rejected", l.rejected)
+	go l.pruneLoop()
+	return l
+}
+
+// Take n tokens from the bucket for the given kind of event and client,
+// which allows limit events per period. Returns false, taking nothing, if
+// there are not enough tokens left. A limit of zero means no limit.
+func (l *RateLimiter) Allow(kind, who string, n, limit int, period time.Duration) bool {
+	if limit <= 0 || who == "" {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	key := kind + ":" + who
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit), last: now}
+		l.buckets[key] = b
+	}
+	// Pick up any change to the limit from a configuration reload.
+	b.capacity, b.period = float64(limit), period
+	b.refill(now)
+	if b.tokens < float64(n) {
+		l.rejected.Inc(1)
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Describe the state of every bucket that is not full, one per line.
+func (l *RateLimiter) State() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	lines := make([]string, 0, len(l.buckets))
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens < b.capacity {
+			lines = append(lines, fmt.Sprintf("%s %.1f/%.0f per %s", key, b.tokens, b.capacity, b.period))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// Throw away buckets that have refilled completely, since they are no
+// different from new ones.
+func (l *RateLimiter) pruneLoop() {
+	for {
+		time.Sleep(time.Second * rateLimitPruneSecs)
+		l.lock.Lock()
+		now := time.Now()
+		for key, b := range l.buckets {
+			if b.refill(now); b.tokens >= b.capacity {
+				delete(l.buckets, key)
+			}
+		}
+		l.lock.Unlock()
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last)
+	b.last = now
+	b.tokens += b.capacity * float64(elapsed) / float64(b.period)
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"bufio"
+	"github.com/rcrowley/go-metrics"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := &tokenBucket{tokens: 0, capacity: 10, period: time.Minute, last: start}
+	b.refill(start.Add(30 * time.Second))
+	if b.tokens != 5 {
+		t.Errorf("after half a period: got %.1f tokens, want 5", b.tokens)
+	}
+	b.refill(start.Add(time.Hour))
+	if b.tokens != 10 {
+		t.Errorf("after an hour: got %.1f tokens, want 10", b.tokens)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := NewRateLimiter(metrics.NewRegistry())
+	for i := 0; i < 3; i++ {
+		if !l.Allow(RateMessages, "192.0.2.1", 1, 3, time.Hour) {
+			t.Fatalf("event %d refused", i+1)
+		}
+	}
+	if l.Allow(RateMessages, "192.0.2.1", 1, 3, time.Hour) {
+		t.Error("event over the limit allowed")
+	}
+	if !l.Allow(RateMessages, "192.0.2.2", 1, 3, time.Hour) || !l.Allow(RateRecipients, "192.0.2.1", 1, 3, time.Hour) {
+		t.Error("limit shared between clients or kinds of event")
+	}
+	if !l.Allow(RateMessages, "192.0.2.1", 1, 0, time.Hour) || !l.Allow(RateMessages, "", 1, 3, time.Hour) {
+		t.Error("event without a limit or a client refused")
+	}
+
+	// A third of an hour gives back one of three tokens per hour.
+	l.buckets["msg:192.0.2.1"].last = time.Now().Add(-20*time.Minute - time.Second)
+	if l.Allow(RateMessages, "192.0.2.1", 2, 3, time.Hour) {
+		t.Error("two events allowed with one token")
+	}
+	if !l.Allow(RateMessages, "192.0.2.1", 1, 3, time.Hour) {
+		t.Error("refused after refilling, or tokens taken by a refused request")
+	}
+}
+
+func TestRateLimiterState(t *testing.T) {
+	l := NewRateLimiter(metrics.NewRegistry())
+	l.Allow(RateRecipients, "user=alice", 2, 3, time.Hour)
+	l.Allow(RateMessages, "192.0.2.1", 1, 5, time.Hour)
+	l.Allow(RateConnections, "192.0.2.1", 0, 5, time.Minute)
+	want := []string{"msg:192.0.2.1 4.0/5 per 1h0m0s", "rcpt:user=alice 1.0/3 per 1h0m0s"}
+	if got := l.State(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestAdminRateLimits(t *testing.T) {
+	c := testConfig(t, "domain: mx.example.com")
+	s := NewServer("", c)
+	s.State().Rates.Allow(RateMessages, "192.0.2.1", 1, 5, time.Hour)
+	a := NewAdminService(nil, s)
+	server, client := net.Pipe()
+	defer client.Close()
+	go a.Handle(server)
+	if _, err := client.Write([]byte("ratelimits\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(client)
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); line == "OK" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	if want := []string{"msg:192.0.2.1 4.0/5 per 1h0m0s"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+}
+
+func TestConnectionRate(t *testing.T) {
+	c := testConfig(t, "domain: mx.example.com", "connrate: 1")
+	svc := NewSMTPService(c, c.Listeners()[0], NewServerState(c), make(chan int, 1))
+	addr := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40000}
+	for _, code := range []int{220, 421} {
+		server, client := net.Pipe()
+		if !svc.Admit(server) {
+			t.Fatal("connection not admitted")
+		}
+		go svc.Handle(&addrConn{server, addr})
+		_, msg, err := textproto.NewConn(client).ReadResponse(code)
+		if err != nil {
+			t.Errorf("%d: got %v", code, err)
+		} else if code == 421 && !strings.HasPrefix(msg, "4.7.0 ") {
+			t.Errorf("got reply %q without an enhanced status code", msg)
+		}
+		client.Close()
+	}
+}
+
+func TestMessageRate(t *testing.T) {
+	cfg := testConfig(t, "domain: mx.example.com", "localdomains: example.com", "msgrate: 1")
+	state := NewServerState(cfg)
+	c := startSession(t, cfg, "198.51.100.7", func(s *SMTPSession) { s.shared = state })
+	c.send(250, "EHLO client.example")
+	c.send(250, "MAIL FROM:<a@elsewhere.example>")
+	c.send(250, "RSET")
+	c.send(451, "MAIL FROM:<a@elsewhere.example>")
+
+	// Another client has its own limit.
+	c = startSession(t, cfg, "198.51.100.8", func(s *SMTPSession) { s.shared = state })
+	c.send(250, "EHLO client.example")
+	c.send(250, "MAIL FROM:<a@elsewhere.example>")
+}
+
+func TestRecipientRate(t *testing.T) {
+	cfg := testConfig(t, "domain: mx.example.com", "localdomains: example.com", "rcptrate: 2")
+	c := startSession(t, cfg, "198.51.100.7", nil)
+	c.send(250, "EHLO client.example")
+	c.send(250, "MAIL FROM:<a@elsewhere.example>")
+	c.send(250, "RCPT TO:<one@example.com>")
+	c.send(250, "RCPT TO:<two@example.com>")
+	if _, err := c.Cmd("RCPT TO:<three@example.com>"); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := c.ReadResponse(451); err != nil || !strings.HasPrefix(msg, "4.7.1 ") {
+		t.Errorf("got %q (%v), want 451 4.7.1", msg, err)
+	}
+}
+
+// The messages of an authenticated user are limited however many addresses
+// they connect from.
+func TestRateLimitPerUser(t *testing.T) {
+	cfg := testConfig(t,
+		"domain: mx.example.com",
+		"localdomains: example.com",
+		"xclienthosts: 10.0.0.0/8",
+		"msgrate: 1")
+	state := NewServerState(cfg)
+	for i, code := range []int{250, 451} {
+		c := startSession(t, cfg, "10.1.2.3", func(s *SMTPSession) { s.shared = state })
+		c.send(250, "EHLO proxy.example")
+		c.send(220, "XCLIENT ADDR=198.51.100.%d LOGIN=alice", i+1)
+		c.send(250, "EHLO client.example")
+		c.send(code, "MAIL FROM:<alice@example.com>")
+	}
+	if _, ok := state.Rates.buckets["msg:user=alice"]; !ok {
+		t.Error("messages not limited by user")
+	}
+}
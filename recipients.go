@@ -0,0 +1,289 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"github.com/codeslinger/log"
+	"strings"
+)
+
+// --- Recipients -----------------------------------------------------------
+
+// Settings for routing mail by the domain of its recipients. Mail for Local
+// domains is delivered here, after aliases are expanded; mail for Relay
+// domains is accepted and passed on as it is. Mail for any other domain is
+// only accepted from clients allowed to relay. Any of the characters in
+// Delimiter separate a local part from a sub-address, as in "user+tag",
+// which is dropped before delivery.
+type RoutingPolicy struct {
+	Local     map[string]*LocalDomain
+	Relay     map[string]bool
+	Delimiter string
+}
+
+// A domain whose mail is delivered here. Aliases maps local parts to the
+// comma-separated addresses their mail goes to, which may be local parts in
+// the same domain or addresses anywhere. Mail for local parts that are
+// neither aliases nor known recipients goes to CatchAll, if it is set.
+type LocalDomain struct {
+	Name     string
+	Aliases  LookupTable
+	CatchAll string
+}
+
+// Return the local domain an address belongs to, or nil if it is not in one.
+func (p *RoutingPolicy) Domain(addr string) *LocalDomain {
+	_, domain := splitAddress(addr)
+	return p.Local[domain]
+}
+
+// Report whether mail for an address is relayed to another host.
+func (p *RoutingPolicy) IsRelay(addr string) bool {
+	_, domain := splitAddress(addr)
+	return p.Relay[domain]
+}
+
+// Return the addresses mail for a recipient in a local domain is delivered
+// to, expanding aliases and checking local parts against the table of known
+// recipients, if there is one. No addresses are returned if the recipient
+// does not exist.
+func (p *RoutingPolicy) Resolve(rcpt string, recipients LookupTable) ([]string, error) {
+	addrs := make([]string, 0, 1)
+	_, err := p.resolve(rcpt, recipients, make(map[string]bool), &addrs)
+	return addrs, err
+}
+
+// Add the addresses mail for addr is delivered to, reporting whether addr
+// exists. Addresses already seen are skipped, so alias loops end.
+func (p *RoutingPolicy) resolve(addr string, recipients LookupTable, seen map[string]bool, addrs *[]string) (bool, error) {
+	local, domain := splitAddress(addr)
+	d := p.Local[domain]
+	if d == nil {
+		*addrs = appendAddress(*addrs, addr)
+		return true, nil
+	}
+	addr = local + "@" + domain
+	if seen[addr] {
+		return true, nil
+	}
+	seen[addr] = true
+	targets, err := d.alias(local, p.Delimiter)
+	if err != nil {
+		return false, err
+	}
+	if targets != nil {
+		for _, t := range targets {
+			if !strings.Contains(t, "@") {
+				t += "@" + domain
+			}
+			if strings.EqualFold(t, addr) {
+				*addrs = appendAddress(*addrs, addr)
+				continue
+			}
+			found, err := p.resolve(t, recipients, seen, addrs)
+			if err != nil {
+				return false, err
+			}
+			if !found {
+				log.Warn("alias %s points to unknown address %s", addr, t)
+			}
+		}
+		return true, nil
+	}
+	addr = foldAddress(local, p.Delimiter) + "@" + domain
+	found := local == "postmaster" || recipients == nil
+	if !found {
+		if _, found, err = recipients.Lookup(addr); err != nil {
+			return false, err
+		}
+	}
+	switch {
+	case found:
+		*addrs = appendAddress(*addrs, addr)
+	case d.CatchAll != "":
+		return p.resolve(d.CatchAll, recipients, seen, addrs)
+	}
+	return found, nil
+}
+
+// Report whether an address in a local domain is an alias.
+func (p *RoutingPolicy) IsAlias(addr string) (bool, error) {
+	d := p.Domain(addr)
+	if d == nil {
+		return false, nil
+	}
+	local, _ := splitAddress(addr)
+	targets, err := d.alias(local, p.Delimiter)
+	return targets != nil, err
+}
+
+// Return the addresses a local part is an alias for, or nil if it is not an
+// alias. Local parts with a sub-address are looked up whole first.
+func (d *LocalDomain) alias(local, delimiter string) ([]string, error) {
+	if d.Aliases == nil {
+		return nil, nil
+	}
+	v, ok, err := d.Aliases.Lookup(local)
+	if !ok && err == nil && foldAddress(local, delimiter) != local {
+		v, ok, err = d.Aliases.Lookup(foldAddress(local, delimiter))
+	}
+	if !ok || err != nil {
+		return nil, err
+	}
+	return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }), nil
+}
+
+// Split an address into its local part and lower-cased domain. Local parts
+// are lower-cased too, which RFC 5321 allows but does not require.
+func splitAddress(addr string) (string, string) {
+	addr = strings.ToLower(addr)
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr, ""
+	}
+	return addr[:at], addr[at+1:]
+}
+
+// Drop the sub-address from a local part.
+func foldAddress(local, delimiter string) string {
+	if delimiter == "" {
+		return local
+	}
+	if i := strings.IndexAny(local, delimiter); i > 0 {
+		return local[:i]
+	}
+	return local
+}
+
+func appendAddress(addrs []string, addr string) []string {
+	for _, a := range addrs {
+		if a == addr {
+			return addrs
+		}
+	}
+	return append(addrs, addr)
+}
+
+// Report whether an address in one of our domains asks for the mail to be
+// sent on elsewhere, as in "user%elsewhere@local" or "elsewhere!user@local".
+func relayHack(addr string) bool {
+	local, _ := splitAddress(addr)
+	return strings.ContainsAny(local, "%!@")
+}
+
+// Return the address a source route like "@a,@b:user@c" ends at. Source
+// routes are ignored, as RFC 5321 section 3.6.1 allows.
+func stripSourceRoute(addr string) string {
+	if strings.HasPrefix(addr, "@") {
+		if i := strings.IndexByte(addr, ':'); i >= 0 {
+			return addr[i+1:]
+		}
+	}
+	return addr
+}
+
+// Return the addresses mail for a recipient is to be delivered to. If the
+// recipient must be refused, the reply code and text are returned instead.
+func (s *SMTPSession) routeRecipient(rcpt string) ([]string, int, string) {
+	p := s.cfg.Routing()
+	if strings.EqualFold(rcpt, "postmaster") {
+		return []string{rcpt}, 0, ""
+	}
+	rcpt = stripSourceRoute(rcpt)
+	local, relay := p.Domain(rcpt) != nil, p.IsRelay(rcpt)
+	if (!local && !relay || (local || relay) && relayHack(rcpt)) && !s.trusted() {
+		log.Warn("%s: relay denied from=<%s> to=<%s>", s.remote, s.message.From, rcpt)
+		s.shared.RelayDenied.Inc(1)
+		return nil, 554, "5.7.1 Relay access denied"
+	}
+	if !local {
+		return []string{rcpt}, 0, ""
+	}
+	addrs, err := p.Resolve(rcpt, s.cfg.Recipients())
+	if err != nil {
+		log.Error("%s: failed to resolve <%s>: %v", s.remote, rcpt, err)
+		return nil, 451, "4.3.0 Temporary lookup failure"
+	}
+	if len(addrs) == 0 {
+		log.Info("%s: unknown recipient <%s>", s.remote, rcpt)
+		return nil, 550, "5.1.1 User unknown"
+	}
+	if len(addrs) != 1 || addrs[0] != rcpt {
+		log.Info("%s: <%s> routed to <%s>", s.remote, rcpt, strings.Join(addrs, ">, <"))
+	}
+	return addrs, 0, ""
+}
+
+// Report whether the client may relay mail to any domain: it has
+// authenticated, is connected over a Unix socket, or is on a trusted network.
+func (s *SMTPSession) trusted() bool {
+	_, unix := s.remote.(*UnixPeer)
+	return s.authenticated || unix || s.cfg.TrustedHosts().Contains(RemoteIP(s.remote))
+}
+
+// Add a recipient to the current message, unless it is already there.
+func (s *SMTPSession) addRecipient(addr string) {
+	for e := s.message.To.Front(); e != nil; e = e.Next() {
+		if e.Value.(string) == addr {
+			return
+		}
+	}
+	s.message.To.PushBack(addr)
+}
+
+// Report whether the client may use a command open to the given clients.
+func (s *SMTPSession) permits(a CommandAccess) bool {
+	return a == AccessAll || a == AccessTrusted && s.trusted()
+}
+
+// Return the address given to VRFY or EXPN, which may be in angle brackets
+// or, as a bare local part, stand for an address in the serving domain.
+func (s *SMTPSession) commandAddress(data []byte) (string, error) {
+	arg := strings.TrimSpace(string(data[4:]))
+	if arg == "" {
+		return "", AddressNotFound
+	}
+	if strings.Contains(arg, "<") {
+		return s.extractAddress([]byte(arg))
+	}
+	if !strings.Contains(arg, "@") {
+		arg += "@" + s.cfg.ServingDomain()
+	}
+	return arg, nil
+}
+
+// Check an address given to VRFY, returning the reply code and text.
+// Addresses outside the local domains cannot be checked.
+func (s *SMTPSession) verifyAddress(addr string) (int, string) {
+	p := s.cfg.Routing()
+	if p.Domain(addr) == nil {
+		return 252, "2.1.5 Cannot VRFY user, but will accept message and attempt delivery"
+	}
+	addrs, err := p.Resolve(addr, s.cfg.Recipients())
+	if err != nil {
+		log.Error("%s: failed to resolve <%s>: %v", s.remote, addr, err)
+		return 451, "4.3.0 Temporary lookup failure"
+	}
+	if len(addrs) == 0 {
+		return 550, "5.1.1 User unknown"
+	}
+	return 250, "2.1.5 <" + addr + ">"
+}
+
+// Return the addresses an alias given to EXPN expands to. If it cannot be
+// expanded, the reply code and text are returned instead.
+func (s *SMTPSession) expandAlias(addr string) ([]string, int, string) {
+	p := s.cfg.Routing()
+	alias, err := p.IsAlias(addr)
+	var addrs []string
+	if err == nil && alias {
+		addrs, err = p.Resolve(addr, s.cfg.Recipients())
+	}
+	if err != nil {
+		log.Error("%s: failed to expand <%s>: %v", s.remote, addr, err)
+		return nil, 451, "4.3.0 Temporary lookup failure"
+	}
+	if len(addrs) == 0 {
+		return nil, 550, "5.1.1 Not a mailing list"
+	}
+	return addrs, 0, ""
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"testing"
+)
+
+// --- Relay control --------------------------------------------------------
+
+// Recipients that must never be accepted from a client not allowed to
+// relay.
+var relayAttempts = []string{
+	"<user%evil.example@example.com>",
+	"<evil.example!user@example.com>",
+	"<\"a@evil.example\"@example.com>",
+	"<@example.com:user@evil.example>",
+	"<user@evil.example>",
+	"<user@example.com.>",
+	"<user@[1.2.3.4]>",
+	"<victim%evil.example@partner.example>",
+	"<evil.example!victim@partner.example>",
+}
+
+const untrustedClient = "198.51.100.7"
+
+func relayConfig(t *testing.T) *config {
+	c := testConfig(t,
+		"domain: mx.example.com",
+		"localdomains: example.com",
+		"relaydomains: partner.example",
+		"trustedhosts: 192.0.2.0/24",
+		"xclienthosts: 10.0.0.0/8",
+		"xforwardhosts: 10.0.0.0/8")
+	c.tlsConfig = testTLSConfig(t)
+	return c
+}
+
+// Offer each relay attempt as the recipient of a new message, checking that
+// it gets the given reply.
+func tryRelay(c *testClient, code int) {
+	for _, rcpt := range relayAttempts {
+		c.send(250, "MAIL FROM:<sender@elsewhere.example>")
+		if got := c.cmd("RCPT TO:%s", rcpt); got != code {
+			c.t.Errorf("RCPT TO:%s: got reply %d, want %d", rcpt, got, code)
+		}
+		c.send(250, "RSET")
+	}
+}
+
+func TestRelayDenied(t *testing.T) {
+	c := startSession(t, relayConfig(t), untrustedClient, nil)
+	c.send(250, "EHLO client.example")
+	tryRelay(c, 554)
+	c.send(250, "MAIL FROM:<sender@elsewhere.example>")
+	c.send(250, "RCPT TO:<user@example.com>")
+	c.send(250, "RCPT TO:<user@partner.example>")
+	c.send(250, "RCPT TO:<postmaster>")
+}
+
+func TestRelayDeniedAfterRset(t *testing.T) {
+	c := startSession(t, relayConfig(t), untrustedClient, nil)
+	c.send(250, "EHLO client.example")
+	c.send(250, "MAIL FROM:<sender@elsewhere.example>")
+	c.send(250, "RCPT TO:<user@example.com>")
+	c.send(250, "RSET")
+	tryRelay(c, 554)
+}
+
+func TestRelayDeniedAfterStarttls(t *testing.T) {
+	c := startSession(t, relayConfig(t), untrustedClient, nil)
+	c.send(250, "EHLO client.example")
+	c.starttls()
+	c.send(250, "EHLO client.example")
+	tryRelay(c, 554)
+}
+
+func TestRelayDeniedAfterXclient(t *testing.T) {
+	c := startSession(t, relayConfig(t), untrustedClient, nil)
+	c.send(250, "EHLO client.example")
+	c.send(550, "XCLIENT ADDR=192.0.2.1 LOGIN=admin")
+	tryRelay(c, 554)
+}
+
+func TestRelayDeniedAfterXforward(t *testing.T) {
+	c := startSession(t, relayConfig(t), untrustedClient, nil)
+	c.send(250, "EHLO client.example")
+	c.send(550, "XFORWARD ADDR=192.0.2.1")
+	tryRelay(c, 554)
+}
+
+func TestRelayAllowedAuthenticated(t *testing.T) {
+	c := startSession(t, relayConfig(t), "10.1.2.3", nil)
+	c.send(250, "EHLO proxy.example")
+	c.send(220, "XCLIENT ADDR=198.51.100.7 LOGIN=alice")
+	c.send(250, "EHLO client.example")
+	tryRelay(c, 250)
+}
+
+func TestRelayAllowedUnixSocket(t *testing.T) {
+	c := startSession(t, relayConfig(t), "", func(s *SMTPSession) {
+		s.remote = &UnixPeer{Path: "/var/run/go25.sock", Pid: -1, Uid: -1, Gid: -1}
+	})
+	c.send(250, "EHLO localhost")
+	tryRelay(c, 250)
+}
+
+func TestRelayAllowedTrustedHosts(t *testing.T) {
+	c := startSession(t, relayConfig(t), "192.0.2.1", nil)
+	c.send(250, "EHLO client.example")
+	tryRelay(c, 250)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// --- DNS resolution -------------------------------------------------------
+
+// Looks up DNS records for the checks made on clients and messages. All
+// DNS queries go through this interface so that they can be pointed at a
+// particular server, or replaced entirely.
+type Resolver interface {
+	LookupIP(host string) ([]net.IP, error)
+	LookupTXT(name string) ([]string, error)
+	LookupMX(name string) ([]*net.MX, error)
+	LookupAddr(ip net.IP) ([]string, error)
+}
+
+// A Resolver using the Go DNS client, either with the system's configured
+// name servers or with a single given server.
+type dnsResolver struct {
+	r       *net.Resolver
+	timeout time.Duration
+}
+
+const defaultDNSTimeoutSecs = 10
+
+// Create a resolver that sends its queries to the given server address
+// ("host:port"), or to the system's name servers if the address is empty.
+func NewResolver(server string, timeout time.Duration) Resolver {
+	r := &net.Resolver{PreferGo: true}
+	if server != "" {
+		r.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		}
+	}
+	return &dnsResolver{r: r, timeout: timeout}
+}
+
+func (d *dnsResolver) LookupIP(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	addrs, err := d.r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+func (d *dnsResolver) LookupTXT(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	return d.r.LookupTXT(ctx, name)
+}
+
+func (d *dnsResolver) LookupMX(name string) ([]*net.MX, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	return d.r.LookupMX(ctx, name)
+}
+
+func (d *dnsResolver) LookupAddr(ip net.IP) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	return d.r.LookupAddr(ctx, ip.String())
+}
+
+// Report whether a lookup failed because the name or record does not
+// exist, as opposed to a temporary failure.
+func IsNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
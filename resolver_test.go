@@ -0,0 +1,55 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// A Resolver answering from fixed records. Names in fail time out; any other
+// name without records does not exist.
+type fakeResolver struct {
+	txt  map[string][]string
+	ip   map[string][]net.IP
+	mx   map[string][]*net.MX
+	ptr  map[string][]string
+	fail map[string]bool
+}
+
+func (r *fakeResolver) err(name string) error {
+	if r.fail[name] {
+		return &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips, ok := r.ip[host]; ok {
+		return ips, nil
+	}
+	return nil, r.err(host)
+}
+
+func (r *fakeResolver) LookupTXT(name string) ([]string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if txts, ok := r.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, r.err(name)
+}
+
+func (r *fakeResolver) LookupMX(name string) ([]*net.MX, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if mxs, ok := r.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, r.err(name)
+}
+
+func (r *fakeResolver) LookupAddr(ip net.IP) ([]string, error) {
+	if names, ok := r.ptr[ip.String()]; ok {
+		return names, nil
+	}
+	return nil, r.err(ip.String())
+}
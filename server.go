@@ -0,0 +1,226 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"fmt"
+	"github.com/codeslinger/log"
+	"github.com/rcrowley/go-metrics"
+	"net"
+	"strings"
+	"sync"
+)
+
+// --- Server ---------------------------------------------------------------
+
+// The running server process: its configuration and the services started
+// from it.
+type Server struct {
+	path      string
+	cfg       Config
+	cfgLock   sync.Mutex
+	smtp      []*SMTPService
+	admin     *AdminService
+	state     *ServerState
+	listeners []net.Listener
+	upgrading bool
+	handedOff bool
+	exitChan  chan int
+}
+
+// State shared by the sessions on all listeners, which lives as long as the
+// server does rather than being replaced when the configuration is reloaded.
+type ServerState struct {
+	Conns         *ConnLimiter
+	Rates         *RateLimiter
+	Greylist      *Greylist
+	DMARCReports  *DMARCReporter
+	EarlyTalkers  metrics.Counter
+	DNSBLRejected metrics.Counter
+	SpamRejected  metrics.Counter
+	VirusRejected metrics.Counter
+	RelayDenied   metrics.Counter
+}
+
+// Create the shared state for a server started with the given configuration.
+func NewServerState(c Config) *ServerState {
+	st := &ServerState{
+		Conns:         NewConnLimiter(c.Metrics()),
+		Rates:         NewRateLimiter(c.Metrics()),
+		Greylist:      NewGreylist(c.GreylistDB(), c.Metrics()),
+		DMARCReports:  NewDMARCReporter(c.DMARCReports()),
+		EarlyTalkers:  metrics.NewCounter(),
+		DNSBLRejected: metrics.NewCounter(),
+		SpamRejected:  metrics.NewCounter(),
+		VirusRejected: metrics.NewCounter(),
+		RelayDenied:   metrics.NewCounter(),
+	}
+	c.Metrics().Register("smtp.earlytalkers", st.EarlyTalkers)
+	c.Metrics().Register("smtp.dnsbl.rejected", st.DNSBLRejected)
+	c.Metrics().Register("smtp.spam.rejected", st.SpamRejected)
+	c.Metrics().Register("smtp.virus.rejected", st.VirusRejected)
+	c.Metrics().Register("smtp.relay.denied", st.RelayDenied)
+	return st
+}
+
+// Create a new server from the configuration loaded from the given path.
+func NewServer(path string, c Config) *Server {
+	s := &Server{
+		path:     path,
+		cfg:      c,
+		state:    NewServerState(c),
+		exitChan: make(chan int, 1),
+	}
+	for _, p := range c.Listeners() {
+		s.smtp = append(s.smtp, NewSMTPService(c, p, s.state, s.exitChan))
+	}
+	if c.AdminLocal() != nil {
+		s.admin = NewAdminService(c.AdminLocal(), s)
+	}
+	return s
+}
+
+// Start accepting connections on all configured services, using listening
+// sockets inherited from a parent process where available. If any service
+// cannot listen, the sockets already opened are closed again and the error
+// returned.
+func (s *Server) Start() error {
+	inherited := inheritedListeners()
+	services := make([]Service, 0)
+	addrs := make([]string, 0)
+	for _, svc := range s.smtp {
+		services = append(services, svc)
+		addrs = append(addrs, svc.Addr().String())
+	}
+	if s.admin != nil {
+		services = append(services, s.admin)
+	}
+	for _, svc := range services {
+		var l net.Listener
+		if inherited, l = takeListener(inherited, svc.Addr()); l == nil {
+			var err error
+			if l, err = Listen(svc); err != nil {
+				for _, l := range append(s.listeners, inherited...) {
+					l.Close()
+				}
+				s.listeners = nil
+				return err
+			}
+		}
+		s.listeners = append(s.listeners, l)
+		go RunService(svc, l)
+	}
+	for _, l := range inherited {
+		log.Warn("closing unused inherited listener for %s", l.Addr())
+		l.Close()
+	}
+	// systemd only listens to the main process, which a process started by
+	// an upgrade is not until its parent says so, so the parent reports it
+	// ready too.
+	if !notifyParentReady() {
+		sdNotify("READY=1\nSTATUS=Accepting connections on " + strings.Join(addrs, ", "))
+	}
+	startWatchdog()
+	return nil
+}
+
+// Hand the listening sockets over to a new instance of the server binary,
+// then stop accepting connections and exit once all sessions in progress
+// have finished.
+func (s *Server) Upgrade() error {
+	s.cfgLock.Lock()
+	if s.upgrading {
+		s.cfgLock.Unlock()
+		return UpgradeInProgress
+	}
+	s.upgrading = true
+	s.cfgLock.Unlock()
+	// Save state the new process will load before it starts.
+	if err := s.state.Greylist.Save(); err != nil {
+		log.Error("failed to save greylist: %v", err)
+	}
+	pid, err := execUpgrade(s.listeners)
+	if err != nil {
+		log.Error("upgrade failed: %v", err)
+		s.cfgLock.Lock()
+		s.upgrading = false
+		s.cfgLock.Unlock()
+		return err
+	}
+	log.Info("upgrade succeeded, draining sessions")
+	s.cfgLock.Lock()
+	s.handedOff = true
+	s.cfgLock.Unlock()
+	s.state.Greylist.Detach()
+	sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1\nSTATUS=Handed over to process %d, draining sessions", pid, pid))
+	for _, l := range s.listeners {
+		// The socket file now belongs to the new process.
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+	for _, svc := range s.smtp {
+		svc.Drain()
+	}
+	s.exitChan <- 1
+	return nil
+}
+
+// Returns channel indicating when this server should exit.
+func (s *Server) Exited() chan int {
+	return s.exitChan
+}
+
+// Returns the state shared by all sessions.
+func (s *Server) State() *ServerState {
+	return s.state
+}
+
+// Returns the currently active configuration.
+func (s *Server) Config() Config {
+	s.cfgLock.Lock()
+	defer s.cfgLock.Unlock()
+	return s.cfg
+}
+
+// Tell systemd the service is stopping, unless it was handed over to a new
+// process, save any state that should survive a restart, and write out the
+// DMARC reports collected so far.
+func (s *Server) Stop() {
+	// After an upgrade the new process is the service, and is not stopping.
+	s.cfgLock.Lock()
+	handedOff := s.handedOff
+	s.cfgLock.Unlock()
+	if !handedOff {
+		sdNotify("STOPPING=1")
+	}
+	if err := s.state.Greylist.Save(); err != nil {
+		log.Error("failed to save greylist: %v", err)
+	}
+	s.state.DMARCReports.Flush()
+}
+
+// Re-read the configuration file and, if it is valid, make it the active
+// configuration for new sessions. Returns the names of any changed
+// directives that will only take effect after a restart.
+func (s *Server) Reload() ([]string, error) {
+	s.cfgLock.Lock()
+	defer s.cfgLock.Unlock()
+	c, restart, err := ReloadConfig(s.path, s.cfg)
+	if err != nil {
+		log.Error("failed to reload config: %v", err)
+		return nil, err
+	}
+	old := s.cfg
+	s.cfg = c
+	log.SetLevel(c.LogLevel())
+	for _, svc := range s.smtp {
+		svc.Reconfigure(c)
+	}
+	old.Close()
+	log.Info("reloaded config: %s", c)
+	if len(restart) > 0 {
+		log.Warn("restart required for changes to: %s", strings.Join(restart, ", "))
+	}
+	return restart, nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStartClosesListenersOnFailure(t *testing.T) {
+	// Find a free port, and hold another so that binding to it fails.
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	c := testConfig(t, "domain: mx.example.com", "listen: "+addr, "adminlisten: "+taken.Addr().String())
+	s := NewServer("", c)
+	if err := s.Start(); err == nil {
+		t.Fatal("Start succeeded with its admin address in use")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("SMTP listener left open: %v", err)
+	}
+	l.Close()
+}
+
+func TestReloadClosesTables(t *testing.T) {
+	dir := t.TempDir()
+	table := filepath.Join(dir, "recipients.cdb")
+	if err := os.WriteFile(table, makeCDB(map[string]string{"alice@example.com": ""}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "go25.conf")
+	conf := "domain: mx.example.com\nlocaldomains: example.com\nrecipients: cdb:" + table + "\n"
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(path, c)
+	if _, err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Recipients().Lookup("alice@example.com"); err != tableClosed {
+		t.Errorf("replaced table: got error %v, want %v", err, tableClosed)
+	}
+	if _, found, err := s.Config().Recipients().Lookup("alice@example.com"); !found || err != nil {
+		t.Errorf("new table: got %v (%v)", found, err)
+	}
+}
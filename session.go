@@ -3,22 +3,42 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/codeslinger/log"
 	"net"
+	"strings"
 	"time"
 )
 
 // --- SMTP Session ---------------------------------------------------------
 
 type SMTPSession struct {
-	conn    *net.TCPConn
-	r       *bufio.Reader
-	remote  *net.TCPAddr
-	state   sessionState
-	cfg     Config
-	message *SMTPMessage
+	conn          net.Conn
+	r             *bufio.Reader
+	peer          net.Addr
+	remote        net.Addr
+	state         sessionState
+	cfg           Config
+	profile       *ListenerProfile
+	shared        *ServerState
+	tls           bool
+	esmtp         bool
+	authenticated bool
+	helo          string
+	heloFixed     bool
+	clientName    string
+	login         string
+	proto         string
+	xclient       bool
+	xforward      bool
+	forward       *ForwardInfo
+	heloSPF       *SPFCheck
+	milters       []*milterConn
+	discard       bool
+	errors        int
+	message       *SMTPMessage
 }
 
 type sessionState int
@@ -38,6 +58,8 @@ const (
 	MinCommandLength  = 6
 	MinMailLineLength = 14
 	MinRcptLineLength = 12
+	MinStarttlsLength = 10
+	MinXclientLength  = 12
 )
 
 var (
@@ -71,24 +93,82 @@ var ResponseMap = map[int][]byte{
 	554: []byte("554 Transaction failed\r\n"),
 }
 
-// Create a new SMTP session record.
-func NewSMTPSession(conn *net.TCPConn, cfg Config) *SMTPSession {
+// Create a new SMTP session record for a connection accepted on a listener
+// with the given profile.
+func NewSMTPSession(conn net.Conn, cfg Config, profile *ListenerProfile, shared *ServerState) *SMTPSession {
+	_, isTLS := conn.(*tls.Conn)
+	remote := RemoteAddr(conn)
 	return &SMTPSession{
-		r:       bufio.NewReaderSize(conn, MaxLineLength),
-		conn:    conn,
-		remote:  conn.RemoteAddr().(*net.TCPAddr),
-		state:   connected,
-		cfg:     cfg,
-		message: nil,
+		r:             bufio.NewReaderSize(conn, MaxLineLength),
+		conn:          conn,
+		peer:          remote,
+		remote:        remote,
+		state:         connected,
+		cfg:           cfg,
+		profile:       profile,
+		shared:        shared,
+		tls:           isTLS,
+		esmtp:         false,
+		authenticated: false,
+		helo:          "",
+		heloFixed:     false,
+		clientName:    "",
+		login:         "",
+		proto:         "",
+		xclient:       cfg.XclientHosts().Contains(RemoteIP(remote)),
+		xforward:      cfg.XforwardHosts().Contains(RemoteIP(remote)),
+		forward:       nil,
+		heloSPF:       nil,
+		milters:       nil,
+		discard:       false,
+		errors:        0,
+		message:       nil,
 	}
 }
 
 // Greet a newly-connected SMTP client with the initial banner message.
 func (s *SMTPSession) Greet() Verdict {
+	if s.profile.GreetPause > 0 {
+		if verdict := s.checkEarlyTalker(); verdict == Terminate {
+			return verdict
+		}
+	}
+	if verdict := s.checkDNSBL(); verdict == Terminate {
+		return verdict
+	}
+	if verdict := s.connectMilters(); verdict == Terminate {
+		return verdict
+	}
 	s.state = bannerSent
 	return s.respondWithVerdict(220, s.banner())
 }
 
+// Release the resources held by this session once the client has gone.
+func (s *SMTPSession) Close() {
+	s.closeMilters()
+}
+
+// Wait before sending the banner to see whether the client starts talking
+// before it is allowed to, as spambots often do. The client's input is left
+// in the buffer, not consumed.
+func (s *SMTPSession) checkEarlyTalker() Verdict {
+	if err := s.conn.SetReadDeadline(time.Now().Add(s.profile.GreetPause)); err != nil {
+		return Terminate
+	}
+	_, err := s.r.Peek(1)
+	if err == nil {
+		s.shared.EarlyTalkers.Inc(1)
+		log.Warn("%s: client sent data before greeting, %d bytes", s.remote, s.r.Buffered())
+		s.respond(554, "5.5.1 Protocol error: client talked before greeting")
+		return Terminate
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return Continue
+	}
+	s.err("error waiting for client before greeting", err)
+	return Terminate
+}
+
 // Read, process and respond to a SMTP command(s) from the client.
 func (s *SMTPSession) Process() Verdict {
 	data, err := s.readLine()
@@ -137,6 +217,13 @@ func (s *SMTPSession) Process() Verdict {
 				return s.handleHelp(data)
 			}
 		}
+	} else if data[0] == 'L' || data[0] == 'l' {
+		if (data[1] == 'H' || data[1] == 'h') &&
+			(data[2] == 'L' || data[2] == 'l') &&
+			(data[3] == 'O' || data[3] == 'o') &&
+			data[4] == ' ' {
+			return s.handleLhlo(data)
+		}
 	} else if data[0] == 'M' || data[0] == 'm' {
 		if len(data) < MinMailLineLength {
 			return s.codeWithVerdict(500)
@@ -184,6 +271,16 @@ func (s *SMTPSession) Process() Verdict {
 			}
 		}
 	} else if data[0] == 'S' || data[0] == 's' {
+		if (data[1] == 'T' || data[1] == 't') && len(data) >= MinStarttlsLength {
+			if (data[2] == 'A' || data[2] == 'a') &&
+				(data[3] == 'R' || data[3] == 'r') &&
+				(data[4] == 'T' || data[4] == 't') &&
+				(data[5] == 'T' || data[5] == 't') &&
+				(data[6] == 'L' || data[6] == 'l') &&
+				(data[7] == 'S' || data[7] == 's') {
+				return s.handleStarttls(data)
+			}
+		}
 		if len(data) < MinMailLineLength {
 			return s.codeWithVerdict(500)
 		}
@@ -227,6 +324,28 @@ func (s *SMTPSession) Process() Verdict {
 			(data[3] == 'Y' || data[3] == 'y') {
 			return s.handleVrfy(data)
 		}
+	} else if data[0] == 'X' || data[0] == 'x' {
+		if len(data) < MinXclientLength {
+			return s.codeWithVerdict(500)
+		}
+		if (data[1] == 'C' || data[1] == 'c') &&
+			(data[2] == 'L' || data[2] == 'l') &&
+			(data[3] == 'I' || data[3] == 'i') &&
+			(data[4] == 'E' || data[4] == 'e') &&
+			(data[5] == 'N' || data[5] == 'n') &&
+			(data[6] == 'T' || data[6] == 't') &&
+			data[7] == ' ' {
+			return s.handleXclient(data)
+		} else if (data[1] == 'F' || data[1] == 'f') &&
+			(data[2] == 'O' || data[2] == 'o') &&
+			(data[3] == 'R' || data[3] == 'r') &&
+			(data[4] == 'W' || data[4] == 'w') &&
+			(data[5] == 'A' || data[5] == 'a') &&
+			(data[6] == 'R' || data[6] == 'r') &&
+			(data[7] == 'D' || data[7] == 'd') &&
+			data[8] == ' ' {
+			return s.handleXforward(data)
+		}
 	}
 	return s.codeWithVerdict(500)
 }
@@ -238,9 +357,17 @@ func (s *SMTPSession) handleAuth(data []byte) Verdict {
 
 // Process a DATA command.
 func (s *SMTPSession) handleData(data []byte) Verdict {
+	if s.state != mailReceived && s.state != rcptReceived {
+		return s.codeWithVerdict(503)
+	}
 	if s.message.To.Len() < 1 {
 		return s.respondWithVerdict(554, "no valid recipients given")
 	}
+	if code, msg := s.milterData(); code != 0 {
+		s.milterAbort()
+		s.state = heloReceived
+		return s.respondWithVerdict(code, msg)
+	}
 	if err := s.respondCode(354); err != nil {
 		return Terminate
 	}
@@ -250,20 +377,87 @@ func (s *SMTPSession) handleData(data []byte) Verdict {
 		log.Error("failed to read body of message: %v", err)
 		return Terminate
 	}
-	s.message.Body = body
+	if s.cfg.DKIMVerify() && !s.authenticated {
+		s.message.DKIM = VerifyDKIM(s.cfg.Resolver(), body+"\r\n")
+	}
+	if s.cfg.ARCVerify() && !s.submitted() {
+		s.message.ARC = VerifyARC(s.cfg.Resolver(), body+"\r\n")
+	}
+	if code, msg := s.checkDMARC(body); code != 0 {
+		s.state = bodyReceived
+		s.milterAbort()
+		log.Warn("%s: DMARC refused from=<%s>: %s", s.remote, s.message.From, msg)
+		return s.respondPerRecipient(code, msg)
+	}
+	s.message.Body = s.message.AuthResultsHeader(s.cfg.ServingDomain()) + s.spfHeaders() +
+		s.message.QuarantineHeader() + s.message.ReceivedHeader(s.cfg.ServingDomain(), time.Now()) + body
+	if code, msg := s.milterMessage(); code != 0 {
+		s.state = bodyReceived
+		s.milterAbort()
+		log.Warn("%s: milter refused from=<%s>: %d %s", s.remote, s.message.From, code, msg)
+		return s.respondPerRecipient(code, msg)
+	}
+	if code, msg := s.checkVirus(); code != 0 {
+		s.state = bodyReceived
+		log.Warn("%s: virus scan refused from=<%s>: %d %s", s.remote, s.message.From, code, msg)
+		return s.respondPerRecipient(code, msg)
+	}
+	if code, msg := s.checkSpam(); code != 0 {
+		s.state = bodyReceived
+		log.Warn("%s: spam refused from=<%s>: score %s", s.remote, s.message.From, s.message.Spam)
+		return s.respondPerRecipient(code, msg)
+	}
+	if s.message.Discarded {
+		s.state = bodyReceived
+		log.Info("%s: message discarded: %s", s.remote, s.message)
+		return s.respondPerRecipient(250, "OK")
+	}
+	s.sealARC()
+	s.signDKIM()
 	s.state = bodyReceived
-	return s.codeWithVerdict(250)
+	log.Info("%s: message received: %s", s.remote, s.message)
+	return s.respondPerRecipient(250, "OK")
 }
 
 // Process an EHLO command.
 func (s *SMTPSession) handleEhlo(data []byte) Verdict {
+	if s.profile.Mode == ModeLMTP {
+		return s.codeWithVerdict(500)
+	}
+	return s.sendExtensions(data)
+}
+
+// Process an LHLO command, the LMTP equivalent of EHLO.
+func (s *SMTPSession) handleLhlo(data []byte) Verdict {
+	if s.profile.Mode != ModeLMTP {
+		return s.codeWithVerdict(500)
+	}
+	return s.sendExtensions(data)
+}
+
+// Reply to EHLO or LHLO with the list of supported extensions.
+func (s *SMTPSession) sendExtensions(data []byte) Verdict {
 	if s.state > bannerSent {
 		return s.codeWithVerdict(503)
 	}
+	s.setHelo(data)
+	if code, msg := s.milterHelo(); code != 0 {
+		return s.respondWithVerdict(code, msg)
+	}
+	s.esmtp = true
 	msg := []string{s.heloLine(),
-		fmt.Sprintf("SIZE %d", s.cfg.MaxMsgSize()),
+		fmt.Sprintf("SIZE %d", s.maxMsgSize()),
 		"PIPELINING",
 		"8BITMIME"}
+	if s.cfg.TLSConfig() != nil && !s.tls {
+		msg = append(msg, "STARTTLS")
+	}
+	if s.xclient {
+		msg = append(msg, "XCLIENT "+strings.Join(XclientAttrs, " "))
+	}
+	if s.xforward {
+		msg = append(msg, "XFORWARD "+strings.Join(XforwardAttrs, " "))
+	}
 	if err := s.respondMulti(250, msg); err != nil {
 		return Terminate
 	}
@@ -276,16 +470,43 @@ func (s *SMTPSession) handleEtrn(data []byte) Verdict {
 	return s.codeWithVerdict(502)
 }
 
-// Process an EXPN command.
+// Process an EXPN command, listing the addresses an alias expands to.
 func (s *SMTPSession) handleExpn(data []byte) Verdict {
-	return s.codeWithVerdict(502)
+	if !s.permits(s.profile.Expn) {
+		log.Info("%s: EXPN refused", s.remote)
+		return s.codeWithVerdict(502)
+	}
+	addr, err := s.commandAddress(data)
+	if err != nil {
+		return s.codeWithVerdict(501)
+	}
+	addrs, code, msg := s.expandAlias(addr)
+	if code != 0 {
+		return s.respondWithVerdict(code, msg)
+	}
+	lines := make([]string, len(addrs))
+	for i, a := range addrs {
+		lines[i] = "2.1.5 <" + a + ">"
+	}
+	if err := s.respondMulti(250, lines); err != nil {
+		return Terminate
+	}
+	return Continue
 }
 
 // Process a HELO command.
 func (s *SMTPSession) handleHelo(data []byte) Verdict {
+	if s.profile.Mode == ModeLMTP {
+		return s.codeWithVerdict(500)
+	}
 	if s.state > bannerSent {
 		return s.codeWithVerdict(503)
 	}
+	s.setHelo(data)
+	if code, msg := s.milterHelo(); code != 0 {
+		return s.respondWithVerdict(code, msg)
+	}
+	s.esmtp = false
 	s.state = heloReceived
 	return s.respondWithVerdict(250, s.heloLine())
 }
@@ -297,15 +518,42 @@ func (s *SMTPSession) handleHelp(data []byte) Verdict {
 
 // Process a MAIL FROM command.
 func (s *SMTPSession) handleMail(data []byte) Verdict {
-	if s.state != heloReceived {
+	if s.state != heloReceived && s.state != bodyReceived {
 		return s.codeWithVerdict(503)
 	}
+	if s.profile.RequireTLS && !s.tls {
+		return s.respondWithVerdict(530, "Must issue a STARTTLS command first")
+	}
+	if s.profile.RequireAuth && !s.authenticated {
+		return s.respondWithVerdict(530, "Authentication required")
+	}
 	from, err := s.extractAddress(data)
 	if err != nil {
 		return s.codeWithVerdict(501)
 	}
+	if !s.shared.Rates.Allow(RateMessages, s.rateKey(), 1, s.cfg.MsgRate(), time.Hour) {
+		log.Warn("%s: message rate limit exceeded for %s", s.remote, s.rateKey())
+		return s.respondWithVerdict(451, "4.7.1 Message rate limit exceeded, try again later")
+	}
+	heloSPF, spf, code, msg := s.checkSPF(from)
+	if code != 0 {
+		log.Warn("%s: SPF refused from=<%s>: %s", s.remote, from, msg)
+		return s.respondWithVerdict(code, msg)
+	}
 	s.message = NewSMTPMessage(s.remote)
 	s.message.From = from
+	s.message.Helo = s.helo
+	s.message.Login = s.login
+	s.message.Proto = s.protocol()
+	s.message.Forward = s.forward
+	s.message.HeloSPF = heloSPF
+	s.message.SPF = spf
+	if code, msg := s.milterMail(from); code != 0 {
+		s.milterAbort()
+		s.message = nil
+		return s.respondWithVerdict(code, msg)
+	}
+	s.forward = nil
 	s.state = mailReceived
 	return s.codeWithVerdict(250)
 }
@@ -330,16 +578,41 @@ func (s *SMTPSession) handleRcpt(data []byte) Verdict {
 	if err != nil {
 		return s.codeWithVerdict(501)
 	}
-	s.message.To.PushBack(rcpt)
+	if !s.shared.Rates.Allow(RateRecipients, s.rateKey(), 1, s.cfg.RcptRate(), time.Hour) {
+		log.Warn("%s: recipient rate limit exceeded for %s", s.remote, s.rateKey())
+		return s.respondWithVerdict(451, "4.7.1 Recipient rate limit exceeded, try again later")
+	}
+	addrs, code, msg := s.routeRecipient(rcpt)
+	if code != 0 {
+		return s.respondWithVerdict(code, msg)
+	}
+	if p := s.cfg.Greylisting(); p != nil && !s.trusted() &&
+		!s.shared.Greylist.Check(p, RemoteIP(s.remote), s.message.From, rcpt) {
+		log.Info("%s: greylisted from=<%s> to=<%s>", s.remote, s.message.From, rcpt)
+		return s.respondWithVerdict(451, "4.7.1 Greylisted, please try again later")
+	}
+	// A refused recipient leaves the transaction open, so the filters are
+	// not told to abort it.
+	if code, msg := s.milterRcpt(rcpt); code != 0 {
+		return s.respondWithVerdict(code, msg)
+	}
+	for _, addr := range addrs {
+		s.addRecipient(addr)
+	}
+	s.message.Rcpts = append(s.message.Rcpts, rcpt)
 	s.state = rcptReceived
 	return s.codeWithVerdict(250)
 }
 
 // Process a RSET command.
 func (s *SMTPSession) handleRset(data []byte) Verdict {
+	if s.state == mailReceived || s.state == rcptReceived {
+		s.milterAbort()
+	}
 	if s.state >= heloReceived {
 		s.state = heloReceived
 		s.message = NewSMTPMessage(s.remote)
+		s.forward = nil
 	}
 	return s.codeWithVerdict(250)
 }
@@ -359,14 +632,55 @@ func (s *SMTPSession) handleSoml(data []byte) Verdict {
 	return s.codeWithVerdict(502)
 }
 
+// Process a STARTTLS command. On success the session starts over as if the
+// client had just connected, as required by RFC 3207.
+func (s *SMTPSession) handleStarttls(data []byte) Verdict {
+	if s.cfg.TLSConfig() == nil || s.tls {
+		return s.codeWithVerdict(502)
+	}
+	if s.state > heloReceived {
+		return s.codeWithVerdict(503)
+	}
+	// Anything the client pipelined after STARTTLS was sent in the clear and
+	// must not be treated as part of the encrypted session.
+	if s.r.Buffered() > 0 {
+		return s.respondWithVerdict(501, "Pipelining after STARTTLS not allowed")
+	}
+	if verdict := s.respondWithVerdict(220, "Ready to start TLS"); verdict == Terminate {
+		return verdict
+	}
+	tlsConn := tls.Server(s.conn, s.cfg.TLSConfig())
+	tlsConn.SetDeadline(s.timeout())
+	if err := tlsConn.Handshake(); err != nil {
+		s.err("TLS handshake failed", err)
+		return Terminate
+	}
+	s.conn = tlsConn
+	s.r = bufio.NewReaderSize(tlsConn, MaxLineLength)
+	s.tls = true
+	s.state = bannerSent
+	s.message = nil
+	return Continue
+}
+
 // Process a TURN command.
 func (s *SMTPSession) handleTurn(data []byte) Verdict {
 	return s.codeWithVerdict(502)
 }
 
-// Process a VRFY command.
+// Process a VRFY command. Clients not permitted to use it are told that the
+// address cannot be verified, as RFC 5321 section 7.3 suggests.
 func (s *SMTPSession) handleVrfy(data []byte) Verdict {
-	return s.codeWithVerdict(502)
+	if !s.permits(s.profile.Vrfy) {
+		log.Info("%s: VRFY refused", s.remote)
+		return s.codeWithVerdict(252)
+	}
+	addr, err := s.commandAddress(data)
+	if err != nil {
+		return s.codeWithVerdict(501)
+	}
+	code, msg := s.verifyAddress(addr)
+	return s.respondWithVerdict(code, msg)
 }
 
 // Respond to client, reporting session termination if there was an error
@@ -376,7 +690,22 @@ func (s *SMTPSession) respondWithVerdict(code int, message string) Verdict {
 		log.Error("%s: failed to send response: %v", s.remote, err)
 		return Terminate
 	}
-	return Continue
+	return s.countError(code)
+}
+
+// Respond to the end of a message's data. LMTP gives one reply per
+// recipient, in the order they were given.
+func (s *SMTPSession) respondPerRecipient(code int, message string) Verdict {
+	if s.profile.Mode != ModeLMTP {
+		return s.respondWithVerdict(code, message)
+	}
+	for _, rcpt := range s.message.Rcpts {
+		if err := s.respond(code, fmt.Sprintf("<%s> %s", rcpt, message)); err != nil {
+			log.Error("%s: failed to send response: %v", s.remote, err)
+			return Terminate
+		}
+	}
+	return s.countError(code)
 }
 
 // Respond to client, reporting session termination if there was an error
@@ -386,21 +715,24 @@ func (s *SMTPSession) codeWithVerdict(code int) Verdict {
 		log.Error("%s: failed to send response: %v", s.remote, err)
 		return Terminate
 	}
-	return Continue
+	return s.countError(code)
 }
 
 // Write a single-line response to this session.
 func (s *SMTPSession) respond(code int, message string) error {
+	s.tarpit(code)
 	return s.send(s.responseLine(code, " ", message))
 }
 
 // Write a single-line response from the ResponseMap for the given code.
 func (s *SMTPSession) respondCode(code int) error {
+	s.tarpit(code)
 	return s.send(ResponseMap[code])
 }
 
 // Write a multi-line response to this session.
 func (s *SMTPSession) respondMulti(code int, messages []string) (err error) {
+	s.tarpit(code)
 	for i := range messages {
 		sep := "-"
 		if i == len(messages)-1 {
@@ -422,7 +754,7 @@ func (s *SMTPSession) responseLine(code int, sep, message string) []byte {
 // Read in the <CRLF>.<CRLF>-terminated body of an SMTP message submission.
 func (s *SMTPSession) readBody() (string, error) {
 	// TODO: spill message to disk if its over a certain size
-	body := make([]byte, s.cfg.MaxMsgSize())
+	body := make([]byte, s.maxMsgSize())
 	pos := 0
 	for {
 		n, err := s.slurp(body[pos:])
@@ -430,18 +762,23 @@ func (s *SMTPSession) readBody() (string, error) {
 			return "", err
 		}
 		pos += n
-		if body[pos-1] == '\n' &&
-			body[pos-2] == '\r' &&
-			body[pos-3] == '.' &&
-			body[pos-4] == '\n' &&
-			body[pos-5] == '\r' {
+		if pos == 3 && string(body[:3]) == ".\r\n" {
+			return "", nil
+		}
+		if pos >= 5 && string(body[pos-5:pos]) == "\r\n.\r\n" {
 			break
 		}
-		if pos >= s.cfg.MaxMsgSize() {
+		if pos >= s.maxMsgSize() {
 			return "", MessageTooLong
 		}
 	}
-	return string(body[0 : pos-5]), nil
+	// Undo the dot-stuffing of lines that begin with a period (RFC 5321
+	// section 4.5.2).
+	msg := strings.ReplaceAll(string(body[0:pos-5]), "\r\n..", "\r\n.")
+	if strings.HasPrefix(msg, "..") {
+		msg = msg[1:]
+	}
+	return msg, nil
 }
 
 // Extract the email address part of an SMTP command line that should
@@ -461,8 +798,66 @@ func (s *SMTPSession) extractAddress(line []byte) (string, error) {
 	return "", AddressNotFound
 }
 
+// Record the name the client gave in its HELO, EHLO or LHLO command, unless
+// a front-end has already told us the real client's name with XCLIENT.
+func (s *SMTPSession) setHelo(data []byte) {
+	if !s.heloFixed {
+		s.helo = strings.TrimSpace(string(data[5:]))
+	}
+}
+
+// Returns the name of the protocol used by this session, as used in the
+// "with" clause of Received: headers (RFC 3848).
+func (s *SMTPSession) protocol() string {
+	if s.proto != "" {
+		return s.proto
+	}
+	proto := "SMTP"
+	if s.profile.Mode == ModeLMTP {
+		proto = "LMTP"
+	} else if s.esmtp {
+		proto = "ESMTP"
+	}
+	if s.tls {
+		proto += "S"
+	}
+	if s.authenticated {
+		proto += "A"
+	}
+	return proto
+}
+
+// Returns the key under which this session's messages and recipients are
+// rate limited: the authenticated user if there is one, otherwise the
+// client's IP address.
+func (s *SMTPSession) rateKey() string {
+	if s.login != "" {
+		return "user=" + s.login
+	}
+	if ip := RemoteIP(s.remote); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// Returns the maximum size of a message allowed in this session, in bytes.
+func (s *SMTPSession) maxMsgSize() int {
+	if s.profile.MaxMsgSize > 0 {
+		return s.profile.MaxMsgSize
+	}
+	return s.cfg.MaxMsgSize()
+}
+
 // Format line for greeting clients at initial connect time.
 func (s *SMTPSession) banner() string {
+	if s.profile.Banner != "" {
+		return fmt.Sprintf("%s %s", s.cfg.ServingDomain(), s.profile.Banner)
+	}
+	if s.profile.Mode == ModeLMTP {
+		return fmt.Sprintf("%s LMTP %s Service ready",
+			s.cfg.ServingDomain(),
+			s.cfg.SoftwareIdent())
+	}
 	return fmt.Sprintf("%s ESMTP %s Service ready",
 		s.cfg.ServingDomain(),
 		s.cfg.SoftwareIdent())
@@ -470,7 +865,10 @@ func (s *SMTPSession) banner() string {
 
 // Format line for greeting clients in response to HELO/EHLO command.
 func (s *SMTPSession) heloLine() string {
-	return fmt.Sprintf("%s Hello [%s]", s.cfg.ServingDomain(), s.remote.IP)
+	if ip := RemoteIP(s.remote); ip != nil {
+		return fmt.Sprintf("%s Hello [%s]", s.cfg.ServingDomain(), ip)
+	}
+	return fmt.Sprintf("%s Hello %s", s.cfg.ServingDomain(), s.remote)
 }
 
 // Read a single line from the client.
@@ -0,0 +1,174 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/rcrowley/go-metrics"
+	"math/big"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// --- Test sessions --------------------------------------------------------
+
+// Return a configuration made from the given directives, as if they had been
+// read from a file.
+func testConfig(t *testing.T, lines ...string) *config {
+	c, err := parseTestConfig(lines...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Make a configuration like testConfig, returning any error in it.
+func parseTestConfig(lines ...string) (*config, error) {
+	c := newConfig(metrics.NewRegistry())
+	if err := c.setDefaults(); err != nil {
+		return nil, err
+	}
+	for i, line := range lines {
+		if c.block != nil && line == "end" {
+			c.listeners = append(c.listeners, c.block)
+			c.block = nil
+			continue
+		}
+		if err := c.parseLine(line, i+1); err != nil {
+			return nil, err
+		}
+	}
+	return c, c.finish()
+}
+
+// A connection that appears to come from the given address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// The client's end of a session under test.
+type testClient struct {
+	*textproto.Conn
+	t    *testing.T
+	conn net.Conn
+}
+
+// Start a session with a client at the given address over an in-memory
+// connection, and read its greeting. The session can be adjusted by setup
+// before it starts.
+func startSession(t *testing.T, c Config, remote string, setup func(*SMTPSession)) *testClient {
+	tc := openSession(t, c, remote, setup)
+	tc.expect(220)
+	return tc
+}
+
+// Start a session like startSession, leaving the greeting to be read.
+func openSession(t *testing.T, c Config, remote string, setup func(*SMTPSession)) *testClient {
+	server, client := net.Pipe()
+	addr := &net.TCPAddr{IP: net.ParseIP(remote), Port: 40000}
+	s := NewSMTPSession(&addrConn{server, addr}, c, c.Listeners()[0], NewServerState(c))
+	if setup != nil {
+		setup(s)
+	}
+	go func() {
+		defer server.Close()
+		defer s.Close()
+		if s.Greet() == Terminate {
+			return
+		}
+		for s.Process() != Terminate {
+		}
+	}()
+	return &testClient{Conn: textproto.NewConn(client), t: t, conn: client}
+}
+
+// Read a reply and check its code.
+func (c *testClient) expect(code int) {
+	got, msg, err := c.ReadResponse(0)
+	if err != nil {
+		c.t.Fatalf("reading reply: %v", err)
+	}
+	if got != code {
+		c.t.Fatalf("got reply %d %s, want %d", got, msg, code)
+	}
+}
+
+// Send a command and return the code of its reply.
+func (c *testClient) cmd(format string, args ...interface{}) int {
+	if _, err := c.Cmd(format, args...); err != nil {
+		c.t.Fatalf("sending %q: %v", format, err)
+	}
+	code, _, err := c.ReadResponse(0)
+	if err != nil {
+		c.t.Fatalf("reading reply to %q: %v", format, err)
+	}
+	return code
+}
+
+// Send a command and check the code of its reply.
+func (c *testClient) send(code int, format string, args ...interface{}) {
+	if got := c.cmd(format, args...); got != code {
+		c.t.Fatalf("%q: got reply %d, want %d", format, got, code)
+	}
+}
+
+// Switch the connection to TLS after a successful STARTTLS.
+func (c *testClient) starttls() {
+	c.send(220, "STARTTLS")
+	conn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := conn.Handshake(); err != nil {
+		c.t.Fatalf("TLS handshake: %v", err)
+	}
+	c.Conn = textproto.NewConn(conn)
+}
+
+// Return TLS settings with a throwaway self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+// --- Sessions -------------------------------------------------------------
+
+func TestEmptyMessage(t *testing.T) {
+	c := startSession(t, testConfig(t, "domain: mx.example.com"), "198.51.100.7", nil)
+	c.send(250, "EHLO client.example")
+	c.send(250, "MAIL FROM:<sender@elsewhere.example>")
+	c.send(250, "RCPT TO:<user@mx.example.com>")
+	c.send(354, "DATA")
+	c.send(250, ".")
+	c.send(250, "MAIL FROM:<sender@elsewhere.example>")
+	c.send(250, "RCPT TO:<user@mx.example.com>")
+	c.send(354, "DATA")
+	for _, part := range []string{"\r", "\n", ".", "\r\n"} {
+		if _, err := c.conn.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.expect(250)
+}
@@ -2,9 +2,14 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/codeslinger/log"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // --- SMTP Service ---------------------------------------------------------
@@ -13,9 +18,13 @@ var DefaultIdent = "ESMTP Go25"
 
 type SMTPService struct {
 	cfg      Config
-	addr     *net.TCPAddr
+	profile  *ListenerProfile
+	cfgLock  sync.RWMutex
+	addr     net.Addr
+	state    *ServerState
 	exited   chan int
-	draining bool
+	draining int32
+	active   sync.WaitGroup
 }
 
 type Verdict int
@@ -25,43 +34,127 @@ const (
 	Terminate
 )
 
-// Create a new SMTP server instance bound to the given TCP address.
-func NewSMTPService(c Config, exited chan int) *SMTPService {
+// Create a new SMTP server instance for the given listener profile, sharing
+// the given server-wide state with other listeners.
+func NewSMTPService(c Config, p *ListenerProfile, state *ServerState, exited chan int) *SMTPService {
 	return &SMTPService{
 		cfg:      c,
-		addr:     c.ListenLocal(),
+		profile:  p,
+		addr:     p.Addr,
+		state:    state,
 		exited:   exited,
-		draining: false,
+		draining: 0,
 	}
 }
 
-// Returns TCP address on which this server is listening.
-func (s *SMTPService) Addr() *net.TCPAddr {
+// Returns address on which this server is listening.
+func (s *SMTPService) Addr() net.Addr {
 	return s.addr
 }
 
+// Returns the name of the listener profile this server was created for.
+func (s *SMTPService) Name() string {
+	return s.profile.Name
+}
+
+// Returns the configuration and listener profile given to newly-connected
+// sessions.
+func (s *SMTPService) Config() (Config, *ListenerProfile) {
+	s.cfgLock.RLock()
+	defer s.cfgLock.RUnlock()
+	return s.cfg, s.profile
+}
+
+// Replace the configuration given to newly-connected sessions, along with
+// this server's listener profile if the new configuration still has one of
+// the same name. Sessions already in progress keep the configuration they
+// started with.
+func (s *SMTPService) Reconfigure(c Config) {
+	s.cfgLock.Lock()
+	defer s.cfgLock.Unlock()
+	s.cfg = c
+	for _, p := range c.Listeners() {
+		if p.Name == s.profile.Name {
+			s.profile = p
+		}
+	}
+}
+
+// Returns the permissions to give this server's socket file if it listens
+// on a Unix domain socket.
+func (s *SMTPService) SocketPerms() (os.FileMode, int, int) {
+	_, p := s.Config()
+	return p.SocketMode, p.SocketUid, p.SocketGid
+}
+
 // Shut down this SMTP server.
 func (s *SMTPService) Shutdown() {
-	s.draining = true
+	atomic.StoreInt32(&s.draining, 1)
 	s.exited <- 1
 }
 
-// Process an incoming SMTP connection.
-func (s *SMTPService) Handle(conn *net.TCPConn) {
+// Refuse new sessions and wait for those in progress to finish, including
+// any admitted whose goroutine has yet to start.
+func (s *SMTPService) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+	s.active.Wait()
+}
+
+// Process an incoming SMTP connection admitted by Admit.
+func (s *SMTPService) Handle(conn net.Conn) {
+	defer s.active.Done()
+	defer s.state.Conns.Leave()
 	defer func() {
 		log.Trace(func() string {
-			return fmt.Sprintf("%s: client disconnected", conn.RemoteAddr())
+			return fmt.Sprintf("%s: client disconnected", RemoteAddr(conn))
 		})
 		conn.Close()
 	}()
 
 	// Send a 421 error response if the server is in the process of shutting
 	// down when the client connects.
-	if s.draining {
+	if atomic.LoadInt32(&s.draining) != 0 {
 		conn.Write(ResponseMap[421])
 		return
 	}
-	session := NewSMTPSession(conn, s.cfg)
+	cfg, profile := s.Config()
+	client := conn
+	// Only connections from trusted proxies may say who the client really
+	// is; anyone else is treated as connecting directly.
+	if profile.Proxy && profile.ProxyFrom.Contains(RemoteIP(conn.RemoteAddr())) {
+		var err error
+		timeout := time.Now().Add(time.Second * time.Duration(cfg.MaxIdleSecs()))
+		if client, err = ReadProxyHeader(conn, timeout); err != nil {
+			log.Warn("%s: failed to read PROXY header: %v", conn.RemoteAddr(), err)
+			return
+		}
+		log.Trace(func() string {
+			return fmt.Sprintf("%s: proxied connection from %s", conn.RemoteAddr(), client.RemoteAddr())
+		})
+	}
+	ip := RemoteIP(client.RemoteAddr())
+	if !s.state.Conns.Acquire(ip, cfg.MaxConnsPerIP()) {
+		log.Warn("%s: too many connections from client, refusing", client.RemoteAddr())
+		client.Write([]byte("421 4.7.0 Too many connections, try again later\r\n"))
+		return
+	}
+	defer s.state.Conns.Release(ip)
+	if ip != nil && !s.state.Rates.Allow(RateConnections, ip.String(), 1, cfg.ConnRate(), time.Minute) {
+		log.Warn("%s: connection rate limit exceeded, refusing", client.RemoteAddr())
+		client.Write([]byte("421 4.7.0 Connection rate limit exceeded, try again later\r\n"))
+		return
+	}
+	if profile.Mode == ModeSMTPS {
+		tlsConn := tls.Server(client, cfg.TLSConfig())
+		tlsConn.SetDeadline(time.Now().Add(time.Second * time.Duration(cfg.MaxIdleSecs())))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Warn("%s: TLS handshake failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		client = tlsConn
+	}
+	session := NewSMTPSession(client, cfg, profile, s.state)
+	defer session.Close()
 	if verdict := session.Greet(); verdict == Terminate {
 		return
 	}
@@ -72,8 +165,46 @@ func (s *SMTPService) Handle(conn *net.TCPConn) {
 	}
 }
 
+// Count a newly-accepted connection against the server-wide limit before a
+// goroutine is started for it, refusing and closing it if there are too
+// many already.
+// Connections admitted here are waited for by Drain until Handle is done
+// with them.
+func (s *SMTPService) Admit(conn net.Conn) bool {
+	cfg, _ := s.Config()
+	if !s.state.Conns.Admit(cfg.MaxConns()) {
+		log.Warn("%s: too many connections, refusing", RemoteAddr(conn))
+		refuse(conn, []byte("421 4.7.0 Too many connections, try again later\r\n"))
+		return false
+	}
+	// Count the connection before checking for a drain, so that Drain
+	// either waits for it or it sees the drain and is refused.
+	s.active.Add(1)
+	if atomic.LoadInt32(&s.draining) != 0 {
+		s.active.Done()
+		s.state.Conns.Leave()
+		refuse(conn, ResponseMap[421])
+		return false
+	}
+	return true
+}
+
+// Send a reply to a connection that will not be handled and close it, in
+// the background so that a slow client cannot hold up the accept loop.
+func refuse(conn net.Conn, reply []byte) {
+	go func() {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write(reply)
+		conn.Close()
+	}()
+}
+
 // Set TCP socket options on a new SMTP connection.
-func (s *SMTPService) SetClientOptions(conn *net.TCPConn) error {
+func (s *SMTPService) SetClientOptions(c net.Conn) error {
+	conn, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
 	if err := conn.SetKeepAlive(false); err != nil {
 		log.Error("%s: SetKeepAlive: %v", conn.RemoteAddr(), err)
 		return err
@@ -0,0 +1,83 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// Start draining the given service, returning a channel closed once it is
+// done, and check that it is still waiting after a little while.
+func startDrain(t *testing.T, svc *SMTPService) chan bool {
+	done := make(chan bool)
+	go func() {
+		svc.Drain()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Drain returned with a session in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	return done
+}
+
+func waitDrain(t *testing.T, done chan bool) {
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Drain did not return once sessions were done")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	c := testConfig(t, "domain: mx.example.com", "localdomains: example.com")
+	svc := NewSMTPService(c, c.Listeners()[0], NewServerState(c), make(chan int, 1))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go RunService(svc, l)
+	defer l.Close()
+
+	conn, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &testClient{Conn: conn, t: t}
+	client.expect(220)
+	client.send(250, "EHLO client.example")
+	done := startDrain(t, svc)
+
+	late, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := late.ReadResponse(421); err != nil {
+		t.Errorf("connection during drain: %v", err)
+	}
+	late.Close()
+
+	client.send(250, "MAIL FROM:<a@elsewhere.example>")
+	client.send(221, "QUIT")
+	client.Close()
+	waitDrain(t, done)
+}
+
+func TestDrainWaitsForAdmitted(t *testing.T) {
+	c := testConfig(t, "domain: mx.example.com")
+	svc := NewSMTPService(c, c.Listeners()[0], NewServerState(c), make(chan int, 1))
+	server, client := net.Pipe()
+	defer client.Close()
+	if !svc.Admit(server) {
+		t.Fatal("connection not admitted")
+	}
+	done := startDrain(t, svc)
+	go svc.Handle(server)
+	if _, _, err := textproto.NewConn(client).ReadResponse(421); err != nil {
+		t.Errorf("connection admitted before drain: %v", err)
+	}
+	waitDrain(t, done)
+}
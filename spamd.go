@@ -0,0 +1,165 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/codeslinger/log"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- SpamAssassin ---------------------------------------------------------
+
+// Settings for checking messages with SpamAssassin's spamd. Messages scoring
+// Reject or more are refused; with a Reject of zero they are only tagged.
+// Messages larger than MaxSize are not checked.
+type SpamdPolicy struct {
+	Addr    net.Addr
+	User    string
+	Reject  float64
+	MaxSize int
+	Timeout time.Duration
+}
+
+// The verdict of spamd on a message: whether it is spam, its score and the
+// score needed to be spam, and the names of the tests it hit.
+type SpamdResult struct {
+	Spam      bool
+	Score     float64
+	Threshold float64
+	Tests     []string
+}
+
+const (
+	defaultSpamdMaxSize = 500 * 1024
+	defaultSpamdTimeout = 30 * time.Second
+	spamcVersion        = "SPAMC/1.5"
+)
+
+// Have spamd check a message using the SPAMC protocol.
+func CheckSpamd(p *SpamdPolicy, msg string) (*SpamdResult, error) {
+	conn, err := net.DialTimeout(p.Addr.Network(), p.Addr.String(), p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(p.Timeout)); err != nil {
+		return nil, err
+	}
+	req := fmt.Sprintf("SYMBOLS %s\r\nContent-length: %d\r\n", spamcVersion, len(msg))
+	if p.User != "" {
+		req += "User: " + p.User + "\r\n"
+	}
+	if _, err = io.WriteString(conn, req+"\r\n"+msg); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	// The status line is "SPAMD/<version> <code> <message>".
+	f := strings.Fields(line)
+	if len(f) < 3 || !strings.HasPrefix(f[0], "SPAMD/") {
+		return nil, errors.New(fmt.Sprintf("malformed response: %q", strings.TrimSpace(line)))
+	}
+	if f[1] != "0" {
+		return nil, errors.New("spamd error: " + strings.Join(f[1:], " "))
+	}
+	res := &SpamdResult{}
+	found := false
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "Spam") {
+			if res.Spam, res.Score, res.Threshold, err = parseSpamHeader(kv[1]); err != nil {
+				return nil, err
+			}
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("response has no Spam header")
+	}
+	symbols, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range strings.Split(string(symbols), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			res.Tests = append(res.Tests, t)
+		}
+	}
+	return res, nil
+}
+
+func (r *SpamdResult) String() string {
+	return fmt.Sprintf("%.1f/%.1f", r.Score, r.Threshold)
+}
+
+// Format the X-Spam-Status and X-Spam-Score headers for this result, as
+// SpamAssassin itself writes them.
+func (r *SpamdResult) Headers() string {
+	status := "No"
+	if r.Spam {
+		status = "Yes"
+	}
+	status += fmt.Sprintf(", score=%.1f required=%.1f", r.Score, r.Threshold)
+	if len(r.Tests) > 0 {
+		status += "\r\n\ttests=" + strings.Join(r.Tests, ",")
+	}
+	return fmt.Sprintf("X-Spam-Status: %s\r\nX-Spam-Score: %.1f\r\n", status, r.Score)
+}
+
+// Check the current message with spamd and tag it with the result. If the
+// message must be refused, the reply code and text are returned. Messages
+// that cannot be checked are accepted untagged.
+func (s *SMTPSession) checkSpam() (int, string) {
+	p := s.cfg.Spamd()
+	if p == nil || s.authenticated || len(s.message.Body) > p.MaxSize {
+		return 0, ""
+	}
+	res, err := CheckSpamd(p, s.message.Body+"\r\n")
+	if err != nil {
+		log.Warn("%s: spamd check failed: %v", s.remote, err)
+		return 0, ""
+	}
+	s.message.Spam = res
+	if p.Reject > 0 && res.Score >= p.Reject {
+		s.shared.SpamRejected.Inc(1)
+		return 550, "5.7.1 Message rejected as spam"
+	}
+	s.message.Body = res.Headers() + s.message.Body
+	return 0, ""
+}
+
+// Parse the value of the Spam header of a spamd response, like
+// "True ; 15.3 / 5.0".
+func parseSpamHeader(v string) (spam bool, score, threshold float64, err error) {
+	parts := strings.SplitN(v, ";", 2)
+	if len(parts) != 2 {
+		return false, 0, 0, errors.New("malformed Spam header: " + v)
+	}
+	nums := strings.SplitN(parts[1], "/", 2)
+	if len(nums) != 2 {
+		return false, 0, 0, errors.New("malformed Spam header: " + v)
+	}
+	spam = strings.EqualFold(strings.TrimSpace(parts[0]), "True") ||
+		strings.EqualFold(strings.TrimSpace(parts[0]), "Yes")
+	if score, err = strconv.ParseFloat(strings.TrimSpace(nums[0]), 64); err == nil {
+		threshold, err = strconv.ParseFloat(strings.TrimSpace(nums[1]), 64)
+	}
+	return
+}
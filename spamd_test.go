@@ -0,0 +1,130 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Start a spamd on a local port that gives every message the given reply,
+// and return its address. Each request it reads is sent on requests.
+func fakeSpamd(t *testing.T, reply string, requests chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			req, size := "", 0
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					break
+				}
+				req += line
+				if strings.HasPrefix(line, "Content-length: ") {
+					size, _ = strconv.Atoi(strings.TrimSpace(line[16:]))
+				}
+				if line == "\r\n" {
+					body := make([]byte, size)
+					io.ReadFull(r, body)
+					req += string(body)
+					break
+				}
+			}
+			if requests != nil {
+				requests <- req
+			}
+			io.WriteString(conn, reply)
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func spamdReply(spam string) string {
+	return "SPAMD/1.5 0 EX_OK\r\nContent-length: 20\r\nSpam: " + spam + "\r\n\r\nBAYES_99,URIBL_BLACK"
+}
+
+func TestCheckSpamd(t *testing.T) {
+	requests := make(chan string, 1)
+	addr, _ := ResolveAddr(fakeSpamd(t, spamdReply("True ; 15.3 / 5.0"), requests))
+	p := &SpamdPolicy{Addr: addr, User: "nobody", Timeout: defaultSpamdTimeout}
+	res, err := CheckSpamd(p, "Subject: hi\r\n\r\nhello\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SYMBOLS SPAMC/1.5\r\nContent-length: 22\r\nUser: nobody\r\n\r\nSubject: hi\r\n\r\nhello\r\n"
+	if req := <-requests; req != want {
+		t.Errorf("got request %q, want %q", req, want)
+	}
+	if !res.Spam || res.Score != 15.3 || res.Threshold != 5.0 || strings.Join(res.Tests, ",") != "BAYES_99,URIBL_BLACK" {
+		t.Errorf("got result %+v", res)
+	}
+	headers := "X-Spam-Status: Yes, score=15.3 required=5.0\r\n\ttests=BAYES_99,URIBL_BLACK\r\nX-Spam-Score: 15.3\r\n"
+	if got := res.Headers(); got != headers {
+		t.Errorf("got headers %q, want %q", got, headers)
+	}
+}
+
+func TestCheckSpamdErrors(t *testing.T) {
+	for _, reply := range []string{
+		"SPAMD/1.5 64 EX_USAGE\r\n\r\n",
+		"HTTP/1.0 200 OK\r\n\r\n",
+		"SPAMD/1.5 0 EX_OK\r\nContent-length: 0\r\n\r\n",
+		"SPAMD/1.5 0 EX_OK\r\nSpam: True 15.3 / 5.0\r\n\r\n",
+		"SPAMD/1.5 0 EX_OK\r\nSpam: True ; lots / 5.0\r\n\r\n",
+		"SPAMD/1.5 0 EX_OK\r\nSpam: True ; 15.3",
+	} {
+		addr, _ := ResolveAddr(fakeSpamd(t, reply, nil))
+		p := &SpamdPolicy{Addr: addr, Timeout: defaultSpamdTimeout}
+		if res, err := CheckSpamd(p, "hello\r\n"); err == nil {
+			t.Errorf("%q: got result %+v", reply, res)
+		}
+	}
+}
+
+func TestSpamdSession(t *testing.T) {
+	tests := []struct {
+		spam   string
+		reject string
+		code   int
+		status string
+	}{
+		{"True ; 15.3 / 5.0", "10", 550, ""},
+		{"True ; 15.3 / 5.0", "0", 250, "X-Spam-Status: Yes, score=15.3 required=5.0\r\n"},
+		{"False ; 3.0 / 5.0", "10", 250, "X-Spam-Status: No, score=3.0 required=5.0\r\n"},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t,
+			"domain: mx.example.com",
+			"localdomains: example.com",
+			"spamd: "+fakeSpamd(t, spamdReply(test.spam), nil),
+			"spamdreject: "+test.reject)
+		var session *SMTPSession
+		c := startSession(t, cfg, "198.51.100.7", func(s *SMTPSession) {
+			session = s
+		})
+		c.send(250, "EHLO client.example")
+		c.send(250, "MAIL FROM:<a@elsewhere.example>")
+		c.send(250, "RCPT TO:<user@example.com>")
+		c.send(354, "DATA")
+		if got := c.cmd("Subject: hi\r\n\r\nhello\r\n."); got != test.code {
+			t.Errorf("%s reject %s: got reply %d, want %d", test.spam, test.reject, got, test.code)
+			continue
+		}
+		if test.code == 250 && !strings.HasPrefix(session.message.Body, test.status) {
+			t.Errorf("%s reject %s: message not tagged:\n%s", test.spam, test.reject, session.message.Body)
+		}
+	}
+}
@@ -0,0 +1,762 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codeslinger/log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- SPF ------------------------------------------------------------------
+
+// The result of an SPF check, as defined in RFC 7208 section 2.6.
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// What to do with a message given each SPF result: add a Received-SPF
+// header and accept it, reject it, defer it, or accept it without comment.
+const (
+	SPFActionTag    = "tag"
+	SPFActionReject = "reject"
+	SPFActionDefer  = "defer"
+	SPFActionIgnore = "ignore"
+)
+
+// SPF settings from the configuration, giving the action to take for each
+// result.
+type SPFPolicy struct {
+	Actions map[SPFResult]string
+}
+
+// The outcome of checking one identity, either the MAIL FROM address or the
+// HELO name, of a client.
+type SPFCheck struct {
+	Identity    string
+	Sender      string
+	Domain      string
+	IP          net.IP
+	Helo        string
+	Result      SPFResult
+	Explanation string
+}
+
+// Limits on the work a single check may cause, from RFC 7208 section 4.6.4.
+const (
+	spfMaxLookups     = 10
+	spfMaxVoidLookups = 2
+	spfMaxNames       = 10
+	spfMaxDomainLen   = 253
+)
+
+var (
+	spfPermError = errors.New("permanent SPF error")
+	spfTempError = errors.New("temporary SPF error")
+)
+
+// The state of an evaluation of the check_host() function.
+type spfEval struct {
+	r        Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	receiver string
+	lookups  int
+	voids    int
+}
+
+// Create a policy with the default actions: reject on fail and tag
+// everything else.
+func NewSPFPolicy() *SPFPolicy {
+	p := &SPFPolicy{Actions: make(map[SPFResult]string)}
+	for _, res := range []SPFResult{SPFNone, SPFNeutral, SPFPass, SPFSoftFail, SPFTempError, SPFPermError} {
+		p.Actions[res] = SPFActionTag
+	}
+	p.Actions[SPFFail] = SPFActionReject
+	return p
+}
+
+// Return the action to take for the given result.
+func (p *SPFPolicy) Action(res SPFResult) string {
+	if a, ok := p.Actions[res]; ok {
+		return a
+	}
+	return SPFActionTag
+}
+
+// Set actions from a list of "result=action" pairs, like "fail=reject,
+// softfail=tag".
+func (p *SPFPolicy) parseActions(s string) error {
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		kv := strings.SplitN(strings.ToLower(f), "=", 2)
+		if len(kv) != 2 {
+			return errors.New(fmt.Sprintf("expected 'result=action': %s", f))
+		}
+		res := SPFResult(kv[0])
+		if _, ok := p.Actions[res]; !ok {
+			return errors.New(fmt.Sprintf("unknown SPF result: %s", kv[0]))
+		}
+		switch kv[1] {
+		case SPFActionTag, SPFActionReject, SPFActionDefer, SPFActionIgnore:
+			p.Actions[res] = kv[1]
+		default:
+			return errors.New(fmt.Sprintf("unknown SPF action: %s", kv[1]))
+		}
+	}
+	return nil
+}
+
+// Check whether the client at the given address may use the given sender
+// address, or the HELO name if the sender is empty, as the receiver named.
+func CheckSPF(r Resolver, ip net.IP, sender, helo, receiver string) *SPFCheck {
+	c := &SPFCheck{Identity: "mailfrom", Sender: sender, IP: ip, Helo: helo}
+	if sender == "" {
+		c.Identity, c.Sender = "helo", "postmaster@"+helo
+	}
+	at := strings.LastIndex(c.Sender, "@")
+	if at <= 0 {
+		c.Sender = "postmaster@" + c.Sender[at+1:]
+		at = len("postmaster")
+	}
+	c.Domain = strings.ToLower(strings.TrimSuffix(c.Sender[at+1:], "."))
+	e := &spfEval{r: r, ip: ip, sender: c.Sender, helo: helo, receiver: receiver}
+	c.Result, c.Explanation = e.checkHost(c.Domain, true)
+	return c
+}
+
+// Check the HELO name the client gave, as the receiver named. Names that
+// are address literals or not fully qualified have no SPF result.
+func CheckHeloSPF(r Resolver, ip net.IP, helo, receiver string) *SPFCheck {
+	if !validDomain(helo) {
+		return &SPFCheck{Identity: "helo", Sender: "postmaster@" + helo, Domain: helo, IP: ip, Helo: helo, Result: SPFNone}
+	}
+	return CheckSPF(r, ip, "", helo, receiver)
+}
+
+// Format the Received-SPF header recording this check, as defined in RFC
+// 7208 section 9.1.
+func (c *SPFCheck) Header(receiver string) string {
+	var comment string
+	switch c.Result {
+	case SPFPass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", c.Sender, c.IP)
+	case SPFFail, SPFSoftFail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", c.Sender, c.IP)
+	case SPFNeutral:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", c.IP, c.Sender)
+	case SPFNone:
+		comment = fmt.Sprintf("domain of %s does not provide an SPF record", c.Sender)
+	default:
+		comment = fmt.Sprintf("error in processing SPF record of %s", c.Domain)
+	}
+	return fmt.Sprintf("Received-SPF: %s (%s: %s)\r\n\tclient-ip=%s; envelope-from=\"%s\"; helo=%s;\r\n\treceiver=%s; identity=%s;\r\n",
+		c.Result, receiver, comment, c.IP, c.Sender, c.Helo, receiver, c.Identity)
+}
+
+func (c *SPFCheck) String() string {
+	return fmt.Sprintf("%s=%s (%s)", c.Identity, c.Result, c.Domain)
+}
+
+// Evaluate the SPF record of the given domain, returning the result and, at
+// the top level of a fail, the domain's explanation.
+func (e *spfEval) checkHost(domain string, top bool) (SPFResult, string) {
+	if !validDomain(domain) {
+		return SPFNone, ""
+	}
+	record, err := e.record(domain)
+	if err == spfTempError {
+		return SPFTempError, ""
+	} else if err != nil {
+		return SPFPermError, ""
+	} else if record == "" {
+		return SPFNone, ""
+	}
+	var redirect, exp string
+	mechanisms := make([]string, 0)
+	for _, term := range strings.Fields(record)[1:] {
+		name, value, ok := spfModifier(term)
+		if !ok {
+			mechanisms = append(mechanisms, term)
+			continue
+		}
+		switch name {
+		case "redirect":
+			if redirect != "" {
+				return SPFPermError, ""
+			}
+			redirect = value
+		case "exp":
+			if exp != "" {
+				return SPFPermError, ""
+			}
+			exp = value
+		}
+	}
+	for _, term := range mechanisms {
+		qualifier := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = SPFFail, term[1:]
+		case '~':
+			qualifier, term = SPFSoftFail, term[1:]
+		case '?':
+			qualifier, term = SPFNeutral, term[1:]
+		}
+		match, err := e.mechanism(term, domain)
+		if err == spfTempError {
+			return SPFTempError, ""
+		} else if err != nil {
+			return SPFPermError, ""
+		}
+		if !match {
+			continue
+		}
+		if qualifier == SPFFail && top && exp != "" {
+			return qualifier, e.explain(exp, domain)
+		}
+		return qualifier, ""
+	}
+	if redirect != "" {
+		if e.lookups++; e.lookups > spfMaxLookups {
+			return SPFPermError, ""
+		}
+		target, err := e.expand(redirect, domain, false)
+		if err != nil {
+			return SPFPermError, ""
+		}
+		res, explanation := e.checkHost(target, top)
+		if res == SPFNone {
+			return SPFPermError, ""
+		}
+		return res, explanation
+	}
+	return SPFNeutral, ""
+}
+
+// Fetch the SPF record of a domain, or an empty string if it has none.
+func (e *spfEval) record(domain string) (string, error) {
+	txts, err := e.r.LookupTXT(domain)
+	if err != nil {
+		if IsNotFound(err) {
+			return "", nil
+		}
+		return "", spfTempError
+	}
+	found := make([]string, 0, 1)
+	for _, t := range txts {
+		if strings.EqualFold(t, "v=spf1") || (len(t) > 7 && strings.EqualFold(t[:7], "v=spf1 ")) {
+			found = append(found, t)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return found[0], nil
+	}
+	return "", spfPermError
+}
+
+// Report whether the client matches a mechanism, given without its
+// qualifier.
+func (e *spfEval) mechanism(term, domain string) (bool, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+	switch name {
+	case "all":
+		if arg != "" {
+			return false, spfPermError
+		}
+		return true, nil
+	case "ip4", "ip6":
+		return e.matchIP(name, strings.TrimPrefix(arg, ":"))
+	}
+	if e.lookups++; e.lookups > spfMaxLookups {
+		return false, spfPermError
+	}
+	target, cidr4, cidr6 := domain, 32, 128
+	if strings.HasPrefix(arg, ":") {
+		spec := arg[1:]
+		if i := strings.Index(spec, "/"); i >= 0 && (name == "a" || name == "mx") {
+			spec, arg = spec[:i], spec[i:]
+		} else {
+			arg = ""
+		}
+		var err error
+		if target, err = e.expand(spec, domain, false); err != nil {
+			return false, err
+		}
+	} else if name == "include" || name == "exists" {
+		return false, spfPermError
+	}
+	if name == "a" || name == "mx" {
+		var err error
+		if cidr4, cidr6, err = parseDualCIDR(arg); err != nil {
+			return false, err
+		}
+	} else if arg != "" {
+		return false, spfPermError
+	}
+	switch name {
+	case "a":
+		return e.matchHost(target, cidr4, cidr6)
+	case "mx":
+		mxs, err := e.r.LookupMX(target)
+		if err != nil {
+			return false, e.lookupError(err)
+		}
+		if len(mxs) > spfMaxNames {
+			return false, spfPermError
+		}
+		if len(mxs) == 0 {
+			return false, e.void()
+		}
+		for _, mx := range mxs {
+			if ok, err := e.matchHost(strings.TrimSuffix(mx.Host, "."), cidr4, cidr6); ok || err == spfPermError {
+				return ok, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		return e.matchPTR(target), nil
+	case "include":
+		switch res, _ := e.checkHost(target, false); res {
+		case SPFPass:
+			return true, nil
+		case SPFTempError:
+			return false, spfTempError
+		case SPFPermError, SPFNone:
+			return false, spfPermError
+		}
+		return false, nil
+	case "exists":
+		ips, err := e.r.LookupIP(target)
+		if err != nil {
+			return false, e.lookupError(err)
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, e.void()
+	}
+	return false, spfPermError
+}
+
+// Report whether the client is within an ip4 or ip6 network.
+func (e *spfEval) matchIP(name, arg string) (bool, error) {
+	if !strings.Contains(arg, "/") {
+		if name == "ip4" {
+			arg += "/32"
+		} else {
+			arg += "/128"
+		}
+	}
+	ip, network, err := net.ParseCIDR(arg)
+	if err != nil || (name == "ip4") != (ip.To4() != nil) {
+		return false, spfPermError
+	}
+	return network.Contains(e.ip), nil
+}
+
+// Report whether the client is within the given prefix length of any
+// address of a host.
+func (e *spfEval) matchHost(host string, cidr4, cidr6 int) (bool, error) {
+	ips, err := e.r.LookupIP(host)
+	if err != nil {
+		return false, e.lookupError(err)
+	}
+	if len(ips) == 0 {
+		return false, e.void()
+	}
+	for _, ip := range ips {
+		if v4 := ip.To4(); v4 != nil {
+			if c := e.ip.To4(); c != nil && v4.Mask(net.CIDRMask(cidr4, 32)).Equal(c.Mask(net.CIDRMask(cidr4, 32))) {
+				return true, nil
+			}
+		} else if e.ip.To4() == nil && ip.Mask(net.CIDRMask(cidr6, 128)).Equal(e.ip.Mask(net.CIDRMask(cidr6, 128))) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Report whether a validated name of the client is the given domain or a
+// subdomain of it.
+func (e *spfEval) matchPTR(domain string) bool {
+	for _, name := range e.validatedNames() {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the names of the client whose addresses include the client, as
+// described in RFC 7208 section 5.5.
+func (e *spfEval) validatedNames() []string {
+	names, err := e.r.LookupAddr(e.ip)
+	valid := make([]string, 0)
+	if err != nil {
+		return valid
+	}
+	for i, name := range names {
+		if i >= spfMaxNames {
+			break
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		ips, err := e.r.LookupIP(name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(e.ip) {
+				valid = append(valid, name)
+				break
+			}
+		}
+	}
+	return valid
+}
+
+// Classify a failed lookup, counting it as a void lookup if the name did
+// not exist.
+func (e *spfEval) lookupError(err error) error {
+	if IsNotFound(err) {
+		return e.void()
+	}
+	return spfTempError
+}
+
+// Count a lookup that returned no answers.
+func (e *spfEval) void() error {
+	if e.voids++; e.voids > spfMaxVoidLookups {
+		return spfPermError
+	}
+	return nil
+}
+
+// Fetch and expand the explanation for a fail result. Any problem with it
+// leaves the explanation empty.
+func (e *spfEval) explain(exp, domain string) string {
+	target, err := e.expand(exp, domain, false)
+	if err != nil {
+		return ""
+	}
+	txts, err := e.r.LookupTXT(target)
+	if err != nil || len(txts) != 1 {
+		return ""
+	}
+	text, err := e.expand(txts[0], domain, true)
+	if err != nil {
+		return ""
+	}
+	return text
+}
+
+// Expand the macros in a domain-spec, or in an explanation string if exp is
+// true, as described in RFC 7208 section 7.
+func (e *spfEval) expand(s, domain string, exp bool) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			out.WriteByte(s[i])
+			continue
+		}
+		if i++; i >= len(s) {
+			return "", spfPermError
+		}
+		switch s[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", spfPermError
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 2 {
+			return "", spfPermError
+		}
+		value, err := e.macro(s[i+1:i+end], domain, exp)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(value)
+		i += end
+	}
+	if exp {
+		return out.String(), nil
+	}
+	result := strings.TrimSuffix(out.String(), ".")
+	for len(result) > spfMaxDomainLen {
+		dot := strings.IndexByte(result, '.')
+		if dot < 0 {
+			return "", spfPermError
+		}
+		result = result[dot+1:]
+	}
+	return result, nil
+}
+
+// Expand a single macro, given as the letter, transformers and delimiters
+// between its braces.
+func (e *spfEval) macro(m, domain string, exp bool) (string, error) {
+	letter := m[0]
+	var value string
+	local, senderDomain := "postmaster", e.sender
+	if at := strings.LastIndex(e.sender, "@"); at >= 0 {
+		if at > 0 {
+			local = e.sender[:at]
+		}
+		senderDomain = e.sender[at+1:]
+	}
+	switch letter | 0x20 {
+	case 's':
+		value = e.sender
+	case 'l':
+		value = local
+	case 'o':
+		value = senderDomain
+	case 'd':
+		value = domain
+	case 'i':
+		value = spfDottedIP(e.ip)
+	case 'p':
+		value = "unknown"
+		for _, name := range e.validatedNames() {
+			if name == domain || strings.HasSuffix(name, "."+domain) {
+				value = name
+				break
+			} else if value == "unknown" {
+				value = name
+			}
+		}
+	case 'v':
+		value = "in-addr"
+		if e.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'h':
+		value = e.helo
+	case 'c', 'r', 't':
+		if !exp {
+			return "", spfPermError
+		}
+		switch letter | 0x20 {
+		case 'c':
+			value = e.ip.String()
+		case 'r':
+			value = e.receiver
+		case 't':
+			value = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+	default:
+		return "", spfPermError
+	}
+	m = m[1:]
+	digits := 0
+	for digits < len(m) && m[digits] >= '0' && m[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		keep, _ = strconv.Atoi(m[:digits])
+		if keep == 0 {
+			return "", spfPermError
+		}
+	}
+	m = m[digits:]
+	reverse := strings.HasPrefix(m, "r") || strings.HasPrefix(m, "R")
+	if reverse {
+		m = m[1:]
+	}
+	delims := "."
+	if m != "" {
+		if strings.Trim(m, ".-+,/_=") != "" {
+			return "", spfPermError
+		}
+		delims = m
+	}
+	if keep > 0 || reverse || delims != "." {
+		parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delims, r) })
+		if reverse {
+			for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+				parts[i], parts[j] = parts[j], parts[i]
+			}
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		value = strings.Join(parts, ".")
+	}
+	if letter >= 'A' && letter <= 'Z' {
+		value = strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+	}
+	return value, nil
+}
+
+// Split a term into the name and value of a modifier, if it is one.
+func spfModifier(term string) (string, string, bool) {
+	eq := strings.IndexByte(term, '=')
+	if eq < 1 {
+		return "", "", false
+	}
+	name := term[:eq]
+	for i, r := range name {
+		alpha := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if !alpha && (i == 0 || !(r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.')) {
+			return "", "", false
+		}
+	}
+	return strings.ToLower(name), term[eq+1:], true
+}
+
+// Parse the "/cidr4//cidr6" suffix of an a or mx mechanism.
+func parseDualCIDR(s string) (int, int, error) {
+	cidr4, cidr6 := 32, 128
+	if s == "" {
+		return cidr4, cidr6, nil
+	}
+	v4, v6 := s, ""
+	if i := strings.Index(s, "//"); i >= 0 {
+		v4, v6 = s[:i], s[i+2:]
+	}
+	var err error
+	if v4 != "" {
+		if cidr4, err = strconv.Atoi(strings.TrimPrefix(v4, "/")); err != nil || !strings.HasPrefix(v4, "/") || cidr4 < 0 || cidr4 > 32 {
+			return 0, 0, spfPermError
+		}
+	}
+	if v6 != "" || strings.Contains(s, "//") {
+		if cidr6, err = strconv.Atoi(v6); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return 0, 0, spfPermError
+		}
+	}
+	return cidr4, cidr6, nil
+}
+
+// Format an address as the "i" macro does: dotted octets for IPv4, dotted
+// nibbles for IPv6.
+func spfDottedIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	name := dnsblName(ip, "")
+	parts := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return strings.Join(parts, ".")
+}
+
+// Report whether a name is a fully qualified domain name made of valid
+// labels.
+func validDomain(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > spfMaxDomainLen || !strings.Contains(name, ".") {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return net.ParseIP(name) == nil && !strings.HasPrefix(name, "[")
+}
+
+// Check SPF for the client's HELO name and for the sender of a new message,
+// unless the client has authenticated. If the message must be refused, the
+// reply code and text are returned along with the checks.
+func (s *SMTPSession) checkSPF(from string) (helo, mail *SPFCheck, code int, msg string) {
+	p := s.cfg.SPF()
+	ip := RemoteIP(s.remote)
+	if p == nil || ip == nil || s.authenticated {
+		return nil, nil, 0, ""
+	}
+	r, receiver := s.cfg.Resolver(), s.cfg.ServingDomain()
+	if s.heloSPF == nil || s.heloSPF.Helo != s.helo || !s.heloSPF.IP.Equal(ip) {
+		s.heloSPF = CheckHeloSPF(r, ip, s.helo, receiver)
+	}
+	helo, mail = s.heloSPF, s.heloSPF
+	if from != "" {
+		mail = CheckSPF(r, ip, from, s.helo, receiver)
+	}
+	log.Info("%s: SPF %s, %s", s.remote, helo, mail)
+	// The HELO identity only decides the fate of a message by itself when it
+	// fails; otherwise the sender's result does.
+	for _, c := range []*SPFCheck{helo, mail} {
+		if c == helo && c != mail && c.Result != SPFFail {
+			continue
+		}
+		code, msg = c.reply(p.Action(c.Result))
+		if code != 0 {
+			return helo, mail, code, msg
+		}
+	}
+	return helo, mail, 0, ""
+}
+
+// Return the reply refusing a message for this check under the given action,
+// or a zero code if it is not refused.
+func (c *SPFCheck) reply(action string) (int, string) {
+	status := "7.23 SPF validation failed"
+	if c.Result == SPFTempError || c.Result == SPFPermError {
+		status = "7.24 SPF validation error"
+	}
+	text := fmt.Sprintf("%s: %s for %s", status, c.Result, c.Sender)
+	if c.Explanation != "" {
+		text += ": " + c.Explanation
+	}
+	switch action {
+	case SPFActionReject:
+		return 550, "5." + text
+	case SPFActionDefer:
+		return 451, "4." + text
+	}
+	return 0, ""
+}
+
+// Return the Received-SPF headers to add to the current message.
+func (s *SMTPSession) spfHeaders() string {
+	p, m := s.cfg.SPF(), s.message
+	if p == nil || m.SPF == nil {
+		return ""
+	}
+	checks := []*SPFCheck{m.HeloSPF, m.SPF}
+	if m.HeloSPF == m.SPF {
+		checks = checks[1:]
+	}
+	headers := ""
+	for _, c := range checks {
+		if p.Action(c.Result) != SPFActionIgnore {
+			headers += c.Header(s.cfg.ServingDomain())
+		}
+	}
+	return headers
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// The zone of RFC 7208 appendix A, to which each test adds its own records.
+func spfZone() *fakeResolver {
+	ips := func(s ...string) []net.IP {
+		list := make([]net.IP, len(s))
+		for i, a := range s {
+			list[i] = net.ParseIP(a)
+		}
+		return list
+	}
+	return &fakeResolver{
+		txt: map[string][]string{
+			"explain.example.com": {"%{i} is not one of %{d}'s designated mail servers."},
+		},
+		ip: map[string][]net.IP{
+			"example.com":        ips("192.0.2.10", "192.0.2.11"),
+			"amy.example.com":    ips("192.0.2.65"),
+			"bob.example.com":    ips("192.0.2.66"),
+			"mail-a.example.com": ips("192.0.2.129"),
+			"mail-b.example.com": ips("192.0.2.130"),
+			"www.example.com":    ips("192.0.2.10", "192.0.2.11"),
+			"mail-c.example.org": ips("192.0.2.140"),
+			"v6.example.com":     ips("2001:db8::10"),
+		},
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mail-a.example.com.", Pref: 10}, {Host: "mail-b.example.com.", Pref: 20}},
+			"example.org": {{Host: "mail-c.example.org.", Pref: 10}},
+		},
+		ptr: map[string][]string{
+			"192.0.2.10":  {"example.com."},
+			"192.0.2.11":  {"example.com."},
+			"192.0.2.65":  {"amy.example.com."},
+			"192.0.2.66":  {"bob.example.com."},
+			"192.0.2.129": {"mail-a.example.com."},
+			"192.0.2.130": {"mail-b.example.com."},
+			"192.0.2.140": {"mail-c.example.org."},
+			"10.0.0.4":    {"bob.example.com."},
+		},
+		fail: map[string]bool{
+			"timeout.example.com": true,
+		},
+	}
+}
+
+func TestSPF(t *testing.T) {
+	tests := []struct {
+		name    string
+		records map[string]string
+		ip      string
+		result  SPFResult
+	}{
+		// RFC 7208 appendix A.1.
+		{"a.1 all", map[string]string{"example.com": "v=spf1 +all"}, "198.51.100.1", SPFPass},
+		{"a.1 a", map[string]string{"example.com": "v=spf1 a -all"}, "192.0.2.10", SPFPass},
+		{"a.1 a", map[string]string{"example.com": "v=spf1 a -all"}, "192.0.2.65", SPFFail},
+		{"a.1 a:domain", map[string]string{"example.com": "v=spf1 a:example.org -all"}, "192.0.2.10", SPFFail},
+		{"a.1 mx", map[string]string{"example.com": "v=spf1 mx -all"}, "192.0.2.129", SPFPass},
+		{"a.1 mx", map[string]string{"example.com": "v=spf1 mx -all"}, "192.0.2.10", SPFFail},
+		{"a.1 mx:domain", map[string]string{"example.com": "v=spf1 mx:example.org -all"}, "192.0.2.140", SPFPass},
+		{"a.1 mx mx:domain", map[string]string{"example.com": "v=spf1 mx mx:example.org -all"}, "192.0.2.130", SPFPass},
+		{"a.1 mx/30", map[string]string{"example.com": "v=spf1 mx/30 mx:example.org/30 -all"}, "192.0.2.131", SPFPass},
+		{"a.1 mx/30", map[string]string{"example.com": "v=spf1 mx/30 mx:example.org/30 -all"}, "192.0.2.142", SPFPass},
+		{"a.1 mx/30", map[string]string{"example.com": "v=spf1 mx/30 mx:example.org/30 -all"}, "192.0.2.144", SPFFail},
+		{"a.1 ptr", map[string]string{"example.com": "v=spf1 ptr -all"}, "192.0.2.65", SPFPass},
+		{"a.1 ptr unvalidated", map[string]string{"example.com": "v=spf1 ptr -all"}, "10.0.0.4", SPFFail},
+		{"a.1 ip4", map[string]string{"example.com": "v=spf1 ip4:192.0.2.128/28 -all"}, "192.0.2.129", SPFPass},
+		{"a.1 ip4", map[string]string{"example.com": "v=spf1 ip4:192.0.2.128/28 -all"}, "192.0.2.65", SPFFail},
+
+		// Record selection (RFC 7208 section 4.5).
+		{"no record", nil, "192.0.2.10", SPFNone},
+		{"not spf", map[string]string{"example.com": "v=spf10 -all"}, "192.0.2.10", SPFNone},
+		{"case", map[string]string{"example.com": "V=sPf1 -all"}, "192.0.2.10", SPFFail},
+		{"empty", map[string]string{"example.com": "v=spf1"}, "192.0.2.10", SPFNeutral},
+
+		// Qualifiers (section 4.6.2).
+		{"softfail", map[string]string{"example.com": "v=spf1 ~all"}, "192.0.2.10", SPFSoftFail},
+		{"neutral", map[string]string{"example.com": "v=spf1 ?all"}, "192.0.2.10", SPFNeutral},
+
+		// Syntax errors (section 4.6).
+		{"all with argument", map[string]string{"example.com": "v=spf1 -all:foo"}, "192.0.2.10", SPFPermError},
+		{"bad ip4", map[string]string{"example.com": "v=spf1 ip4:192.0.2 -all"}, "192.0.2.10", SPFPermError},
+		{"ip6 in ip4", map[string]string{"example.com": "v=spf1 ip4:2001:db8::/32 -all"}, "192.0.2.10", SPFPermError},
+		{"unknown mechanism", map[string]string{"example.com": "v=spf1 foo -all"}, "192.0.2.10", SPFPermError},
+		{"include without domain", map[string]string{"example.com": "v=spf1 include -all"}, "192.0.2.10", SPFPermError},
+		{"two redirects", map[string]string{"example.com": "v=spf1 redirect=a.example.com redirect=b.example.com"}, "192.0.2.10", SPFPermError},
+
+		// ip6 (section 5.6).
+		{"ip6", map[string]string{"example.com": "v=spf1 ip6:2001:db8::/32 -all"}, "2001:db8::1", SPFPass},
+		{"ip6 v4 client", map[string]string{"example.com": "v=spf1 ip6:2001:db8::/32 -all"}, "192.0.2.10", SPFFail},
+		{"a v6", map[string]string{"example.com": "v=spf1 a:v6.example.com -all"}, "2001:db8::10", SPFPass},
+
+		// include and redirect (sections 5.2 and 6.1).
+		{"include pass", map[string]string{"example.com": "v=spf1 include:inc.example.com -all", "inc.example.com": "v=spf1 ip4:192.0.2.10 -all"}, "192.0.2.10", SPFPass},
+		{"include fail", map[string]string{"example.com": "v=spf1 include:inc.example.com -all", "inc.example.com": "v=spf1 -all"}, "192.0.2.10", SPFFail},
+		{"include none", map[string]string{"example.com": "v=spf1 include:none.example.com -all"}, "192.0.2.10", SPFPermError},
+		{"include temperror", map[string]string{"example.com": "v=spf1 include:timeout.example.com -all"}, "192.0.2.10", SPFTempError},
+		{"redirect", map[string]string{"example.com": "v=spf1 redirect=r.example.com", "r.example.com": "v=spf1 ip4:192.0.2.10 -all"}, "192.0.2.10", SPFPass},
+		{"redirect none", map[string]string{"example.com": "v=spf1 redirect=none.example.com"}, "192.0.2.10", SPFPermError},
+		{"redirect after match", map[string]string{"example.com": "v=spf1 +all redirect=none.example.com"}, "192.0.2.10", SPFPass},
+
+		// exists and macros (sections 5.7 and 7).
+		{"exists", map[string]string{"example.com": "v=spf1 exists:%{ir}.list.example.com -all"}, "192.0.2.10", SPFFail},
+		{"exists match", map[string]string{"example.com": "v=spf1 exists:%{l}.users.example.com -all"}, "192.0.2.99", SPFPass},
+
+		// Processing limits (section 4.6.4).
+		{"too many lookups", map[string]string{"example.com": "v=spf1 " + strings.Repeat("a:example.org ", 11) + "+all"}, "192.0.2.10", SPFPermError},
+		{"too many void lookups", map[string]string{"example.com": "v=spf1 a:n1.example.com a:n2.example.com a:n3.example.com +all"}, "192.0.2.10", SPFPermError},
+		{"two void lookups", map[string]string{"example.com": "v=spf1 a:n1.example.com a:n2.example.com +all"}, "192.0.2.10", SPFPass},
+
+		// DNS errors (section 4.4).
+		{"timeout", map[string]string{"example.com": "v=spf1 a:timeout.example.com -all"}, "192.0.2.10", SPFTempError},
+	}
+	for _, test := range tests {
+		r := spfZone()
+		for name, record := range test.records {
+			r.txt[name] = []string{record}
+		}
+		r.ip["sender.users.example.com"] = []net.IP{net.ParseIP("127.0.0.2")}
+		c := CheckSPF(r, net.ParseIP(test.ip), "sender@example.com", "client.example.net", "mx.example.net")
+		if c.Result != test.result {
+			t.Errorf("%s (%s): got %s, want %s", test.name, test.ip, c.Result, test.result)
+		}
+	}
+}
+
+func TestSPFMultipleRecords(t *testing.T) {
+	r := spfZone()
+	r.txt["example.com"] = []string{"v=spf1 +all", "v=spf1 -all"}
+	if c := CheckSPF(r, net.ParseIP("192.0.2.10"), "sender@example.com", "client.example.net", "mx"); c.Result != SPFPermError {
+		t.Errorf("got %s, want %s", c.Result, SPFPermError)
+	}
+}
+
+func TestSPFTimeout(t *testing.T) {
+	r := spfZone()
+	r.fail["example.com"] = true
+	if c := CheckSPF(r, net.ParseIP("192.0.2.10"), "sender@example.com", "client.example.net", "mx"); c.Result != SPFTempError {
+		t.Errorf("got %s, want %s", c.Result, SPFTempError)
+	}
+}
+
+func TestSPFExplanation(t *testing.T) {
+	r := spfZone()
+	r.txt["example.com"] = []string{"v=spf1 mx -all exp=explain.%{d}"}
+	c := CheckSPF(r, net.ParseIP("192.0.2.200"), "sender@example.com", "client.example.net", "mx")
+	want := "192.0.2.200 is not one of example.com's designated mail servers."
+	if c.Result != SPFFail || c.Explanation != want {
+		t.Errorf("got %s %q, want %s %q", c.Result, c.Explanation, SPFFail, want)
+	}
+}
+
+func TestSPFNullSender(t *testing.T) {
+	r := spfZone()
+	r.txt["client.example.net"] = []string{"v=spf1 ip4:192.0.2.50 -all"}
+	c := CheckSPF(r, net.ParseIP("192.0.2.50"), "", "client.example.net", "mx")
+	if c.Identity != "helo" || c.Sender != "postmaster@client.example.net" || c.Result != SPFPass {
+		t.Errorf("got %s %s %s", c.Identity, c.Sender, c.Result)
+	}
+}
+
+func TestSPFHeloNotFullyQualified(t *testing.T) {
+	for _, helo := range []string{"localhost", "[192.0.2.1]", "192.0.2.1"} {
+		if c := CheckHeloSPF(spfZone(), net.ParseIP("192.0.2.1"), helo, "mx"); c.Result != SPFNone {
+			t.Errorf("%s: got %s, want %s", helo, c.Result, SPFNone)
+		}
+	}
+}
+
+func TestSPFMacros(t *testing.T) {
+	e := &spfEval{
+		ip:       net.ParseIP("192.0.2.3"),
+		sender:   "strong-bad@email.example.com",
+		helo:     "mx.example.org",
+		receiver: "mx.example.net",
+	}
+	// Examples from RFC 7208 section 7.4.
+	tests := map[string]string{
+		"%{s}":                  "strong-bad@email.example.com",
+		"%{o}":                  "email.example.com",
+		"%{d}":                  "email.example.com",
+		"%{d4}":                 "email.example.com",
+		"%{d3}":                 "email.example.com",
+		"%{d2}":                 "example.com",
+		"%{d1}":                 "com",
+		"%{dr}":                 "com.example.email",
+		"%{d2r}":                "example.email",
+		"%{l}":                  "strong-bad",
+		"%{l-}":                 "strong.bad",
+		"%{lr}":                 "strong-bad",
+		"%{lr-}":                "bad.strong",
+		"%{l1r-}":               "strong",
+		"%{ir}.%{v}._spf.%{d2}": "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":  "bad.strong.lp._spf.example.com",
+	}
+	for macro, want := range tests {
+		got, err := e.expand(macro, "email.example.com", false)
+		if err != nil || got != want {
+			t.Errorf("%s: got %q (%v), want %q", macro, got, err, want)
+		}
+	}
+	e.ip = net.ParseIP("2001:db8::cb01")
+	got, _ := e.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com", false)
+	want := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if got != want {
+		t.Errorf("ipv6: got %q, want %q", got, want)
+	}
+	if _, err := e.expand("%{x}", "email.example.com", false); err == nil {
+		t.Errorf("bad macro %s accepted", "%{x}")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"github.com/codeslinger/log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// --- systemd integration --------------------------------------------------
+
+// Return the number of listening sockets passed by systemd socket
+// activation, if they were meant for this process. The variables are
+// cleared so they are not passed on to any child process.
+func socketActivationFds() int {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, nerr := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || nerr != nil || pid != os.Getpid() || n < 1 {
+		return 0
+	}
+	log.Info("using %d socket(s) passed by systemd", n)
+	return n
+}
+
+// Send a state update to the service manager over the datagram socket named
+// by NOTIFY_SOCKET. Does nothing when not running under systemd.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Warn("failed to connect to NOTIFY_SOCKET %s: %v", path, err)
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		log.Warn("failed to notify systemd: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Send keep-alive pings to the service manager at half the watchdog interval
+// it asked for, if it asked for one.
+func startWatchdog() {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec < 1 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.Info("sending systemd watchdog pings every %s", interval)
+	go func() {
+		for {
+			sdNotify("WATCHDOG=1")
+			time.Sleep(interval)
+		}
+	}()
+}
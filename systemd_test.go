@@ -0,0 +1,97 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Listen on a datagram socket standing in for systemd's NOTIFY_SOCKET.
+func fakeNotifySocket(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// Start a server listening on a free local port, stopping it when the test
+// ends.
+func startTestServer(t *testing.T) {
+	c := testConfig(t, "domain: mx.example.com", "listen: 127.0.0.1:0")
+	s := NewServer("", c)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, l := range s.listeners {
+			l.Close()
+		}
+	})
+}
+
+func TestReadyNotification(t *testing.T) {
+	notify := fakeNotifySocket(t)
+	startTestServer(t)
+	buf := make([]byte, 512)
+	notify.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := notify.Read(buf)
+	if err != nil || !strings.HasPrefix(string(buf[:n]), "READY=1\n") {
+		t.Errorf("got notification %q (%v), want READY=1", buf[:n], err)
+	}
+}
+
+// A process started by an upgrade is not the main process until its parent
+// says so, so it leaves reporting readiness to its parent.
+func TestUpgradedReadyNotification(t *testing.T) {
+	notify := fakeNotifySocket(t)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	// The server closes the descriptor it is given, so give it its own.
+	fd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(readyFdEnv, strconv.Itoa(fd))
+	startTestServer(t)
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Errorf("parent not told: %v", err)
+	}
+	notify.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 512)
+	if n, err := notify.Read(buf); err == nil {
+		t.Errorf("got notification %q, want none", buf[:n])
+	}
+}
+
+// Only a real shutdown says the service is stopping; after an upgrade the
+// new process carries on as the service.
+func TestStoppingNotification(t *testing.T) {
+	for _, handedOff := range []bool{false, true} {
+		notify := fakeNotifySocket(t)
+		c := testConfig(t, "domain: mx.example.com")
+		s := NewServer("", c)
+		s.handedOff = handedOff
+		s.Stop()
+		notify.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		buf := make([]byte, 512)
+		n, err := notify.Read(buf)
+		if stopping := err == nil && string(buf[:n]) == "STOPPING=1"; stopping == handedOff {
+			t.Errorf("handed off %v: got notification %q (%v)", handedOff, buf[:n], err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"github.com/codeslinger/log"
+	"time"
+)
+
+// --- Tarpitting -----------------------------------------------------------
+
+// Settings for slowing down and disconnecting clients that make errors.
+// After is the number of errors after which replies are delayed, by Delay
+// more for each further error up to Max; MaxErrors is the number of errors
+// at which the client is disconnected. Zero disables After and MaxErrors.
+type TarpitPolicy struct {
+	After     int
+	Delay     time.Duration
+	Max       time.Duration
+	MaxErrors int
+}
+
+const (
+	defaultTarpitDelay = time.Second
+	defaultTarpitMax   = 30 * time.Second
+)
+
+// Sleep before replying to a client that has made too many errors. The
+// delay grows with each error past the policy's threshold, up to its
+// maximum.
+func (s *SMTPSession) tarpit(code int) {
+	p := s.cfg.Tarpit()
+	if p.After < 1 || s.errors < p.After || code == 221 || code == 421 {
+		return
+	}
+	delay := time.Duration(s.errors-p.After+1) * p.Delay
+	if delay > p.Max {
+		delay = p.Max
+	}
+	time.Sleep(delay)
+}
+
+// Count a reply with the given code against the client if it reports an
+// error, disconnecting the client once it has made too many.
+func (s *SMTPSession) countError(code int) Verdict {
+	if code < 500 {
+		return Continue
+	}
+	s.errors++
+	p := s.cfg.Tarpit()
+	if p.MaxErrors > 0 && s.errors >= p.MaxErrors {
+		log.Warn("%s: disconnecting after %d errors", s.remote, s.errors)
+		s.respond(421, "4.7.0 Too many errors, closing connection")
+		return Terminate
+	}
+	return Continue
+}
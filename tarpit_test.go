@@ -0,0 +1,19 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTarpitMax(t *testing.T) {
+	cfg := testConfig(t, "domain: mx.example.com", "tarpitafter: 1", "tarpitdelay: 1", "tarpitmax: 1")
+	c := startSession(t, cfg, "198.51.100.7", nil)
+	c.send(500, "BOGUS")
+	c.send(500, "BOGUS")
+	start := time.Now()
+	c.send(500, "BOGUS")
+	if d := time.Since(start); d < time.Second || d > 1900*time.Millisecond {
+		t.Errorf("third error delayed %s, want 1s", d)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codeslinger/log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Binary upgrade -------------------------------------------------------
+
+// Environment variables used to hand listening sockets to a new process.
+// Inherited sockets start at file descriptor 3; the readiness pipe follows
+// them.
+const (
+	listenFdsEnv = "GO25_LISTEN_FDS"
+	readyFdEnv   = "GO25_READY_FD"
+)
+
+const (
+	inheritedFdStart = 3
+	upgradeReadySecs = 30
+)
+
+var (
+	UpgradeInProgress = errors.New("an upgrade is already in progress")
+	UpgradeNotReady   = errors.New("new process did not report ready in time")
+)
+
+// A listening socket whose file descriptor can be passed to another process.
+type fileListener interface {
+	net.Listener
+	File() (*os.File, error)
+}
+
+// Start a new instance of the running binary with the given listeners passed
+// as inherited file descriptors, and wait for it to report that it has
+// started accepting connections on them. Returns the new process ID.
+func execUpgrade(listeners []net.Listener) (int, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	for _, l := range listeners {
+		fl, ok := l.(fileListener)
+		if !ok {
+			return 0, errors.New(fmt.Sprintf("cannot pass listener for %s", l.Addr()))
+		}
+		f, err := fl.File()
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	// The watchdog belongs to whichever process is the main one, so the new
+	// process must not think it is meant for someone else.
+	env := make([]string, 0)
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, listenFdsEnv+"=") &&
+			!strings.HasPrefix(v, readyFdEnv+"=") &&
+			!strings.HasPrefix(v, "WATCHDOG_PID=") {
+			env = append(env, v)
+		}
+	}
+	env = append(env,
+		fmt.Sprintf("%s=%d", listenFdsEnv, len(listeners)),
+		fmt.Sprintf("%s=%d", readyFdEnv, len(files)))
+	files = append(files, w)
+	p, err := os.StartProcess(path, os.Args, &os.ProcAttr{Env: env, Files: files})
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+	log.Info("started new process %d (%s), waiting for it to become ready", p.Pid, path)
+	r.SetReadDeadline(time.Now().Add(time.Second * upgradeReadySecs))
+	if _, err = r.Read(make([]byte, 1)); err != nil {
+		p.Kill()
+		p.Wait()
+		return 0, UpgradeNotReady
+	}
+	pid := p.Pid
+	go p.Release()
+	return pid, nil
+}
+
+// Return any listening sockets handed down from a parent process during an
+// upgrade, or passed by systemd socket activation.
+func inheritedListeners() []net.Listener {
+	listeners := make([]net.Listener, 0)
+	n, err := strconv.Atoi(os.Getenv(listenFdsEnv))
+	os.Unsetenv(listenFdsEnv)
+	if err != nil {
+		if n = socketActivationFds(); n == 0 {
+			return listeners
+		}
+	}
+	for fd := inheritedFdStart; fd < inheritedFdStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listener-%d", fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Error("failed to use inherited file descriptor %d: %v", fd, err)
+			continue
+		}
+		log.Info("inherited listener for %s", l.Addr())
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+// Remove and return the listener bound to the given address from the list,
+// or nil if there is none. Unspecified addresses match each other whatever
+// their address family, since the kernel reports 0.0.0.0 as [::].
+func takeListener(listeners []net.Listener, addr net.Addr) ([]net.Listener, net.Listener) {
+	for i, l := range listeners {
+		if sameAddr(l.Addr(), addr) {
+			return append(listeners[:i], listeners[i+1:]...), l
+		}
+	}
+	return listeners, nil
+}
+
+// Report whether a listener's local address is the configured one.
+func sameAddr(la, addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		t, ok := la.(*net.TCPAddr)
+		if !ok || t.Port != a.Port {
+			return false
+		}
+		return t.IP.Equal(a.IP) || (isUnspecified(t.IP) && isUnspecified(a.IP))
+	case *net.UnixAddr:
+		u, ok := la.(*net.UnixAddr)
+		return ok && u.Name == a.Name
+	}
+	return false
+}
+
+func isUnspecified(ip net.IP) bool {
+	return ip == nil || ip.IsUnspecified()
+}
+
+// Tell the parent process, if any, that this process has started accepting
+// connections. Reports whether there was a parent to tell.
+func notifyParentReady() bool {
+	fd, err := strconv.Atoi(os.Getenv(readyFdEnv))
+	os.Unsetenv(readyFdEnv)
+	if err != nil {
+		return false
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+	return true
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2012-2013 Toby DiPasquale.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codeslinger/log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// --- XCLIENT and XFORWARD -------------------------------------------------
+
+// Attributes accepted by XCLIENT and XFORWARD, as advertised in EHLO.
+var (
+	XclientAttrs  = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "LOGIN"}
+	XforwardAttrs = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "IDENT", "SOURCE"}
+)
+
+// Values a front-end sends when it does not know an attribute.
+const (
+	xUnavailable     = "[UNAVAILABLE]"
+	xTempUnavailable = "[TEMPUNAVAIL]"
+)
+
+var (
+	MalformedAttribute = errors.New("malformed attribute")
+	UnknownAttribute   = errors.New("unknown attribute")
+)
+
+// Process an XCLIENT command, replacing what this session knows about the
+// client with what the trusted front-end says. On success the session
+// starts over with a new greeting.
+func (s *SMTPSession) handleXclient(data []byte) Verdict {
+	if !s.xclient {
+		return s.respondWithVerdict(550, "Insufficient authorization")
+	}
+	if s.state > heloReceived {
+		return s.codeWithVerdict(503)
+	}
+	attrs, err := parseXattrs(data, XclientAttrs)
+	if err != nil {
+		return s.respondWithVerdict(501, fmt.Sprintf("Bad XCLIENT attribute: %v", err))
+	}
+	addr := RemoteIP(s.remote)
+	port := 0
+	if tcp, ok := s.remote.(*net.TCPAddr); ok {
+		port = tcp.Port
+	}
+	for name, value := range attrs {
+		switch name {
+		case "ADDR":
+			if value == "" {
+				continue
+			}
+			if addr = net.ParseIP(strings.TrimPrefix(value, "IPV6:")); addr == nil {
+				return s.respondWithVerdict(501, "Bad XCLIENT ADDR syntax")
+			}
+		case "PORT":
+			if value == "" {
+				continue
+			}
+			if port, err = strconv.Atoi(value); err != nil || port < 0 || port > 65535 {
+				return s.respondWithVerdict(501, "Bad XCLIENT PORT syntax")
+			}
+		case "NAME":
+			s.clientName = value
+		case "HELO":
+			s.helo = value
+			s.heloFixed = value != ""
+		case "LOGIN":
+			s.login = value
+			s.authenticated = value != ""
+		case "PROTO":
+			s.proto = strings.ToUpper(value)
+		}
+	}
+	if addr != nil {
+		s.remote = &net.TCPAddr{IP: addr, Port: port}
+	}
+	log.Info("%s: XCLIENT from %s: name=%s helo=%s login=%s",
+		s.remote, s.peer, s.clientName, s.helo, s.login)
+	if verdict := s.checkDNSBL(); verdict == Terminate {
+		return verdict
+	}
+	if verdict := s.connectMilters(); verdict == Terminate {
+		return verdict
+	}
+	s.state = bannerSent
+	s.message = nil
+	return s.respondWithVerdict(220, s.banner())
+}
+
+// Process an XFORWARD command, recording attributes of the original client
+// for the next message in this session.
+func (s *SMTPSession) handleXforward(data []byte) Verdict {
+	if !s.xforward {
+		return s.respondWithVerdict(550, "Insufficient authorization")
+	}
+	if s.state != heloReceived && s.state != bodyReceived {
+		return s.codeWithVerdict(503)
+	}
+	attrs, err := parseXattrs(data, XforwardAttrs)
+	if err != nil {
+		return s.respondWithVerdict(501, fmt.Sprintf("Bad XFORWARD attribute: %v", err))
+	}
+	if s.forward == nil {
+		s.forward = &ForwardInfo{}
+	}
+	for name, value := range attrs {
+		switch name {
+		case "NAME":
+			s.forward.Name = value
+		case "ADDR":
+			s.forward.Addr = strings.TrimPrefix(value, "IPV6:")
+		case "PORT":
+			s.forward.Port = value
+		case "PROTO":
+			s.forward.Proto = strings.ToUpper(value)
+		case "HELO":
+			s.forward.Helo = value
+		case "IDENT":
+			s.forward.Ident = value
+		case "SOURCE":
+			s.forward.Source = strings.ToUpper(value)
+		}
+	}
+	return s.codeWithVerdict(250)
+}
+
+// Parse the "NAME=value" arguments of an XCLIENT or XFORWARD command line,
+// decoding xtext values. Unavailable values are returned as empty strings.
+func parseXattrs(line []byte, allowed []string) (map[string]string, error) {
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return nil, MalformedAttribute
+	}
+	attrs := make(map[string]string)
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, MalformedAttribute
+		}
+		name := strings.ToUpper(kv[0])
+		known := false
+		for _, a := range allowed {
+			known = known || a == name
+		}
+		if !known {
+			return nil, UnknownAttribute
+		}
+		value, err := decodeXtext(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		if value == xUnavailable || value == xTempUnavailable {
+			value = ""
+		}
+		attrs[name] = value
+	}
+	return attrs, nil
+}
+
+// Decode an RFC 3461 xtext string, in which "+XX" stands for the byte with
+// hex value XX.
+func decodeXtext(s string) (string, error) {
+	if !strings.Contains(s, "+") {
+		return s, nil
+	}
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", MalformedAttribute
+		}
+		b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", MalformedAttribute
+		}
+		out = append(out, byte(b))
+		i += 2
+	}
+	return string(out), nil
+}